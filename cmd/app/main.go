@@ -1,48 +1,136 @@
 package main
 
 import (
+	"cloudbuddy/internal/app/apierror"
 	"cloudbuddy/internal/app/middleware"
+	"cloudbuddy/internal/app/repository"
 	"cloudbuddy/internal/app/routes"
+	"cloudbuddy/internal/pkg"
+	"flag"
+	"log"
+	"os"
 	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
-	cl "github.com/ostafen/clover/v2"
 )
 
 func main() {
-	db, _ := cl.Open("clover-db")
-	defer db.Close()
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "yaml or toml config file, settings in the environment take precedence")
+	flag.Parse()
 
-	if has, _ := db.HasCollection("images"); !has {
-		db.CreateCollection("images")
+	cfg, err := pkg.LoadConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
 	}
-	if has, _ := db.HasCollection("users"); !has {
-		db.CreateCollection("users")
+
+	var repos *repository.Repositories
+	switch cfg.DatabaseDriver {
+	case pkg.DatabaseSqlite, pkg.DatabasePostgres:
+		sqlDb, err := repository.OpenSql(cfg.DatabaseDriver, cfg.DatabaseUrl)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer sqlDb.Close()
+
+		// replicas used to keep everything in a clover database of their own
+		err = repository.ImportClover(sqlDb, cfg.DatabaseDriver, cfg.DatabaseDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		repos = repository.NewSqlRepositories(sqlDb, cfg.DatabaseDriver)
+	default:
+		db, err := repository.OpenClover(cfg.DatabaseDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer db.Close()
+
+		repos = repository.NewCloverRepositories(db)
+	}
+
+	routes.BootstrapAdmins(repos, cfg)
+
+	// loaded once, everything signing or verifying tokens gets handed the ring
+	keyRing, err := pkg.LoadKeyRing(cfg.Jwt)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	r := gin.Default()
+	urls := pkg.NewUrlResolver(cfg.Bucket)
+
+	if cfg.Bucket.ExportsEnabled() {
+		go routes.RunExportCleanup(repos, cfg, 10*time.Minute)
+	} else {
+		log.Println("Exports are disabled, set BUCKET_EXPORTS_NAME to a private bucket to enable them")
+	}
+
+	r := gin.New()
+	r.Use(gin.Logger(), middleware.RequestId(), middleware.Recovery(), middleware.ErrorHandler())
 	r.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"*"},
 		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization"},
-		ExposeHeaders:    []string{"Content-Length"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", pkg.CsrfHeader, middleware.RequestIdHeader},
+		ExposeHeaders:    []string{"Content-Length", "Retry-After", middleware.RequestIdHeader},
 		AllowCredentials: true,
 		MaxAge:           12 * time.Hour,
 	}))
+	r.NoRoute(func(c *gin.Context) {
+		apierror.Abort(c, apierror.ErrNotFound)
+	})
+	r.GET("/.well-known/jwks.json", routes.GetJwks(keyRing))
+
 	images := r.Group("/v1/images")
 
-	images.GET("", routes.GetAllImages(db))
-	images.GET("/:id", routes.GetImageById(db))
-	images.POST("", middleware.DecodeJwtMiddleware(db), routes.PostImage(db))
-	images.PUT("/:id/like", routes.LikeImage(db))
-	images.PUT("/:id/dislike", routes.DislikeImage(db))
-	images.PUT(":id/changeTitle", middleware.DecodeJwtMiddleware(db), routes.ChangeImageTitle(db))
-	images.DELETE("/:id", middleware.DecodeJwtMiddleware(db), routes.DeleteImage(db))
+	images.GET("", middleware.OptionalApiKeyMiddleware(repos, pkg.ScopeImagesRead), routes.GetAllImages(repos, urls))
+	images.GET("/:id", middleware.OptionalApiKeyMiddleware(repos, pkg.ScopeImagesRead), routes.GetImageById(repos, urls))
+	images.POST("", middleware.ApiKeyMiddleware(repos, cfg, keyRing, pkg.ScopeImagesWrite), routes.PostImage(repos, cfg, urls))
+	images.PUT("/:id/like", routes.LikeImage(repos))
+	images.PUT("/:id/dislike", routes.DislikeImage(repos))
+	images.PUT(":id/changeTitle", middleware.ApiKeyMiddleware(repos, cfg, keyRing, pkg.ScopeImagesWrite), routes.ChangeImageTitle(repos))
+	images.DELETE("/:id", middleware.ApiKeyMiddleware(repos, cfg, keyRing, pkg.ScopeImagesDelete), routes.DeleteImage(repos))
 
 	auth := r.Group("/v1/auth")
-	auth.POST("/signup", routes.Signup(db))
-	auth.POST("/signin", routes.Signin(db))
+	auth.POST("/signup", routes.Signup(repos, cfg, keyRing))
+	auth.GET("/username", routes.CheckUsername(repos))
+	auth.POST("/signin", routes.Signin(repos, cfg, keyRing))
+	auth.POST("/signin/2fa", routes.SigninTwoFactor(repos, cfg, keyRing))
+	auth.POST("/refresh", routes.Refresh(repos, cfg, keyRing))
+	auth.POST("/signout", routes.Signout(repos, cfg, keyRing))
+	auth.POST("/forgot", routes.ForgotPassphrase(repos, cfg))
+	auth.POST("/reset", routes.ResetPassphrase(repos, cfg))
+	auth.GET("/verify", routes.VerifyEmail(repos))
+	auth.POST("/webauthn/register/begin", middleware.DecodeJwtMiddleware(repos, cfg, keyRing), routes.BeginWebAuthnRegistration(repos, cfg))
+	auth.POST("/webauthn/register/finish", middleware.DecodeJwtMiddleware(repos, cfg, keyRing), routes.FinishWebAuthnRegistration(repos, cfg))
+	auth.POST("/webauthn/login/begin", routes.BeginWebAuthnLogin(repos, cfg))
+	auth.POST("/webauthn/login/finish", routes.FinishWebAuthnLogin(repos, cfg, keyRing))
+	auth.GET("/oidc/:provider", routes.StartOidc(repos, cfg))
+	auth.GET("/oidc/:provider/callback", routes.OidcCallback(repos, cfg, keyRing))
+
+	me := r.Group("/v1/me", middleware.DecodeJwtMiddleware(repos, cfg, keyRing))
+	me.POST("/passphrase", routes.ChangePassphrase(repos, cfg, keyRing))
+	me.PUT("/email", routes.ChangeEmail(repos, cfg))
+	me.POST("/email/verify", routes.ResendEmailVerification(repos, cfg))
+	me.GET("/sessions", routes.GetSessions(repos))
+	me.DELETE("/sessions", routes.DeleteOtherSessions(repos))
+	me.DELETE("/sessions/:id", routes.DeleteSession(repos, cfg))
+	me.POST("/2fa/totp", routes.EnrollTotp(repos))
+	me.POST("/2fa/totp/confirm", routes.ConfirmTotp(repos))
+	me.DELETE("/2fa/totp", routes.DisableTotp(repos))
+	me.GET("/credentials", routes.GetCredentials(repos))
+	me.DELETE("/credentials/:id", routes.DeleteCredential(repos))
+	me.GET("/oidc/:provider/link", routes.StartOidc(repos, cfg))
+	me.GET("/api-keys", routes.GetApiKeys(repos))
+	me.POST("/api-keys", routes.CreateApiKey(repos))
+	me.DELETE("/api-keys/:id", routes.DeleteApiKey(repos))
+	me.POST("/export", routes.RequestExport(repos, cfg, urls))
+	me.GET("/export/:id", routes.GetExport(repos, cfg))
+
+	admin := r.Group("/v1/admin", middleware.RequirePermission(repos, cfg, keyRing, pkg.PermissionManageUsers))
+	admin.GET("/users", routes.GetUsers(repos))
+	admin.PUT("/users/:id/role", routes.ChangeUserRole(repos))
+	admin.DELETE("/users/:id/sessions", routes.RevokeUserSessions(repos))
 
-	r.Run()
+	r.Run(":" + cfg.Port)
 }
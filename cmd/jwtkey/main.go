@@ -0,0 +1,28 @@
+// generates a new jwt signing key, see pkg.LoadKeyRing for how keys are
+// rotated
+package main
+
+import (
+	"cloudbuddy/internal/pkg"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+func main() {
+	dir := flag.String("dir", "jwt-keys", "directory holding the signing keys")
+	alg := flag.String("alg", pkg.SigningAlgEdDSA, "signing algorithm, EdDSA or RS256")
+	flag.Parse()
+
+	if err := os.MkdirAll(*dir, 0700); err != nil {
+		log.Fatal(err)
+	}
+
+	path, err := pkg.GenerateSigningKey(*dir, *alg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Println(path)
+}
@@ -0,0 +1,186 @@
+package apierror
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errors are served as rfc 7807 problem details. code is stable and meant
+// for clients to branch on, title and detail are for humans and may change.
+const ContentType = "application/problem+json"
+
+// the prefix of the type uri, the code is appended
+const typePrefix = "urn:cloudbuddy:problem:"
+
+type Error struct {
+	Type      string      `json:"type"`
+	Title     string      `json:"title"`
+	Status    int         `json:"status"`
+	Detail    string      `json:"detail,omitempty"`
+	Instance  string      `json:"instance,omitempty"`
+	Code      string      `json:"code"`
+	RequestId string      `json:"request_id,omitempty"`
+	Details   interface{} `json:"details,omitempty"`
+	// field level validation errors
+	Errors interface{} `json:"errors,omitempty"`
+
+	// the underlying error, logged but never served
+	cause error
+}
+
+func New(status int, code string, title string) *Error {
+	return &Error{
+		Type:   typePrefix + code,
+		Title:  title,
+		Status: status,
+		Code:   code,
+	}
+}
+
+func (e *Error) Error() string {
+	msg := e.Code
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+	if e.cause != nil {
+		msg += ": " + e.cause.Error()
+	}
+
+	return msg
+}
+
+func (e *Error) Unwrap() error {
+	return e.cause
+}
+
+// errors with the same code match, so errors.Is works on copies made by the
+// With* methods
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// the catalog errors are shared, so every modification returns a copy
+func (e *Error) clone() *Error {
+	c := *e
+	return &c
+}
+
+func (e *Error) WithDetail(detail string) *Error {
+	c := e.clone()
+	c.Detail = detail
+	return c
+}
+
+func (e *Error) WithDetailf(format string, args ...interface{}) *Error {
+	return e.WithDetail(fmt.Sprintf(format, args...))
+}
+
+func (e *Error) WithDetails(details interface{}) *Error {
+	c := e.clone()
+	c.Details = details
+	return c
+}
+
+func (e *Error) WithErrors(errs interface{}) *Error {
+	c := e.clone()
+	c.Errors = errs
+	return c
+}
+
+func (e *Error) Wrap(err error) *Error {
+	c := e.clone()
+	c.cause = err
+	return c
+}
+
+// converts any error into an api error. errors which aren't api errors
+// become internal errors.
+func From(err error) *Error {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+
+	return ErrInternal.Wrap(err)
+}
+
+// an internal error caused by err
+func Internal(err error) *Error {
+	return ErrInternal.Wrap(err)
+}
+
+// records the error for the error middleware and stops the handler chain
+func Abort(c *gin.Context, err error) {
+	_ = c.Error(err)
+	c.Abort()
+}
+
+// writes the error as problem details
+func Write(c *gin.Context, err *Error) {
+	c.Header("Content-Type", ContentType)
+	c.JSON(err.Status, err)
+}
+
+var (
+	ErrInternal             = New(http.StatusInternalServerError, "internal_error", "An error occurred on the server")
+	ErrBadRequest           = New(http.StatusBadRequest, "bad_request", "The request is invalid")
+	ErrValidation           = New(http.StatusBadRequest, "validation_failed", "The request has invalid fields")
+	ErrUnauthorized         = New(http.StatusUnauthorized, "unauthorized", "Authentication is required")
+	ErrForbidden            = New(http.StatusForbidden, "forbidden", "You are not allowed to do this")
+	ErrNotFound             = New(http.StatusNotFound, "not_found", "The resource was not found")
+	ErrMethodNotAllowed     = New(http.StatusMethodNotAllowed, "method_not_allowed", "The method is not allowed for this resource")
+	ErrConflict             = New(http.StatusConflict, "conflict", "The request conflicts with the current state")
+	ErrUnsupportedMediaType = New(http.StatusUnsupportedMediaType, "unsupported_media_type", "The media type is not supported")
+	ErrTooManyRequests      = New(http.StatusTooManyRequests, "too_many_requests", "Too many requests")
+
+	// authentication
+	ErrAuthorizationMissing      = New(http.StatusUnauthorized, "authorization_missing", "Authorization header missing")
+	ErrAuthorizationMalformed    = New(http.StatusUnauthorized, "authorization_malformed", "Invalid Authorization header format")
+	ErrTokenExpired              = New(http.StatusUnauthorized, "token_expired", "Authorization token is expired")
+	ErrTokenInvalid              = New(http.StatusUnauthorized, "token_invalid", "Authorization token is invalid")
+	ErrTokenRevoked              = New(http.StatusUnauthorized, "token_revoked", "Authorization token has been revoked")
+	ErrSessionRevoked            = New(http.StatusUnauthorized, "session_revoked", "Session has been revoked")
+	ErrRefreshTokenInvalid       = New(http.StatusUnauthorized, "refresh_token_invalid", "Refresh token is invalid")
+	ErrCsrfInvalid               = New(http.StatusForbidden, "csrf_invalid", "CSRF token missing or invalid")
+	ErrApiKeyInvalid             = New(http.StatusUnauthorized, "api_key_invalid", "Invalid api key")
+	ErrInsufficientScope         = New(http.StatusForbidden, "insufficient_scope", "The api key is missing a required scope")
+	ErrInvalidCredentials        = New(http.StatusUnauthorized, "invalid_credentials", "Username or passphrase is incorrect")
+	ErrPassphraseIncorrect       = New(http.StatusForbidden, "passphrase_incorrect", "Passphrase is incorrect")
+	ErrRecentSigninRequired      = New(http.StatusForbidden, "recent_signin_required", "Sign in again to do this")
+	ErrSigninThrottled           = New(http.StatusTooManyRequests, "signin_throttled", "Too many failed signin attempts, try again later")
+	ErrChallengeInvalid          = New(http.StatusUnauthorized, "challenge_invalid", "Challenge token is invalid or expired")
+	ErrCodeIncorrect             = New(http.StatusBadRequest, "code_incorrect", "Code is incorrect")
+	ErrPasskeySigninFailed       = New(http.StatusUnauthorized, "passkey_signin_failed", "Passkey signin failed")
+	ErrPasskeyRegistrationFailed = New(http.StatusBadRequest, "passkey_registration_failed", "Passkey registration failed")
+	ErrPasskeysDisabled          = New(http.StatusNotImplemented, "passkeys_disabled", "Passkeys are not enabled on this server")
+	ErrExportsDisabled           = New(http.StatusNotImplemented, "exports_disabled", "Exports are not enabled on this server")
+	ErrWebAuthnChallengeInvalid  = New(http.StatusBadRequest, "webauthn_challenge_invalid", "Webauthn challenge not found or expired")
+	ErrIdentityProvider          = New(http.StatusUnauthorized, "identity_provider_error", "Signin with identity provider failed")
+	ErrUnknownOidcProvider       = New(http.StatusNotFound, "oidc_provider_unknown", "Unknown identity provider")
+	ErrOidcStateInvalid          = New(http.StatusBadRequest, "oidc_state_invalid", "State is invalid or expired")
+	ErrTwoFactorEnabled          = New(http.StatusConflict, "two_factor_enabled", "Two-factor authentication is already enabled")
+	ErrTwoFactorNotStarted       = New(http.StatusConflict, "two_factor_not_started", "Two-factor enrollment has not been started")
+	ErrTwoFactorDisabled         = New(http.StatusConflict, "two_factor_disabled", "Two-factor authentication is not enabled")
+
+	// accounts
+	ErrUsernameTaken            = New(http.StatusConflict, "username_taken", "A user with that username already exists")
+	ErrEmailTaken               = New(http.StatusConflict, "email_taken", "A user with that email already exists")
+	ErrEmailMissing             = New(http.StatusConflict, "email_missing", "No email has been set")
+	ErrEmailAlreadyVerified     = New(http.StatusConflict, "email_already_verified", "Email is already verified")
+	ErrEmailNotVerified         = New(http.StatusForbidden, "email_not_verified", "Verify your email first")
+	ErrVerificationTokenInvalid = New(http.StatusBadRequest, "verification_token_invalid", "Verification token is invalid or expired")
+	ErrResetTokenInvalid        = New(http.StatusBadRequest, "reset_token_invalid", "Reset token is invalid or expired")
+	ErrIdentityLinked           = New(http.StatusConflict, "identity_linked", "This account is already linked to another user")
+
+	// resources
+	ErrImageNotFound   = New(http.StatusNotFound, "image_not_found", "Image not found")
+	ErrUserNotFound    = New(http.StatusNotFound, "user_not_found", "User not found")
+	ErrSessionNotFound = New(http.StatusNotFound, "session_not_found", "Session not found")
+	ErrPasskeyNotFound = New(http.StatusNotFound, "passkey_not_found", "Passkey not found")
+	ErrApiKeyNotFound  = New(http.StatusNotFound, "api_key_not_found", "Api key not found")
+	ErrExportNotFound  = New(http.StatusNotFound, "export_not_found", "Export not found")
+)
@@ -0,0 +1,106 @@
+package middleware
+
+import (
+	"cloudbuddy/internal/app/apierror"
+	"cloudbuddy/internal/app/repository"
+	"cloudbuddy/internal/pkg"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// accepts `Authorization: ApiKey <key>` for keys carrying the given scope and
+// falls back to DecodeJwtMiddleware for everything else. the key's scopes are
+// attached to the request as "api_key_scopes".
+func ApiKeyMiddleware(repos *repository.Repositories, cfg *pkg.Config, keyRing *pkg.KeyRing, scope string) gin.HandlerFunc {
+	decodeJwt := DecodeJwtMiddleware(repos, cfg, keyRing)
+
+	return func(c *gin.Context) {
+		key, ok := apiKeyFromRequest(c)
+		if !ok {
+			decodeJwt(c)
+			return
+		}
+
+		if authenticateApiKey(repos, c, key, scope) {
+			c.Next()
+		}
+	}
+}
+
+// for routes anyone may read. requests without an api key pass untouched, a
+// request which presents one must present a valid key carrying the scope.
+func OptionalApiKeyMiddleware(repos *repository.Repositories, scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key, ok := apiKeyFromRequest(c)
+		if !ok {
+			c.Next()
+			return
+		}
+
+		if authenticateApiKey(repos, c, key, scope) {
+			c.Next()
+		}
+	}
+}
+
+func apiKeyFromRequest(c *gin.Context) (string, bool) {
+	scheme, key, _ := strings.Cut(c.GetHeader("Authorization"), " ")
+	if !strings.EqualFold(scheme, "apikey") {
+		return "", false
+	}
+
+	return key, true
+}
+
+// checks the key and its scope and attaches the user it belongs to. the
+// request is aborted and false returned when that fails.
+func authenticateApiKey(repos *repository.Repositories, c *gin.Context, key string, scope string) bool {
+	prefix, ok := pkg.ApiKeyPrefix(key)
+	if !ok {
+		apierror.Abort(c, apierror.ErrApiKeyInvalid)
+		return false
+	}
+
+	apiKey, err := repos.ApiKeys.FindByPrefix(prefix)
+	if err != nil {
+		apierror.Abort(c, apierror.Internal(err))
+		return false
+	}
+
+	if apiKey == nil || !pkg.CheckApiKeyHash(key, apiKey.KeyHash) {
+		apierror.Abort(c, apierror.ErrApiKeyInvalid)
+		return false
+	}
+
+	granted := false
+	for _, s := range apiKey.Scopes {
+		if s == scope {
+			granted = true
+			break
+		}
+	}
+
+	if !granted {
+		apierror.Abort(c, apierror.ErrInsufficientScope.WithDetail("api key is missing the "+scope+" scope"))
+		return false
+	}
+
+	user, err := repos.Users.FindById(apiKey.UserId)
+	if err != nil || user == nil {
+		apierror.Abort(c, apierror.ErrApiKeyInvalid.WithDetail("user corresponding to api key not found"))
+		return false
+	}
+
+	err = repos.ApiKeys.SetLastUsedAt(apiKey.UUID, time.Now())
+	if err != nil {
+		log.Println(err)
+	}
+
+	c.Set("user", user)
+	c.Set("api_key_scopes", apiKey.Scopes)
+
+	return true
+}
@@ -1,118 +1,120 @@
 package middleware
 
 import (
+	"cloudbuddy/internal/app/apierror"
+	"cloudbuddy/internal/app/repository"
+	"cloudbuddy/internal/pkg"
 	"errors"
-	"fmt"
-	"log"
 	"net/http"
-	"os"
 	"strings"
-	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
-	"github.com/joho/godotenv"
-	cl "github.com/ostafen/clover/v2"
 )
 
-func DecodeJwtMiddleware(db *cl.DB) gin.HandlerFunc {
+func DecodeJwtMiddleware(repos *repository.Repositories, cfg *pkg.Config, keyRing *pkg.KeyRing) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		err := godotenv.Load()
-		if err != nil {
-			log.Printf("Couldn't load environment variables: %v", err)
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
-				"message": "An unexpected error occured on the server",
-			})
-			return
+		if authenticate(repos, cfg, keyRing, c) {
+			c.Next()
 		}
+	}
+}
 
-		jwtSecret := os.Getenv("JWT_SECRET")
-		if jwtSecret == "" {
-			log.Printf("JWT_SECRET environment variable is not set: %v", err)
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
-				"message": "An unexpected error occured on the server",
-			})
-			return
-		}
+// validates the access token of the request and attaches the user and
+// session. the request is aborted and false returned when that fails.
+func authenticate(repos *repository.Repositories, cfg *pkg.Config, keyRing *pkg.KeyRing, c *gin.Context) bool {
+	tokenString, ok := tokenFromRequest(c)
+	if !ok {
+		return false
+	}
 
-		authorizationHeader := c.GetHeader("Authorization")
-		if authorizationHeader == "" {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
-				"message": "Authorization header missing",
-			})
-			return
+	claims, err := pkg.ParseAccessToken(keyRing, cfg.Jwt, tokenString)
+	if err != nil {
+		if errors.Is(err, jwt.ErrTokenExpired) {
+			apierror.Abort(c, apierror.ErrTokenExpired)
+		} else if errors.Is(err, pkg.ErrInvalidAccessToken) {
+			apierror.Abort(c, apierror.ErrTokenInvalid.Wrap(err))
+		} else {
+			apierror.Abort(c, apierror.Internal(err))
 		}
+		return false
+	}
+
+	// tokens revoked before they expired, e.g. on signout
+	revoked, err := repos.RevokedTokens.IsRevoked(claims.ID)
+	if err != nil {
+		apierror.Abort(c, apierror.Internal(err))
+		return false
+	}
+	if revoked {
+		apierror.Abort(c, apierror.ErrTokenRevoked)
+		return false
+	}
+
+	// find the user with token Subject (userId)
+	user, err := repos.Users.FindById(claims.Subject)
+	if err != nil {
+		apierror.Abort(c, apierror.ErrUnauthorized)
+		return false
+	}
 
+	if user == nil {
+		apierror.Abort(c, apierror.ErrUnauthorized.WithDetail("user corresponding to token not found"))
+		return false
+	}
+
+	// tokens issued before the last passphrase change are revoked
+	if claims.TokenVersion < user.TokenVersion {
+		apierror.Abort(c, apierror.ErrTokenRevoked)
+		return false
+	}
+
+	// the session the token was issued for must still be active
+	session, err := repos.Sessions.FindById(claims.SessionId)
+	if err != nil || session == nil || session.Revoked {
+		apierror.Abort(c, apierror.ErrSessionRevoked)
+		return false
+	}
+
+	// attach the request
+	c.Set("user", user)
+	c.Set("session_id", claims.SessionId)
+	c.Set("token_claims", claims)
+
+	return true
+}
+
+// the token comes from the Authorization header or, for browser clients, from
+// the Authorization cookie. requests authenticated by cookie which change state
+// must carry the csrf token in the X-CSRF-Token header. the request is aborted
+// and false returned when no usable token is present.
+func tokenFromRequest(c *gin.Context) (string, bool) {
+	authorizationHeader := c.GetHeader("Authorization")
+	if authorizationHeader != "" {
 		bearerToken := strings.Split(authorizationHeader, " ")
 		if len(bearerToken) != 2 || strings.ToLower(bearerToken[0]) != "bearer" {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
-				"message": "Invalid Authorization header format",
-			})
-			return
+			apierror.Abort(c, apierror.ErrAuthorizationMalformed)
+			return "", false
 		}
 
-		tokenString := bearerToken[1]
-
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			// validate the alg is what you expect:
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-			}
-
-			return []byte(jwtSecret), nil
-		})
-
-		if err != nil {
-			if errors.Is(err, jwt.ErrTokenExpired) {
-				log.Printf("jwt token parsing failed: %v", err)
-				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
-					"message": "Authorization token is expired",
-				})
-				return
-			} else {
-				log.Printf("jwt token parsing failed: %t", err)
-				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
-					"message": "An unexpected error occured on the server",
-				})
-				return
-			}
-		}
+		return bearerToken[1], true
+	}
 
-		if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-			// check the expiry date
-			if float64(time.Now().Unix()) > claims["exp"].(float64) {
-				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
-					"message": "unauthorized",
-				})
-				return
-			}
-
-			// find the user with token Subject (userId)
-			user, err := db.FindById("users", claims["sub"].(string))
-			if user == nil {
-				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
-					"message": "user corresponding to token not found",
-				})
-				return
-			}
-
-			if err != nil {
-				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
-					"message": "unauthorized",
-				})
-				return
-			}
-
-			// attach the request
-			c.Set("user", user)
-
-			// continue
-			c.Next()
-			return
-		}
+	cookie, err := c.Cookie("Authorization")
+	if err != nil || cookie == "" {
+		apierror.Abort(c, apierror.ErrAuthorizationMissing)
+		return "", false
+	}
 
-		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
-			"message": "unauthorized",
-		})
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		csrfCookie, _ := c.Cookie(pkg.CsrfCookie)
+		if !pkg.ValidCsrfToken(c.GetHeader(pkg.CsrfHeader), csrfCookie) {
+			apierror.Abort(c, apierror.ErrCsrfInvalid)
+			return "", false
+		}
 	}
+
+	return cookie, true
 }
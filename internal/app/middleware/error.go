@@ -0,0 +1,78 @@
+package middleware
+
+import (
+	"cloudbuddy/internal/app/apierror"
+	"cloudbuddy/internal/pkg"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+const RequestIdHeader = "X-Request-Id"
+
+// tags every request with an id, taken from the X-Request-Id header when the
+// client or a proxy sent a usable one. the id is echoed in the response and
+// attached to the request as "request_id".
+func RequestId() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(RequestIdHeader)
+		if !validRequestId(id) {
+			id, _ = pkg.RandomToken(12)
+		}
+
+		c.Set("request_id", id)
+		c.Header(RequestIdHeader, id)
+
+		c.Next()
+	}
+}
+
+func validRequestId(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+
+	for _, r := range id {
+		if r < '!' || r > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// serves the last error recorded by a handler as problem details. errors
+// which aren't api errors are logged and served as internal errors.
+func ErrorHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		last := c.Errors.Last()
+		if last == nil || c.Writer.Written() {
+			return
+		}
+
+		problem := *apierror.From(last.Err)
+		problem.Instance = c.Request.URL.Path
+		problem.RequestId = c.GetString("request_id")
+
+		if problem.Status >= http.StatusInternalServerError {
+			log.Printf("%s %s failed (request id %s): %v", c.Request.Method, c.Request.URL.Path, problem.RequestId, last.Err)
+		}
+
+		apierror.Write(c, &problem)
+	}
+}
+
+// serves panics as internal errors instead of an empty response
+func Recovery() gin.HandlerFunc {
+	return gin.CustomRecovery(func(c *gin.Context, recovered interface{}) {
+		problem := *apierror.ErrInternal
+		problem.Instance = c.Request.URL.Path
+		problem.RequestId = c.GetString("request_id")
+
+		apierror.Write(c, &problem)
+		c.Abort()
+	})
+}
@@ -0,0 +1,42 @@
+package middleware
+
+import (
+	"cloudbuddy/internal/app/apierror"
+	"cloudbuddy/internal/app/repository"
+	"cloudbuddy/internal/pkg"
+
+	"github.com/gin-gonic/gin"
+)
+
+// authenticates like DecodeJwtMiddleware and only lets users through whose
+// role grants at least the permissions of role
+func RequireRole(repos *repository.Repositories, cfg *pkg.Config, keyRing *pkg.KeyRing, role string) gin.HandlerFunc {
+	return authorize(repos, cfg, keyRing, func(user *pkg.User) bool {
+		return pkg.RoleCovers(pkg.RoleOf(user), role)
+	})
+}
+
+// authenticates like DecodeJwtMiddleware and only lets users through whose
+// role grants permission
+func RequirePermission(repos *repository.Repositories, cfg *pkg.Config, keyRing *pkg.KeyRing, permission string) gin.HandlerFunc {
+	return authorize(repos, cfg, keyRing, func(user *pkg.User) bool {
+		return pkg.HasPermission(user, permission)
+	})
+}
+
+func authorize(repos *repository.Repositories, cfg *pkg.Config, keyRing *pkg.KeyRing, allowed func(user *pkg.User) bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// the user may already be attached by a middleware further up
+		if _, exists := c.Get("user"); !exists && !authenticate(repos, cfg, keyRing, c) {
+			return
+		}
+
+		user := c.MustGet("user").(*pkg.User)
+		if !allowed(user) {
+			apierror.Abort(c, apierror.ErrForbidden)
+			return
+		}
+
+		c.Next()
+	}
+}
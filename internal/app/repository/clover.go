@@ -0,0 +1,1070 @@
+package repository
+
+import (
+	"cloudbuddy/internal/pkg"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	cl "github.com/ostafen/clover/v2"
+	"github.com/ostafen/clover/v2/document"
+	q "github.com/ostafen/clover/v2/query"
+)
+
+// the collections kept in a clover database
+var cloverCollections = []string{
+	"images",
+	"users",
+	"usernames",
+	"sessions",
+	"signin_attempts",
+	"revoked_tokens",
+	"credentials",
+	"webauthn_challenges",
+	"identities",
+	"oidc_states",
+	"passphrase_resets",
+	"email_verifications",
+	"api_keys",
+	"exports",
+}
+
+// opens the clover database in dir, creates the collections it lacks and
+// brings documents stored by older versions up to date
+func OpenClover(dir string) (*cl.DB, error) {
+	db, err := cl.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range cloverCollections {
+		has, err := db.HasCollection(name)
+		if err == nil && !has {
+			err = db.CreateCollection(name)
+		}
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("creating collection %s: %w", name, err)
+		}
+	}
+
+	migrateUsernames(db)
+	migrateImages(db)
+
+	return db, nil
+}
+
+func NewCloverRepositories(db *cl.DB) *Repositories {
+	return &Repositories{
+		Images:             &cloverImages{db: db},
+		Users:              &cloverUsers{db: db},
+		Sessions:           &cloverSessions{db: db},
+		RevokedTokens:      &cloverRevokedTokens{db: db},
+		SigninAttempts:     &cloverSigninAttempts{db: db},
+		ApiKeys:            &cloverApiKeys{db: db},
+		Credentials:        &cloverCredentials{db: db},
+		WebAuthnChallenges: &cloverWebAuthnChallenges{db: db},
+		Identities:         &cloverIdentities{db: db},
+		OidcStates:         &cloverOidcStates{db: db},
+		PassphraseResets:   &cloverPassphraseResets{db: db},
+		EmailVerifications: &cloverEmailVerifications{db: db},
+		Exports:            &cloverExports{db: db},
+	}
+}
+
+type cloverImages struct {
+	db *cl.DB
+}
+
+func (r *cloverImages) FindById(id string) (*pkg.Image, error) {
+	doc, err := r.db.FindById("images", id)
+	if err != nil || doc == nil {
+		return nil, err
+	}
+
+	var image pkg.Image
+	if err := unmarshal(doc, &image); err != nil {
+		return nil, err
+	}
+
+	return &image, nil
+}
+
+func (r *cloverImages) List(offset int, limit int) ([]pkg.Image, error) {
+	docs, err := r.db.FindAll(q.NewQuery("images").Sort(q.SortOption{Field: "created_at", Direction: -1}).Skip(offset).Limit(limit))
+	if err != nil {
+		return nil, err
+	}
+
+	return unmarshalAll[pkg.Image](docs)
+}
+
+func (r *cloverImages) ListByUser(userId string) ([]pkg.Image, error) {
+	docs, err := r.db.FindAll(q.NewQuery("images").Where(q.Field("user_id").Eq(userId)).Sort(q.SortOption{Field: "created_at", Direction: -1}))
+	if err != nil {
+		return nil, err
+	}
+
+	return unmarshalAll[pkg.Image](docs)
+}
+
+func (r *cloverImages) Count() (int, error) {
+	return r.db.Count(q.NewQuery("images"))
+}
+
+func (r *cloverImages) Create(image *pkg.Image) error {
+	if image.UUID == "" {
+		image.UUID = cl.NewObjectId()
+	}
+
+	_, err := r.db.InsertOne("images", document.NewDocumentOf(image))
+	return err
+}
+
+func (r *cloverImages) SetKey(id string, key string) error {
+	return update(r.db, "images", id, func(doc *document.Document) {
+		doc.Set("key", key)
+	})
+}
+
+func (r *cloverImages) SetTitle(id string, title string) error {
+	return update(r.db, "images", id, func(doc *document.Document) {
+		doc.Set("title", title)
+	})
+}
+
+func (r *cloverImages) AddLikes(id string, delta int64) error {
+	return update(r.db, "images", id, func(doc *document.Document) {
+		likes, _ := doc.Get("likes").(int64)
+		doc.Set("likes", likes+delta)
+	})
+}
+
+func (r *cloverImages) Delete(id string) error {
+	return r.db.DeleteById("images", id)
+}
+
+type cloverUsers struct {
+	db *cl.DB
+}
+
+func (r *cloverUsers) FindById(id string) (*pkg.User, error) {
+	doc, err := r.db.FindById("users", id)
+	if err != nil || doc == nil {
+		return nil, err
+	}
+
+	return unmarshalUser(doc)
+}
+
+// goes through the claim on the key, of users who got the same key before
+// usernames were normalized only the one holding the claim is found
+func (r *cloverUsers) FindByUsernameKey(key string) (*pkg.User, error) {
+	claim, err := r.db.FindById("usernames", pkg.UsernameClaimId(key))
+	if err != nil || claim == nil {
+		return nil, err
+	}
+
+	userId, _ := claim.Get("user_id").(string)
+	return r.FindById(userId)
+}
+
+func (r *cloverUsers) FindByVerifiedEmail(email string) (*pkg.User, error) {
+	return r.findFirst(q.Field("email").Eq(email).And(q.Field("email_verified").IsTrue()))
+}
+
+func (r *cloverUsers) findFirst(criteria q.Criteria) (*pkg.User, error) {
+	doc, err := r.db.FindFirst(q.NewQuery("users").Where(criteria))
+	if err != nil || doc == nil {
+		return nil, err
+	}
+
+	return unmarshalUser(doc)
+}
+
+func (r *cloverUsers) List() ([]pkg.User, error) {
+	docs, err := r.db.FindAll(q.NewQuery("users").Sort(q.SortOption{Field: "created_at", Direction: -1}))
+	if err != nil {
+		return nil, err
+	}
+
+	return unmarshalAll[pkg.User](docs)
+}
+
+func (r *cloverUsers) Create(user *pkg.User) error {
+	if user.UUID == "" {
+		user.UUID = cl.NewObjectId()
+	}
+
+	err := claimUsername(r.db, user.UsernameKey, user.UUID)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.db.InsertOne("users", document.NewDocumentOf(user))
+	if err != nil {
+		releaseUsername(r.db, user.UsernameKey)
+	}
+
+	return err
+}
+
+// the usernames collection is the unique index over usernames: every user
+// owns the document whose _id is derived from their username key, so two
+// claims on the same key can't both be inserted
+func claimUsername(db *cl.DB, key string, userId string) error {
+	doc := document.NewDocument()
+	doc.Set("_id", pkg.UsernameClaimId(key))
+	doc.Set("key", key)
+	doc.Set("user_id", userId)
+	doc.Set("created_at", time.Now())
+
+	_, err := db.InsertOne("usernames", doc)
+	if errors.Is(err, cl.ErrDuplicateKey) {
+		return ErrUsernameTaken
+	}
+
+	return err
+}
+
+func releaseUsername(db *cl.DB, key string) {
+	err := db.DeleteById("usernames", pkg.UsernameClaimId(key))
+	if err != nil {
+		log.Printf("Releasing username %s failed: %v", key, err)
+	}
+}
+
+func (r *cloverUsers) SetRole(id string, role string) error {
+	return update(r.db, "users", id, func(doc *document.Document) {
+		doc.Set("role", role)
+	})
+}
+
+func (r *cloverUsers) SetPassphrase(id string, hash string) error {
+	return update(r.db, "users", id, func(doc *document.Document) {
+		doc.Set("passphrase", hash)
+	})
+}
+
+func (r *cloverUsers) ChangePassphrase(id string, hash string) (int64, error) {
+	var version int64
+	err := update(r.db, "users", id, func(doc *document.Document) {
+		version = tokenVersionOf(doc) + 1
+		doc.Set("passphrase", hash)
+		doc.Set("token_version", version)
+	})
+
+	return version, err
+}
+
+func (r *cloverUsers) RevokeTokens(id string) (int64, error) {
+	var version int64
+	err := update(r.db, "users", id, func(doc *document.Document) {
+		version = tokenVersionOf(doc) + 1
+		doc.Set("token_version", version)
+	})
+
+	return version, err
+}
+
+func (r *cloverUsers) SetEmail(id string, email string) error {
+	return update(r.db, "users", id, func(doc *document.Document) {
+		doc.Set("email", email)
+		doc.Set("email_verified", false)
+	})
+}
+
+func (r *cloverUsers) VerifyEmail(id string, email string) (bool, error) {
+	owner, err := r.FindByVerifiedEmail(email)
+	if err != nil {
+		return false, err
+	}
+	if owner != nil && owner.UUID != id {
+		return false, nil
+	}
+
+	verified := false
+	err = update(r.db, "users", id, func(doc *document.Document) {
+		if doc.Get("email") != email {
+			return
+		}
+
+		verified = true
+		doc.Set("email_verified", true)
+	})
+	if err != nil || !verified {
+		return verified, err
+	}
+
+	err = r.db.Update(q.NewQuery("users").Where(q.Field("email").Eq(email).And(q.Field("_id").Neq(id))), map[string]interface{}{
+		"email":          "",
+		"email_verified": false,
+	})
+
+	return true, err
+}
+
+func (r *cloverUsers) SetTotpPendingSecret(id string, secret string) error {
+	return update(r.db, "users", id, func(doc *document.Document) {
+		doc.Set("totp_pending_secret", secret)
+	})
+}
+
+func (r *cloverUsers) EnableTotp(id string, secret string, recoveryCodes []string, step int64) error {
+	return update(r.db, "users", id, func(doc *document.Document) {
+		doc.Set("totp_enabled", true)
+		doc.Set("totp_secret", secret)
+		doc.Set("totp_pending_secret", "")
+		doc.Set("totp_last_step", step)
+		doc.Set("recovery_codes", recoveryCodes)
+	})
+}
+
+func (r *cloverUsers) DisableTotp(id string) error {
+	return update(r.db, "users", id, func(doc *document.Document) {
+		doc.Set("totp_enabled", false)
+		doc.Set("totp_secret", "")
+		doc.Set("totp_pending_secret", "")
+		doc.Set("recovery_codes", []string{})
+	})
+}
+
+func (r *cloverUsers) UseTotpStep(id string, step int64) (bool, error) {
+	used := false
+	err := update(r.db, "users", id, func(doc *document.Document) {
+		if last, _ := doc.Get("totp_last_step").(int64); step <= last {
+			return
+		}
+
+		used = true
+		doc.Set("totp_last_step", step)
+	})
+
+	return used, err
+}
+
+func (r *cloverUsers) UseRecoveryCode(id string, hash string) (bool, error) {
+	used := false
+	err := update(r.db, "users", id, func(doc *document.Document) {
+		hashes := stringsOf(doc.Get("recovery_codes"))
+		if !slices.Contains(hashes, hash) {
+			return
+		}
+
+		used = true
+		doc.Set("recovery_codes", pkg.RemoveByValue(hashes, hash))
+	})
+
+	return used, err
+}
+
+func (r *cloverUsers) AddImage(id string, imageId string) error {
+	return update(r.db, "users", id, func(doc *document.Document) {
+		doc.Set("images", append(stringsOf(doc.Get("images")), imageId))
+	})
+}
+
+func (r *cloverUsers) RemoveImage(id string, imageId string) error {
+	return update(r.db, "users", id, func(doc *document.Document) {
+		doc.Set("images", pkg.RemoveByValue(stringsOf(doc.Get("images")), imageId))
+	})
+}
+
+type cloverSessions struct {
+	db *cl.DB
+}
+
+func (r *cloverSessions) FindById(id string) (*pkg.Session, error) {
+	doc, err := r.db.FindById("sessions", id)
+	if err != nil || doc == nil {
+		return nil, err
+	}
+
+	var session pkg.Session
+	if err := unmarshal(doc, &session); err != nil {
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+func (r *cloverSessions) ListActive(userId string) ([]pkg.Session, error) {
+	criteria := q.Field("user_id").Eq(userId).And(q.Field("revoked").IsFalse()).And(q.Field("expires_at").Gt(time.Now()))
+	docs, err := r.db.FindAll(q.NewQuery("sessions").Where(criteria).Sort(q.SortOption{Field: "last_used_at", Direction: -1}))
+	if err != nil {
+		return nil, err
+	}
+
+	return unmarshalAll[pkg.Session](docs)
+}
+
+func (r *cloverSessions) ListByUser(userId string) ([]pkg.Session, error) {
+	docs, err := r.db.FindAll(q.NewQuery("sessions").Where(q.Field("user_id").Eq(userId)).Sort(q.SortOption{Field: "created_at", Direction: -1}))
+	if err != nil {
+		return nil, err
+	}
+
+	return unmarshalAll[pkg.Session](docs)
+}
+
+func (r *cloverSessions) Create(session *pkg.Session) error {
+	if session.UUID == "" {
+		session.UUID = cl.NewObjectId()
+	}
+
+	_, err := r.db.InsertOne("sessions", document.NewDocumentOf(session))
+	return err
+}
+
+func (r *cloverSessions) SetTokenHash(id string, hash string) error {
+	return update(r.db, "sessions", id, func(doc *document.Document) {
+		doc.Set("token_hash", hash)
+	})
+}
+
+// rotation happens inside the updater so two concurrent refreshes with the
+// same token can't both succeed
+func (r *cloverSessions) Rotate(id string, hash string, newHash string, userAgent string, ip string) (string, Rotation, error) {
+	var session pkg.Session
+	var decodeErr error
+	rotation := RotationRejected
+
+	err := update(r.db, "sessions", id, func(doc *document.Document) {
+		if decodeErr = unmarshal(doc, &session); decodeErr != nil {
+			return
+		}
+
+		rotation = rotate(&session, hash, newHash, userAgent, ip, time.Now())
+		doc.Set("token_hash", session.TokenHash)
+		doc.Set("used_hashes", session.UsedHashes)
+		doc.Set("revoked", session.Revoked)
+		doc.Set("expires_at", session.ExpiresAt)
+		doc.Set("user_agent", session.UserAgent)
+		doc.Set("ip", session.IP)
+		doc.Set("last_used_at", session.LastUsedAt)
+	})
+	if err == ErrNotFound {
+		return "", RotationRejected, nil
+	}
+	if err == nil {
+		err = decodeErr
+	}
+	if err != nil {
+		return "", RotationRejected, err
+	}
+
+	return session.UserId, rotation, nil
+}
+
+func (r *cloverSessions) Revoke(id string, userId string) (bool, error) {
+	revoked := false
+	err := update(r.db, "sessions", id, func(doc *document.Document) {
+		if doc.Get("user_id") != userId || doc.Get("revoked") != false {
+			return
+		}
+
+		revoked = true
+		doc.Set("revoked", true)
+	})
+	if err == ErrNotFound {
+		return false, nil
+	}
+
+	return revoked, err
+}
+
+func (r *cloverSessions) RevokeByTokenHash(id string, hash string) error {
+	return r.db.Update(q.NewQuery("sessions").Where(q.Field("_id").Eq(id).And(q.Field("token_hash").Eq(hash))), map[string]interface{}{
+		"revoked": true,
+	})
+}
+
+func (r *cloverSessions) RevokeByUser(userId string, exceptId string) error {
+	criteria := q.Field("user_id").Eq(userId)
+	if exceptId != "" {
+		criteria = criteria.And(q.Field("_id").Neq(exceptId))
+	}
+
+	return r.db.Update(q.NewQuery("sessions").Where(criteria), map[string]interface{}{
+		"revoked": true,
+	})
+}
+
+// entries expire together with their token
+type cloverRevokedTokens struct {
+	db *cl.DB
+}
+
+func (r *cloverRevokedTokens) Create(token *pkg.RevokedToken) error {
+	doc := document.NewDocumentOf(token)
+	doc.SetExpiresAt(token.ExpiresAt)
+
+	_, err := r.db.InsertOne("revoked_tokens", doc)
+	return err
+}
+
+func (r *cloverRevokedTokens) IsRevoked(jti string) (bool, error) {
+	doc, err := r.db.FindFirst(q.NewQuery("revoked_tokens").Where(q.Field("jti").Eq(jti)))
+	return doc != nil, err
+}
+
+// entries expire once their window has passed without failures
+type cloverSigninAttempts struct {
+	db *cl.DB
+}
+
+func (r *cloverSigninAttempts) Find(key string) (*pkg.SigninAttempt, error) {
+	return findFirst[pkg.SigninAttempt](r.db, q.NewQuery("signin_attempts").Where(q.Field("key").Eq(key)))
+}
+
+// the entry is created empty first, the attempt is then counted inside an
+// update so concurrent attempts are counted one after the other
+func (r *cloverSigninAttempts) Reserve(key string, policy pkg.ThrottlePolicy, now time.Time) (time.Time, error) {
+	doc, err := r.db.FindFirst(q.NewQuery("signin_attempts").Where(q.Field("key").Eq(key)))
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if doc == nil {
+		doc = document.NewDocumentOf(pkg.SigninAttempt{Key: key})
+		doc.SetExpiresAt(now.Add(policy.Window))
+
+		if _, err = r.db.InsertOne("signin_attempts", doc); err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	var until time.Time
+	err = update(r.db, "signin_attempts", doc.ObjectId(), func(doc *document.Document) {
+		failures, _ := doc.Get("failures").(int64)
+		last, _ := doc.Get("last_failure_at").(time.Time)
+		attempt := pkg.SigninAttempt{Key: key, Failures: failures, LastFailureAt: last}
+
+		if until = reserve(&attempt, policy, now); !until.IsZero() {
+			return
+		}
+
+		doc.Set("failures", attempt.Failures)
+		doc.Set("last_failure_at", attempt.LastFailureAt)
+		doc.SetExpiresAt(now.Add(policy.Window))
+	})
+
+	return until, err
+}
+
+func (r *cloverSigninAttempts) Refund(key string) error {
+	doc, err := r.db.FindFirst(q.NewQuery("signin_attempts").Where(q.Field("key").Eq(key)))
+	if err != nil || doc == nil {
+		return err
+	}
+
+	err = update(r.db, "signin_attempts", doc.ObjectId(), func(doc *document.Document) {
+		if failures, _ := doc.Get("failures").(int64); failures > 0 {
+			doc.Set("failures", failures-1)
+		}
+	})
+	if err == ErrNotFound {
+		return nil
+	}
+
+	return err
+}
+
+func (r *cloverSigninAttempts) Delete(key string) error {
+	return r.db.Delete(q.NewQuery("signin_attempts").Where(q.Field("key").Eq(key)))
+}
+
+type cloverApiKeys struct {
+	db *cl.DB
+}
+
+func (r *cloverApiKeys) FindByPrefix(prefix string) (*pkg.ApiKey, error) {
+	return findFirst[pkg.ApiKey](r.db, q.NewQuery("api_keys").Where(q.Field("prefix").Eq(prefix)))
+}
+
+func (r *cloverApiKeys) ListByUser(userId string) ([]pkg.ApiKey, error) {
+	docs, err := r.db.FindAll(q.NewQuery("api_keys").Where(q.Field("user_id").Eq(userId)).Sort(q.SortOption{Field: "created_at", Direction: -1}))
+	if err != nil {
+		return nil, err
+	}
+
+	return unmarshalAll[pkg.ApiKey](docs)
+}
+
+func (r *cloverApiKeys) Create(apiKey *pkg.ApiKey) error {
+	if apiKey.UUID == "" {
+		apiKey.UUID = cl.NewObjectId()
+	}
+
+	_, err := r.db.InsertOne("api_keys", document.NewDocumentOf(apiKey))
+	return err
+}
+
+func (r *cloverApiKeys) SetLastUsedAt(id string, at time.Time) error {
+	return update(r.db, "api_keys", id, func(doc *document.Document) {
+		doc.Set("last_used_at", at)
+	})
+}
+
+func (r *cloverApiKeys) Delete(id string, userId string) error {
+	return deleteOwned(r.db, "api_keys", id, userId)
+}
+
+func (r *cloverApiKeys) DeleteByUser(userId string) error {
+	return r.db.Delete(q.NewQuery("api_keys").Where(q.Field("user_id").Eq(userId)))
+}
+
+type cloverCredentials struct {
+	db *cl.DB
+}
+
+func (r *cloverCredentials) ListByUser(userId string) ([]pkg.Credential, error) {
+	docs, err := r.db.FindAll(q.NewQuery("credentials").Where(q.Field("user_id").Eq(userId)).Sort(q.SortOption{Field: "created_at", Direction: -1}))
+	if err != nil {
+		return nil, err
+	}
+
+	return unmarshalAll[pkg.Credential](docs)
+}
+
+func (r *cloverCredentials) Create(credential *pkg.Credential) error {
+	if credential.UUID == "" {
+		credential.UUID = cl.NewObjectId()
+	}
+
+	_, err := r.db.InsertOne("credentials", document.NewDocumentOf(credential))
+	return err
+}
+
+func (r *cloverCredentials) SetCredential(userId string, credentialId string, credential string, usedAt time.Time) error {
+	doc, err := r.db.FindFirst(q.NewQuery("credentials").Where(q.Field("credential_id").Eq(credentialId).And(q.Field("user_id").Eq(userId))))
+	if err != nil {
+		return err
+	}
+	if doc == nil {
+		return ErrNotFound
+	}
+
+	return update(r.db, "credentials", doc.ObjectId(), func(doc *document.Document) {
+		doc.Set("credential", credential)
+		doc.Set("last_used_at", usedAt)
+	})
+}
+
+func (r *cloverCredentials) Delete(id string, userId string) error {
+	return deleteOwned(r.db, "credentials", id, userId)
+}
+
+// challenges expire with the ceremony
+type cloverWebAuthnChallenges struct {
+	db *cl.DB
+}
+
+func (r *cloverWebAuthnChallenges) Create(challenge *pkg.WebAuthnChallenge) error {
+	if challenge.UUID == "" {
+		challenge.UUID = cl.NewObjectId()
+	}
+
+	doc := document.NewDocumentOf(challenge)
+	if !challenge.ExpiresAt.IsZero() {
+		doc.SetExpiresAt(challenge.ExpiresAt)
+	}
+
+	_, err := r.db.InsertOne("webauthn_challenges", doc)
+	return err
+}
+
+func (r *cloverWebAuthnChallenges) Take(id string) (*pkg.WebAuthnChallenge, error) {
+	var challenge pkg.WebAuthnChallenge
+	taken, err := take(r.db, "webauthn_challenges", id, &challenge)
+	if err != nil || !taken {
+		return nil, err
+	}
+
+	return &challenge, nil
+}
+
+type cloverIdentities struct {
+	db *cl.DB
+}
+
+func (r *cloverIdentities) FindBySubject(provider string, subject string) (*pkg.Identity, error) {
+	return findFirst[pkg.Identity](r.db, q.NewQuery("identities").Where(q.Field("provider").Eq(provider).And(q.Field("subject").Eq(subject))))
+}
+
+func (r *cloverIdentities) ListByUser(userId string) ([]pkg.Identity, error) {
+	docs, err := r.db.FindAll(q.NewQuery("identities").Where(q.Field("user_id").Eq(userId)).Sort(q.SortOption{Field: "created_at", Direction: -1}))
+	if err != nil {
+		return nil, err
+	}
+
+	return unmarshalAll[pkg.Identity](docs)
+}
+
+func (r *cloverIdentities) Create(identity *pkg.Identity) error {
+	if identity.UUID == "" {
+		identity.UUID = cl.NewObjectId()
+	}
+
+	_, err := r.db.InsertOne("identities", document.NewDocumentOf(identity))
+	return err
+}
+
+// states expire when the login times out
+type cloverOidcStates struct {
+	db *cl.DB
+}
+
+func (r *cloverOidcStates) Create(state *pkg.OidcState) error {
+	if state.UUID == "" {
+		state.UUID = cl.NewObjectId()
+	}
+
+	doc := document.NewDocumentOf(state)
+	doc.SetExpiresAt(state.ExpiresAt)
+
+	_, err := r.db.InsertOne("oidc_states", doc)
+	return err
+}
+
+func (r *cloverOidcStates) Take(provider string, state string) (*pkg.OidcState, error) {
+	doc, err := r.db.FindFirst(q.NewQuery("oidc_states").Where(q.Field("state").Eq(state).And(q.Field("provider").Eq(provider))))
+	if err != nil || doc == nil {
+		return nil, err
+	}
+
+	var oidcState pkg.OidcState
+	taken, err := take(r.db, "oidc_states", doc.ObjectId(), &oidcState)
+	if err != nil || !taken {
+		return nil, err
+	}
+
+	return &oidcState, nil
+}
+
+type cloverPassphraseResets struct {
+	db *cl.DB
+}
+
+func (r *cloverPassphraseResets) FindByTokenHash(hash string) (*pkg.PassphraseReset, error) {
+	return findFirst[pkg.PassphraseReset](r.db, q.NewQuery("passphrase_resets").Where(q.Field("token_hash").Eq(hash)))
+}
+
+func (r *cloverPassphraseResets) Create(reset *pkg.PassphraseReset) error {
+	if reset.UUID == "" {
+		reset.UUID = cl.NewObjectId()
+	}
+
+	_, err := r.db.InsertOne("passphrase_resets", document.NewDocumentOf(reset))
+	return err
+}
+
+// the check happens inside the updater so a token can't be redeemed twice
+func (r *cloverPassphraseResets) Use(id string, now time.Time) (bool, error) {
+	used := false
+	var userId interface{}
+	err := update(r.db, "passphrase_resets", id, func(doc *document.Document) {
+		if doc.Get("used") != false {
+			return
+		}
+		if expiresAt, _ := doc.Get("expires_at").(time.Time); now.After(expiresAt) {
+			return
+		}
+
+		used = true
+		userId = doc.Get("user_id")
+		doc.Set("used", true)
+	})
+	if err == ErrNotFound || !used {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	err = r.db.Update(q.NewQuery("passphrase_resets").Where(q.Field("user_id").Eq(userId).And(q.Field("used").Eq(false))), map[string]interface{}{
+		"used": true,
+	})
+	return err == nil, err
+}
+
+type cloverEmailVerifications struct {
+	db *cl.DB
+}
+
+func (r *cloverEmailVerifications) FindByTokenHash(hash string) (*pkg.EmailVerification, error) {
+	return findFirst[pkg.EmailVerification](r.db, q.NewQuery("email_verifications").Where(q.Field("token_hash").Eq(hash)))
+}
+
+func (r *cloverEmailVerifications) Create(verification *pkg.EmailVerification) error {
+	if verification.UUID == "" {
+		verification.UUID = cl.NewObjectId()
+	}
+
+	_, err := r.db.InsertOne("email_verifications", document.NewDocumentOf(verification))
+	return err
+}
+
+func (r *cloverEmailVerifications) SetUsed(id string) error {
+	return update(r.db, "email_verifications", id, func(doc *document.Document) {
+		doc.Set("used", true)
+	})
+}
+
+type cloverExports struct {
+	db *cl.DB
+}
+
+func (r *cloverExports) FindById(id string) (*pkg.Export, error) {
+	doc, err := r.db.FindById("exports", id)
+	if err != nil || doc == nil {
+		return nil, err
+	}
+
+	var export pkg.Export
+	if err := unmarshal(doc, &export); err != nil {
+		return nil, err
+	}
+
+	return &export, nil
+}
+
+func (r *cloverExports) ListByStatus(userId string, statuses ...string) ([]pkg.Export, error) {
+	values := make([]interface{}, len(statuses))
+	for i, status := range statuses {
+		values[i] = status
+	}
+
+	criteria := q.Field("status").In(values...)
+	if userId != "" {
+		criteria = criteria.And(q.Field("user_id").Eq(userId))
+	}
+
+	docs, err := r.db.FindAll(q.NewQuery("exports").Where(criteria).Sort(q.SortOption{Field: "created_at", Direction: -1}))
+	if err != nil {
+		return nil, err
+	}
+
+	return unmarshalAll[pkg.Export](docs)
+}
+
+func (r *cloverExports) Create(export *pkg.Export) error {
+	if export.UUID == "" {
+		export.UUID = cl.NewObjectId()
+	}
+
+	_, err := r.db.InsertOne("exports", document.NewDocumentOf(export))
+	return err
+}
+
+func (r *cloverExports) Finish(id string, status string, key string, completedAt time.Time, expiresAt time.Time) error {
+	return update(r.db, "exports", id, func(doc *document.Document) {
+		doc.Set("status", status)
+		doc.Set("key", key)
+		doc.Set("completed_at", completedAt)
+		doc.Set("expires_at", expiresAt)
+	})
+}
+
+func (r *cloverExports) SetStatus(id string, status string) error {
+	return update(r.db, "exports", id, func(doc *document.Document) {
+		doc.Set("status", status)
+		doc.Set("key", "")
+	})
+}
+
+// users created before roles or token versioning existed lack those fields
+func unmarshalUser(doc *document.Document) (*pkg.User, error) {
+	var user pkg.User
+	if err := unmarshal(doc, &user); err != nil {
+		return nil, err
+	}
+
+	if !pkg.ValidRole(user.Role) {
+		user.Role = pkg.RoleUser
+	}
+
+	return &user, nil
+}
+
+func tokenVersionOf(doc *document.Document) int64 {
+	version, _ := doc.Get("token_version").(int64)
+	return version
+}
+
+func stringsOf(value interface{}) []string {
+	items, _ := value.([]interface{})
+	strs, ok := pkg.ConvertInterfaceSliceToXSlice[string](items)
+	if !ok {
+		return []string{}
+	}
+
+	return strs
+}
+
+// the first document the query finds, nil if there is none
+func findFirst[T any](db *cl.DB, query *q.Query) (*T, error) {
+	doc, err := db.FindFirst(query)
+	if err != nil || doc == nil {
+		return nil, err
+	}
+
+	var value T
+	if err := unmarshal(doc, &value); err != nil {
+		return nil, err
+	}
+
+	return &value, nil
+}
+
+// deletes a document of the user, ErrNotFound if the user has none with id
+func deleteOwned(db *cl.DB, collection string, id string, userId string) error {
+	doc, err := db.FindFirst(q.NewQuery(collection).Where(q.Field("_id").Eq(id).And(q.Field("user_id").Eq(userId))))
+	if err != nil {
+		return err
+	}
+	if doc == nil {
+		return ErrNotFound
+	}
+
+	return db.DeleteById(collection, id)
+}
+
+// reads a document into v and deletes it, reports false if there is none.
+// the document is marked taken inside an update first, so of two concurrent
+// takes only one gets it.
+func take(db *cl.DB, collection string, id string, v interface{}) (bool, error) {
+	taken := false
+	var decodeErr error
+	err := update(db, collection, id, func(doc *document.Document) {
+		if doc.Get("taken") == true {
+			return
+		}
+
+		taken = true
+		doc.Set("taken", true)
+		decodeErr = unmarshal(doc, v)
+	})
+	if err == ErrNotFound || !taken {
+		return false, nil
+	}
+	if err == nil {
+		err = decodeErr
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, db.DeleteById(collection, id)
+}
+
+// updates a document in place, ErrNotFound if there is none with id
+func update(db *cl.DB, collection string, id string, updater func(doc *document.Document)) error {
+	err := db.UpdateById(collection, id, func(doc *document.Document) *document.Document {
+		updater(doc)
+		return doc
+	})
+	if err == cl.ErrDocumentNotExist {
+		return ErrNotFound
+	}
+
+	return err
+}
+
+func unmarshalAll[T any](docs []*document.Document) ([]T, error) {
+	values := make([]T, 0, len(docs))
+	for _, doc := range docs {
+		var value T
+		if err := unmarshal(doc, &value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+
+	return values, nil
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// fills the fields of the struct v points to from the document by their
+// clover tags. document.Unmarshal round trips through encoding/json and
+// matches fields by their json names, which loses every field whose json
+// name differs or which isn't served at all, like the passphrase. fields
+// missing from the document keep their zero value, fields of the wrong type
+// are an error rather than a panic further down.
+func unmarshal(doc *document.Document, v interface{}) error {
+	rv := reflect.ValueOf(v).Elem()
+	rt := rv.Type()
+
+	for i := 0; i < rt.NumField(); i++ {
+		tag, ok := rt.Field(i).Tag.Lookup("clover")
+		if !ok {
+			continue
+		}
+
+		name, _, _ := strings.Cut(tag, ",")
+		value := doc.Get(name)
+		if value == nil {
+			continue
+		}
+
+		field := rv.Field(i)
+		if err := setValue(field, value); err != nil {
+			return fmt.Errorf("document %s: field %s: %w", doc.ObjectId(), name, err)
+		}
+	}
+
+	return nil
+}
+
+func setValue(field reflect.Value, value interface{}) error {
+	mismatch := fmt.Errorf("is %T, want %s", value, field.Type())
+
+	switch {
+	case field.Type() == timeType:
+		t, ok := value.(time.Time)
+		if !ok {
+			return mismatch
+		}
+		field.Set(reflect.ValueOf(t))
+	case field.Kind() == reflect.String:
+		s, ok := value.(string)
+		if !ok {
+			return mismatch
+		}
+		field.SetString(s)
+	case field.Kind() == reflect.Bool:
+		b, ok := value.(bool)
+		if !ok {
+			return mismatch
+		}
+		field.SetBool(b)
+	case field.Kind() == reflect.Int64:
+		switch n := value.(type) {
+		case int64:
+			field.SetInt(n)
+		case float64:
+			field.SetInt(int64(n))
+		default:
+			return mismatch
+		}
+	case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.String:
+		items, ok := value.([]interface{})
+		if !ok {
+			return mismatch
+		}
+		strs, ok := pkg.ConvertInterfaceSliceToXSlice[string](items)
+		if !ok {
+			return mismatch
+		}
+		field.Set(reflect.ValueOf(strs))
+	default:
+		return fmt.Errorf("unsupported field type %s", field.Type())
+	}
+
+	return nil
+}
@@ -0,0 +1,72 @@
+package repository
+
+import (
+	"cloudbuddy/internal/pkg"
+	"log"
+
+	cl "github.com/ostafen/clover/v2"
+	"github.com/ostafen/clover/v2/document"
+	q "github.com/ostafen/clover/v2/query"
+)
+
+// gives users created before usernames were normalized their username_key
+// and claim. clashing names are only logged, the user who didn't get the
+// claim can't sign in by username until an admin sorts it out.
+func migrateUsernames(db *cl.DB) {
+	docs, err := db.FindAll(q.NewQuery("users").Where(q.Field("username_key").NotExists()))
+	if err != nil {
+		log.Printf("Migrating usernames failed: %v", err)
+		return
+	}
+
+	for _, doc := range docs {
+		key := pkg.UsernameKey(doc.Get("username").(string))
+
+		err := claimUsername(db, key, doc.ObjectId())
+		if err != nil {
+			log.Printf("Username %s of user %s clashes with another user: %v", key, doc.ObjectId(), err)
+		}
+
+		err = update(db, "users", doc.ObjectId(), func(doc *document.Document) {
+			doc.Set("username_key", key)
+		})
+		if err != nil {
+			log.Printf("Migrating username of user %s failed: %v", doc.ObjectId(), err)
+		}
+	}
+}
+
+// images uploaded before they stored their key and backend kept the url they
+// were served with. the key is recovered from the url, which is then dropped.
+func migrateImages(db *cl.DB) {
+	docs, err := db.FindAll(q.NewQuery("images").Where(q.Field("backend").NotExists()))
+	if err != nil {
+		log.Printf("Migrating images failed: %v", err)
+		return
+	}
+
+	for _, doc := range docs {
+		key, _ := doc.Get("key").(string)
+		if key == "" {
+			url, _ := doc.Get("url").(string)
+			key = pkg.ObjectKeyFromUrl(url)
+		}
+
+		if key == "" {
+			log.Printf("Image %s has no object key, it will be served without url", doc.ObjectId())
+		}
+
+		err := db.UpdateById("images", doc.ObjectId(), func(doc *document.Document) *document.Document {
+			fields := doc.ToMap()
+			delete(fields, "url")
+
+			migrated := document.NewDocumentOf(fields)
+			migrated.Set("backend", pkg.StorageBackendS3)
+			migrated.Set("key", key)
+			return migrated
+		})
+		if err != nil {
+			log.Printf("Migrating image %s failed: %v", doc.ObjectId(), err)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package repository
+
+import (
+	"cloudbuddy/internal/pkg"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"time"
+
+	cl "github.com/ostafen/clover/v2"
+	q "github.com/ostafen/clover/v2/query"
+)
+
+// copies the clover database in dir into a database opened with OpenSql,
+// once. the import runs in one transaction together with its record in
+// clover_import, on postgres replicas starting at the same time wait for
+// the first one. signin attempts, webauthn challenges and oidc states only
+// live for minutes and are left behind.
+func ImportClover(db *sql.DB, driver string, dir string) error {
+	if _, err := os.Stat(dir); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if driver == pkg.DatabasePostgres {
+		if _, err := tx.Exec(`LOCK TABLE clover_import IN EXCLUSIVE MODE`); err != nil {
+			return err
+		}
+	}
+
+	var imports, users int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM clover_import`).Scan(&imports); err != nil {
+		return err
+	}
+	if imports > 0 {
+		return nil
+	}
+
+	// a database which was used before without the import is left alone
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM users`).Scan(&users); err != nil {
+		return err
+	}
+
+	if users > 0 {
+		log.Printf("The %s database already has users, the clover database in %s isn't imported", driver, dir)
+	} else {
+		src, err := OpenClover(dir)
+		if err != nil {
+			return fmt.Errorf("opening %s: %w", dir, err)
+		}
+		defer src.Close()
+
+		if err := importClover(src, newSqlRepositories(tx, driver)); err != nil {
+			return fmt.Errorf("importing %s: %w", dir, err)
+		}
+	}
+
+	_, err = tx.Exec(rebind(driver, `INSERT INTO clover_import (dir, imported_at) VALUES (?, ?)`), dir, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func importClover(src *cl.DB, dst *Repositories) error {
+	users, err := NewCloverRepositories(src).Users.List()
+	if err != nil {
+		return err
+	}
+
+	userIds := map[string]bool{}
+	for _, user := range users {
+		if !pkg.ValidRole(user.Role) {
+			user.Role = pkg.RoleUser
+		}
+
+		// of users who got the same key before usernames were normalized
+		// only the one holding the claim keeps it, the others can't sign in
+		// by username like before
+		claim, err := src.FindById("usernames", pkg.UsernameClaimId(user.UsernameKey))
+		if err != nil {
+			return err
+		}
+		if claim == nil || claim.Get("user_id") != user.UUID {
+			log.Printf("User %s doesn't hold the claim on username %s, it is imported without", user.UUID, user.UsernameKey)
+			user.UsernameKey = "!" + user.UUID
+		}
+
+		if err := dst.Users.Create(&user); err != nil {
+			return fmt.Errorf("users: %w", err)
+		}
+		userIds[user.UUID] = true
+	}
+
+	err = importCollection(src, "images", userIds, func(image *pkg.Image) string { return image.UserId }, dst.Images.Create)
+	if err == nil {
+		err = importCollection(src, "sessions", userIds, func(session *pkg.Session) string { return session.UserId }, dst.Sessions.Create)
+	}
+	if err == nil {
+		err = importCollection(src, "revoked_tokens", userIds, func(token *pkg.RevokedToken) string { return token.UserId }, dst.RevokedTokens.Create)
+	}
+	if err == nil {
+		err = importCollection(src, "api_keys", userIds, func(apiKey *pkg.ApiKey) string { return apiKey.UserId }, dst.ApiKeys.Create)
+	}
+	if err == nil {
+		err = importCollection(src, "credentials", userIds, func(credential *pkg.Credential) string { return credential.UserId }, dst.Credentials.Create)
+	}
+	if err == nil {
+		err = importCollection(src, "identities", userIds, func(identity *pkg.Identity) string { return identity.UserId }, dst.Identities.Create)
+	}
+	if err == nil {
+		err = importCollection(src, "passphrase_resets", userIds, func(reset *pkg.PassphraseReset) string { return reset.UserId }, dst.PassphraseResets.Create)
+	}
+	if err == nil {
+		err = importCollection(src, "email_verifications", userIds, func(verification *pkg.EmailVerification) string { return verification.UserId }, dst.EmailVerifications.Create)
+	}
+	if err == nil {
+		err = importCollection(src, "exports", userIds, func(export *pkg.Export) string { return export.UserId }, dst.Exports.Create)
+	}
+
+	return err
+}
+
+// creates every document of the collection, documents of users who don't
+// exist are skipped
+func importCollection[T any](src *cl.DB, collection string, userIds map[string]bool, userIdOf func(value *T) string, create func(value *T) error) error {
+	docs, err := src.FindAll(q.NewQuery(collection))
+	if err != nil {
+		return err
+	}
+
+	values, err := unmarshalAll[T](docs)
+	if err != nil {
+		return fmt.Errorf("%s: %w", collection, err)
+	}
+
+	for i := range values {
+		if !userIds[userIdOf(&values[i])] {
+			log.Printf("Document %s in %s belongs to no user, it isn't imported", docs[i].ObjectId(), collection)
+			continue
+		}
+
+		if err := create(&values[i]); err != nil {
+			return fmt.Errorf("%s: %w", collection, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,88 @@
+package repository
+
+import (
+	"cloudbuddy/internal/pkg"
+	"path/filepath"
+	"testing"
+	"time"
+
+	cl "github.com/ostafen/clover/v2"
+	"github.com/ostafen/clover/v2/document"
+)
+
+func TestImportClover(t *testing.T) {
+	dir := t.TempDir()
+
+	src, err := OpenClover(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := NewCloverRepositories(src)
+
+	alice := createUser(t, old, "alice", 0)
+	image := &pkg.Image{Title: "image", Backend: "s3", UserId: alice.UUID, CreatedAt: testTime}
+	if err := old.Images.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	if err := old.Users.AddImage(alice.UUID, image.UUID); err != nil {
+		t.Fatal(err)
+	}
+	session := createSession(t, old, alice.UUID, "hash", time.Now().UTC().Truncate(time.Second))
+	apiKey := &pkg.ApiKey{UserId: alice.UUID, Name: "ci", Prefix: "prefix", KeyHash: "hash", Scopes: []string{pkg.ScopeImagesWrite}, CreatedAt: testTime}
+	if err := old.ApiKeys.Create(apiKey); err != nil {
+		t.Fatal(err)
+	}
+
+	// a user from before usernames were normalized who lost the claim on
+	// their key, and a session of a user who is gone
+	clashId := cl.NewObjectId()
+	clash := document.NewDocumentOf(pkg.User{UUID: clashId, Username: "Alice", UsernameKey: "alice", Role: pkg.RoleUser, CreatedAt: testTime})
+	if _, err := src.InsertOne("users", clash); err != nil {
+		t.Fatal(err)
+	}
+	createSession(t, old, "gone", "orphan", testTime)
+
+	if err := src.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db := openTestSqlite(t)
+	for i := 0; i < 2; i++ {
+		if err := ImportClover(db, pkg.DatabaseSqlite, dir); err != nil {
+			t.Fatalf("import %d: %v", i+1, err)
+		}
+	}
+
+	repos := NewSqlRepositories(db, pkg.DatabaseSqlite)
+
+	imported, err := repos.Users.FindByUsernameKey("alice")
+	if err != nil || imported == nil || imported.UUID != alice.UUID {
+		t.Fatalf("alice wasn't imported with the username: %+v %v", imported, err)
+	}
+	if len(imported.Images) != 1 || imported.Images[0] != image.UUID {
+		t.Fatalf("unexpected images %v", imported.Images)
+	}
+	if found := findUser(t, repos, clashId); found.UsernameKey == "alice" {
+		t.Fatal("both users have the key alice")
+	}
+
+	if found, err := repos.Sessions.FindById(session.UUID); err != nil || found == nil || found.TokenHash != "hash" {
+		t.Fatalf("session wasn't imported: %+v %v", found, err)
+	}
+	if found, err := repos.ApiKeys.FindByPrefix("prefix"); err != nil || found == nil || found.UserId != alice.UUID {
+		t.Fatalf("api key wasn't imported: %+v %v", found, err)
+	}
+
+	users, err := repos.Users.List()
+	if err != nil || len(users) != 2 {
+		t.Fatalf("want 2 users, got %+v %v", users, err)
+	}
+}
+
+func TestImportCloverWithoutDatabase(t *testing.T) {
+	db := openTestSqlite(t)
+
+	if err := ImportClover(db, pkg.DatabaseSqlite, filepath.Join(t.TempDir(), "missing")); err != nil {
+		t.Fatal(err)
+	}
+}
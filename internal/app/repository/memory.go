@@ -0,0 +1,852 @@
+package repository
+
+import (
+	"cloudbuddy/internal/pkg"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	cl "github.com/ostafen/clover/v2"
+)
+
+// keeps everything in memory, for tests. values are copied in and out so
+// callers can't change what is stored behind the repository's back.
+func NewMemoryRepositories() *Repositories {
+	return &Repositories{
+		Images:             &memoryImages{images: map[string]pkg.Image{}},
+		Users:              &memoryUsers{users: map[string]pkg.User{}},
+		Sessions:           &memorySessions{newMemoryStore(copySession)},
+		RevokedTokens:      &memoryRevokedTokens{newMemoryStore[pkg.RevokedToken](nil)},
+		SigninAttempts:     &memorySigninAttempts{newMemoryStore[pkg.SigninAttempt](nil)},
+		ApiKeys:            &memoryApiKeys{newMemoryStore(copyApiKey)},
+		Credentials:        &memoryCredentials{newMemoryStore[pkg.Credential](nil)},
+		WebAuthnChallenges: &memoryWebAuthnChallenges{newMemoryStore[pkg.WebAuthnChallenge](nil)},
+		Identities:         &memoryIdentities{newMemoryStore[pkg.Identity](nil)},
+		OidcStates:         &memoryOidcStates{newMemoryStore[pkg.OidcState](nil)},
+		PassphraseResets:   &memoryPassphraseResets{newMemoryStore[pkg.PassphraseReset](nil)},
+		EmailVerifications: &memoryEmailVerifications{newMemoryStore[pkg.EmailVerification](nil)},
+		Exports:            &memoryExports{newMemoryStore[pkg.Export](nil)},
+	}
+}
+
+type memoryImages struct {
+	mu     sync.Mutex
+	images map[string]pkg.Image
+}
+
+func (r *memoryImages) FindById(id string) (*pkg.Image, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	image, ok := r.images[id]
+	if !ok {
+		return nil, nil
+	}
+
+	return &image, nil
+}
+
+func (r *memoryImages) List(offset int, limit int) ([]pkg.Image, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	images := r.newestFirst(func(pkg.Image) bool { return true })
+	if offset > len(images) {
+		offset = len(images)
+	}
+	images = images[offset:]
+	if limit < len(images) {
+		images = images[:limit]
+	}
+
+	return images, nil
+}
+
+func (r *memoryImages) ListByUser(userId string) ([]pkg.Image, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.newestFirst(func(image pkg.Image) bool { return image.UserId == userId }), nil
+}
+
+func (r *memoryImages) newestFirst(match func(pkg.Image) bool) []pkg.Image {
+	images := []pkg.Image{}
+	for _, image := range r.images {
+		if match(image) {
+			images = append(images, image)
+		}
+	}
+
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].CreatedAt.After(images[j].CreatedAt)
+	})
+
+	return images
+}
+
+func (r *memoryImages) Count() (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.images), nil
+}
+
+func (r *memoryImages) Create(image *pkg.Image) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if image.UUID == "" {
+		image.UUID = cl.NewObjectId()
+	}
+	r.images[image.UUID] = *image
+
+	return nil
+}
+
+func (r *memoryImages) update(id string, updater func(image *pkg.Image)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	image, ok := r.images[id]
+	if !ok {
+		return ErrNotFound
+	}
+
+	updater(&image)
+	r.images[id] = image
+
+	return nil
+}
+
+func (r *memoryImages) SetKey(id string, key string) error {
+	return r.update(id, func(image *pkg.Image) {
+		image.Key = key
+	})
+}
+
+func (r *memoryImages) SetTitle(id string, title string) error {
+	return r.update(id, func(image *pkg.Image) {
+		image.Title = title
+	})
+}
+
+func (r *memoryImages) AddLikes(id string, delta int64) error {
+	return r.update(id, func(image *pkg.Image) {
+		image.Likes += delta
+	})
+}
+
+func (r *memoryImages) Delete(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.images, id)
+
+	return nil
+}
+
+type memoryUsers struct {
+	mu    sync.Mutex
+	users map[string]pkg.User
+}
+
+func (r *memoryUsers) FindById(id string) (*pkg.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, ok := r.users[id]
+	if !ok {
+		return nil, nil
+	}
+
+	return copyUser(user), nil
+}
+
+func (r *memoryUsers) FindByUsernameKey(key string) (*pkg.User, error) {
+	return r.findFirst(func(user pkg.User) bool { return user.UsernameKey == key })
+}
+
+func (r *memoryUsers) FindByVerifiedEmail(email string) (*pkg.User, error) {
+	return r.findFirst(func(user pkg.User) bool { return user.Email == email && user.EmailVerified })
+}
+
+func (r *memoryUsers) findFirst(match func(pkg.User) bool) (*pkg.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, user := range r.users {
+		if match(user) {
+			return copyUser(user), nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (r *memoryUsers) List() ([]pkg.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	users := []pkg.User{}
+	for _, user := range r.users {
+		users = append(users, *copyUser(user))
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].CreatedAt.After(users[j].CreatedAt)
+	})
+
+	return users, nil
+}
+
+func (r *memoryUsers) Create(user *pkg.User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, other := range r.users {
+		if other.UsernameKey == user.UsernameKey {
+			return ErrUsernameTaken
+		}
+	}
+
+	if user.UUID == "" {
+		user.UUID = cl.NewObjectId()
+	}
+	r.users[user.UUID] = *copyUser(*user)
+
+	return nil
+}
+
+func (r *memoryUsers) update(id string, updater func(user *pkg.User)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, ok := r.users[id]
+	if !ok {
+		return ErrNotFound
+	}
+
+	updated := copyUser(user)
+	updater(updated)
+	r.users[id] = *updated
+
+	return nil
+}
+
+func (r *memoryUsers) SetRole(id string, role string) error {
+	return r.update(id, func(user *pkg.User) {
+		user.Role = role
+	})
+}
+
+func (r *memoryUsers) SetPassphrase(id string, hash string) error {
+	return r.update(id, func(user *pkg.User) {
+		user.Passphrase = hash
+	})
+}
+
+func (r *memoryUsers) ChangePassphrase(id string, hash string) (int64, error) {
+	var version int64
+	err := r.update(id, func(user *pkg.User) {
+		user.Passphrase = hash
+		user.TokenVersion++
+		version = user.TokenVersion
+	})
+
+	return version, err
+}
+
+func (r *memoryUsers) RevokeTokens(id string) (int64, error) {
+	var version int64
+	err := r.update(id, func(user *pkg.User) {
+		user.TokenVersion++
+		version = user.TokenVersion
+	})
+
+	return version, err
+}
+
+func (r *memoryUsers) SetEmail(id string, email string) error {
+	return r.update(id, func(user *pkg.User) {
+		user.Email = email
+		user.EmailVerified = false
+	})
+}
+
+func (r *memoryUsers) VerifyEmail(id string, email string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, ok := r.users[id]
+	if !ok {
+		return false, ErrNotFound
+	}
+	if user.Email != email {
+		return false, nil
+	}
+
+	for otherId, other := range r.users {
+		if otherId != id && other.Email == email && other.EmailVerified {
+			return false, nil
+		}
+	}
+
+	for otherId, other := range r.users {
+		if otherId != id && other.Email == email {
+			other.Email = ""
+			r.users[otherId] = other
+		}
+	}
+
+	user.EmailVerified = true
+	r.users[id] = user
+
+	return true, nil
+}
+
+func (r *memoryUsers) SetTotpPendingSecret(id string, secret string) error {
+	return r.update(id, func(user *pkg.User) {
+		user.TotpPendingSecret = secret
+	})
+}
+
+func (r *memoryUsers) EnableTotp(id string, secret string, recoveryCodes []string, step int64) error {
+	return r.update(id, func(user *pkg.User) {
+		user.TotpEnabled = true
+		user.TotpSecret = secret
+		user.TotpPendingSecret = ""
+		user.TotpLastStep = step
+		user.RecoveryCodes = slices.Clone(recoveryCodes)
+	})
+}
+
+func (r *memoryUsers) DisableTotp(id string) error {
+	return r.update(id, func(user *pkg.User) {
+		user.TotpEnabled = false
+		user.TotpSecret = ""
+		user.TotpPendingSecret = ""
+		user.RecoveryCodes = []string{}
+	})
+}
+
+func (r *memoryUsers) UseTotpStep(id string, step int64) (bool, error) {
+	used := false
+	err := r.update(id, func(user *pkg.User) {
+		if step > user.TotpLastStep {
+			used = true
+			user.TotpLastStep = step
+		}
+	})
+
+	return used, err
+}
+
+func (r *memoryUsers) UseRecoveryCode(id string, hash string) (bool, error) {
+	used := false
+	err := r.update(id, func(user *pkg.User) {
+		if slices.Contains(user.RecoveryCodes, hash) {
+			used = true
+			user.RecoveryCodes = pkg.RemoveByValue(user.RecoveryCodes, hash)
+		}
+	})
+
+	return used, err
+}
+
+func (r *memoryUsers) AddImage(id string, imageId string) error {
+	return r.update(id, func(user *pkg.User) {
+		user.Images = append(user.Images, imageId)
+	})
+}
+
+func (r *memoryUsers) RemoveImage(id string, imageId string) error {
+	return r.update(id, func(user *pkg.User) {
+		user.Images = pkg.RemoveByValue(user.Images, imageId)
+	})
+}
+
+// users hold slices, which would otherwise be shared with the stored user
+func copyUser(user pkg.User) *pkg.User {
+	user.RecoveryCodes = slices.Clone(user.RecoveryCodes)
+	user.Images = slices.Clone(user.Images)
+	return &user
+}
+
+// the records of the repositories below, keyed by their id. copy makes the
+// copies handed in and out for records holding slices.
+type memoryStore[T any] struct {
+	mu      sync.Mutex
+	records map[string]T
+	copy    func(T) T
+}
+
+func newMemoryStore[T any](copy func(T) T) *memoryStore[T] {
+	if copy == nil {
+		copy = func(record T) T { return record }
+	}
+
+	return &memoryStore[T]{records: map[string]T{}, copy: copy}
+}
+
+func (s *memoryStore[T]) find(match func(T) bool) *T {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, record := range s.records {
+		if match(record) {
+			found := s.copy(record)
+			return &found
+		}
+	}
+
+	return nil
+}
+
+// the matching records sorted by less
+func (s *memoryStore[T]) filter(match func(T) bool, less func(a, b T) bool) []T {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records := []T{}
+	for _, record := range s.records {
+		if match(record) {
+			records = append(records, s.copy(record))
+		}
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return less(records[i], records[j])
+	})
+
+	return records
+}
+
+func (s *memoryStore[T]) insert(id *string, record *T) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if *id == "" {
+		*id = cl.NewObjectId()
+	}
+	s.records[*id] = s.copy(*record)
+}
+
+// changes the record in place, ErrNotFound if there is none with id
+func (s *memoryStore[T]) update(id string, updater func(record *T)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, ok := s.records[id]
+	if !ok {
+		return ErrNotFound
+	}
+
+	updated := s.copy(record)
+	updater(&updated)
+	s.records[id] = updated
+
+	return nil
+}
+
+// deletes the matching records, returns how many there were
+func (s *memoryStore[T]) delete(match func(id string, record T) bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deleted := 0
+	for id, record := range s.records {
+		if match(id, record) {
+			delete(s.records, id)
+			deleted++
+		}
+	}
+
+	return deleted
+}
+
+// removes the record with id and returns it, nil if there is none
+func (s *memoryStore[T]) take(id string) *T {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, ok := s.records[id]
+	if !ok {
+		return nil
+	}
+
+	delete(s.records, id)
+	return &record
+}
+
+func copySession(session pkg.Session) pkg.Session {
+	session.UsedHashes = slices.Clone(session.UsedHashes)
+	return session
+}
+
+func copyApiKey(apiKey pkg.ApiKey) pkg.ApiKey {
+	apiKey.Scopes = slices.Clone(apiKey.Scopes)
+	return apiKey
+}
+
+func newestFirst[T any](createdAt func(T) time.Time) func(a, b T) bool {
+	return func(a, b T) bool {
+		return createdAt(a).After(createdAt(b))
+	}
+}
+
+type memorySessions struct {
+	*memoryStore[pkg.Session]
+}
+
+func (r *memorySessions) FindById(id string) (*pkg.Session, error) {
+	return r.find(func(session pkg.Session) bool { return session.UUID == id }), nil
+}
+
+func (r *memorySessions) ListActive(userId string) ([]pkg.Session, error) {
+	now := time.Now()
+	return r.filter(func(session pkg.Session) bool {
+		return session.UserId == userId && !session.Revoked && session.ExpiresAt.After(now)
+	}, newestFirst(func(session pkg.Session) time.Time { return session.LastUsedAt })), nil
+}
+
+func (r *memorySessions) ListByUser(userId string) ([]pkg.Session, error) {
+	return r.filter(func(session pkg.Session) bool { return session.UserId == userId },
+		newestFirst(func(session pkg.Session) time.Time { return session.CreatedAt })), nil
+}
+
+func (r *memorySessions) Create(session *pkg.Session) error {
+	r.insert(&session.UUID, session)
+	return nil
+}
+
+func (r *memorySessions) SetTokenHash(id string, hash string) error {
+	return r.update(id, func(session *pkg.Session) {
+		session.TokenHash = hash
+	})
+}
+
+func (r *memorySessions) Rotate(id string, hash string, newHash string, userAgent string, ip string) (string, Rotation, error) {
+	var userId string
+	rotation := RotationRejected
+	err := r.update(id, func(session *pkg.Session) {
+		userId = session.UserId
+		rotation = rotate(session, hash, newHash, userAgent, ip, time.Now())
+	})
+	if err == ErrNotFound {
+		return "", RotationRejected, nil
+	}
+
+	return userId, rotation, err
+}
+
+func (r *memorySessions) Revoke(id string, userId string) (bool, error) {
+	revoked := false
+	err := r.update(id, func(session *pkg.Session) {
+		if session.UserId == userId && !session.Revoked {
+			revoked = true
+			session.Revoked = true
+		}
+	})
+	if err == ErrNotFound {
+		return false, nil
+	}
+
+	return revoked, err
+}
+
+func (r *memorySessions) RevokeByTokenHash(id string, hash string) error {
+	err := r.update(id, func(session *pkg.Session) {
+		if session.TokenHash == hash {
+			session.Revoked = true
+		}
+	})
+	if err == ErrNotFound {
+		return nil
+	}
+
+	return err
+}
+
+func (r *memorySessions) RevokeByUser(userId string, exceptId string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for id, session := range r.records {
+		if session.UserId == userId && id != exceptId {
+			session.Revoked = true
+			r.records[id] = session
+		}
+	}
+
+	return nil
+}
+
+type memoryRevokedTokens struct {
+	*memoryStore[pkg.RevokedToken]
+}
+
+func (r *memoryRevokedTokens) Create(token *pkg.RevokedToken) error {
+	id := token.Jti
+	r.insert(&id, token)
+	return nil
+}
+
+func (r *memoryRevokedTokens) IsRevoked(jti string) (bool, error) {
+	return r.find(func(token pkg.RevokedToken) bool { return token.Jti == jti }) != nil, nil
+}
+
+type memorySigninAttempts struct {
+	*memoryStore[pkg.SigninAttempt]
+}
+
+func (r *memorySigninAttempts) Find(key string) (*pkg.SigninAttempt, error) {
+	return r.find(func(attempt pkg.SigninAttempt) bool { return attempt.Key == key }), nil
+}
+
+func (r *memorySigninAttempts) Reserve(key string, policy pkg.ThrottlePolicy, now time.Time) (time.Time, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	attempt, ok := r.records[key]
+	if !ok {
+		attempt = pkg.SigninAttempt{Key: key}
+	}
+
+	if until := reserve(&attempt, policy, now); !until.IsZero() {
+		return until, nil
+	}
+	r.records[key] = attempt
+
+	return time.Time{}, nil
+}
+
+func (r *memorySigninAttempts) Refund(key string) error {
+	err := r.update(key, func(attempt *pkg.SigninAttempt) {
+		if attempt.Failures > 0 {
+			attempt.Failures--
+		}
+	})
+	if err == ErrNotFound {
+		return nil
+	}
+
+	return err
+}
+
+func (r *memorySigninAttempts) Delete(key string) error {
+	r.delete(func(id string, attempt pkg.SigninAttempt) bool { return id == key })
+	return nil
+}
+
+type memoryApiKeys struct {
+	*memoryStore[pkg.ApiKey]
+}
+
+func (r *memoryApiKeys) FindByPrefix(prefix string) (*pkg.ApiKey, error) {
+	return r.find(func(apiKey pkg.ApiKey) bool { return apiKey.Prefix == prefix }), nil
+}
+
+func (r *memoryApiKeys) ListByUser(userId string) ([]pkg.ApiKey, error) {
+	return r.filter(func(apiKey pkg.ApiKey) bool { return apiKey.UserId == userId },
+		newestFirst(func(apiKey pkg.ApiKey) time.Time { return apiKey.CreatedAt })), nil
+}
+
+func (r *memoryApiKeys) Create(apiKey *pkg.ApiKey) error {
+	r.insert(&apiKey.UUID, apiKey)
+	return nil
+}
+
+func (r *memoryApiKeys) SetLastUsedAt(id string, at time.Time) error {
+	return r.update(id, func(apiKey *pkg.ApiKey) {
+		apiKey.LastUsedAt = at
+	})
+}
+
+func (r *memoryApiKeys) Delete(id string, userId string) error {
+	if r.delete(func(keyId string, apiKey pkg.ApiKey) bool { return keyId == id && apiKey.UserId == userId }) == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (r *memoryApiKeys) DeleteByUser(userId string) error {
+	r.delete(func(id string, apiKey pkg.ApiKey) bool { return apiKey.UserId == userId })
+	return nil
+}
+
+type memoryCredentials struct {
+	*memoryStore[pkg.Credential]
+}
+
+func (r *memoryCredentials) ListByUser(userId string) ([]pkg.Credential, error) {
+	return r.filter(func(credential pkg.Credential) bool { return credential.UserId == userId },
+		newestFirst(func(credential pkg.Credential) time.Time { return credential.CreatedAt })), nil
+}
+
+func (r *memoryCredentials) Create(credential *pkg.Credential) error {
+	r.insert(&credential.UUID, credential)
+	return nil
+}
+
+func (r *memoryCredentials) SetCredential(userId string, credentialId string, credential string, usedAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for id, stored := range r.records {
+		if stored.UserId == userId && stored.CredentialId == credentialId {
+			stored.Credential = credential
+			stored.LastUsedAt = usedAt
+			r.records[id] = stored
+			return nil
+		}
+	}
+
+	return ErrNotFound
+}
+
+func (r *memoryCredentials) Delete(id string, userId string) error {
+	if r.delete(func(credentialId string, credential pkg.Credential) bool {
+		return credentialId == id && credential.UserId == userId
+	}) == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+type memoryWebAuthnChallenges struct {
+	*memoryStore[pkg.WebAuthnChallenge]
+}
+
+func (r *memoryWebAuthnChallenges) Create(challenge *pkg.WebAuthnChallenge) error {
+	r.insert(&challenge.UUID, challenge)
+	return nil
+}
+
+func (r *memoryWebAuthnChallenges) Take(id string) (*pkg.WebAuthnChallenge, error) {
+	return r.take(id), nil
+}
+
+type memoryIdentities struct {
+	*memoryStore[pkg.Identity]
+}
+
+func (r *memoryIdentities) FindBySubject(provider string, subject string) (*pkg.Identity, error) {
+	return r.find(func(identity pkg.Identity) bool { return identity.Provider == provider && identity.Subject == subject }), nil
+}
+
+func (r *memoryIdentities) ListByUser(userId string) ([]pkg.Identity, error) {
+	return r.filter(func(identity pkg.Identity) bool { return identity.UserId == userId },
+		newestFirst(func(identity pkg.Identity) time.Time { return identity.CreatedAt })), nil
+}
+
+func (r *memoryIdentities) Create(identity *pkg.Identity) error {
+	r.insert(&identity.UUID, identity)
+	return nil
+}
+
+type memoryOidcStates struct {
+	*memoryStore[pkg.OidcState]
+}
+
+func (r *memoryOidcStates) Create(state *pkg.OidcState) error {
+	r.insert(&state.UUID, state)
+	return nil
+}
+
+func (r *memoryOidcStates) Take(provider string, state string) (*pkg.OidcState, error) {
+	found := r.find(func(stored pkg.OidcState) bool { return stored.Provider == provider && stored.State == state })
+	if found == nil {
+		return nil, nil
+	}
+
+	return r.take(found.UUID), nil
+}
+
+type memoryPassphraseResets struct {
+	*memoryStore[pkg.PassphraseReset]
+}
+
+func (r *memoryPassphraseResets) FindByTokenHash(hash string) (*pkg.PassphraseReset, error) {
+	return r.find(func(reset pkg.PassphraseReset) bool { return reset.TokenHash == hash }), nil
+}
+
+func (r *memoryPassphraseResets) Create(reset *pkg.PassphraseReset) error {
+	r.insert(&reset.UUID, reset)
+	return nil
+}
+
+func (r *memoryPassphraseResets) Use(id string, now time.Time) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	reset, ok := r.records[id]
+	if !ok || reset.Used || now.After(reset.ExpiresAt) {
+		return false, nil
+	}
+
+	for otherId, other := range r.records {
+		if other.UserId == reset.UserId && !other.Used {
+			other.Used = true
+			r.records[otherId] = other
+		}
+	}
+
+	return true, nil
+}
+
+type memoryEmailVerifications struct {
+	*memoryStore[pkg.EmailVerification]
+}
+
+func (r *memoryEmailVerifications) FindByTokenHash(hash string) (*pkg.EmailVerification, error) {
+	return r.find(func(verification pkg.EmailVerification) bool { return verification.TokenHash == hash }), nil
+}
+
+func (r *memoryEmailVerifications) Create(verification *pkg.EmailVerification) error {
+	r.insert(&verification.UUID, verification)
+	return nil
+}
+
+func (r *memoryEmailVerifications) SetUsed(id string) error {
+	return r.update(id, func(verification *pkg.EmailVerification) {
+		verification.Used = true
+	})
+}
+
+type memoryExports struct {
+	*memoryStore[pkg.Export]
+}
+
+func (r *memoryExports) FindById(id string) (*pkg.Export, error) {
+	return r.find(func(export pkg.Export) bool { return export.UUID == id }), nil
+}
+
+func (r *memoryExports) ListByStatus(userId string, statuses ...string) ([]pkg.Export, error) {
+	return r.filter(func(export pkg.Export) bool {
+		return (userId == "" || export.UserId == userId) && slices.Contains(statuses, export.Status)
+	}, newestFirst(func(export pkg.Export) time.Time { return export.CreatedAt })), nil
+}
+
+func (r *memoryExports) Create(export *pkg.Export) error {
+	r.insert(&export.UUID, export)
+	return nil
+}
+
+func (r *memoryExports) Finish(id string, status string, key string, completedAt time.Time, expiresAt time.Time) error {
+	return r.update(id, func(export *pkg.Export) {
+		export.Status = status
+		export.Key = key
+		export.CompletedAt = completedAt
+		export.ExpiresAt = expiresAt
+	})
+}
+
+func (r *memoryExports) SetStatus(id string, status string) error {
+	return r.update(id, func(export *pkg.Export) {
+		export.Status = status
+		export.Key = ""
+	})
+}
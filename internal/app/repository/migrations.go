@@ -0,0 +1,424 @@
+package repository
+
+import (
+	"cloudbuddy/internal/pkg"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// schema changes in the order they are applied, each one once. released
+// migrations are never edited, changes go into a new one. the users' images
+// are the images with their user_id, there is no list of them.
+var migrations = []struct {
+	sqlite   string
+	postgres string
+}{
+	{
+		sqlite: `
+			CREATE TABLE users (
+				id                  TEXT PRIMARY KEY,
+				username            TEXT NOT NULL,
+				username_key        TEXT NOT NULL UNIQUE,
+				fullname            TEXT NOT NULL DEFAULT '',
+				email               TEXT NOT NULL DEFAULT '',
+				email_verified      BOOLEAN NOT NULL DEFAULT FALSE,
+				role                TEXT NOT NULL,
+				passphrase          TEXT NOT NULL DEFAULT '',
+				token_version       BIGINT NOT NULL DEFAULT 0,
+				totp_enabled        BOOLEAN NOT NULL DEFAULT FALSE,
+				totp_secret         TEXT NOT NULL DEFAULT '',
+				totp_pending_secret TEXT NOT NULL DEFAULT '',
+				created_at          TIMESTAMP NOT NULL
+			);
+			CREATE INDEX users_email ON users (email);
+			CREATE TABLE recovery_codes (
+				user_id TEXT NOT NULL REFERENCES users (id),
+				hash    TEXT NOT NULL,
+				PRIMARY KEY (user_id, hash)
+			);
+			CREATE TABLE images (
+				id         TEXT PRIMARY KEY,
+				title      TEXT NOT NULL DEFAULT '',
+				backend    TEXT NOT NULL,
+				object_key TEXT NOT NULL DEFAULT '',
+				likes      BIGINT NOT NULL DEFAULT 0,
+				user_id    TEXT NOT NULL REFERENCES users (id),
+				created_at TIMESTAMP NOT NULL
+			);
+			CREATE INDEX images_created_at ON images (created_at);
+			CREATE INDEX images_user_id ON images (user_id, created_at);
+		`,
+		postgres: `
+			CREATE TABLE users (
+				id                  TEXT PRIMARY KEY,
+				username            TEXT NOT NULL,
+				username_key        TEXT NOT NULL UNIQUE,
+				fullname            TEXT NOT NULL DEFAULT '',
+				email               TEXT NOT NULL DEFAULT '',
+				email_verified      BOOLEAN NOT NULL DEFAULT FALSE,
+				role                TEXT NOT NULL,
+				passphrase          TEXT NOT NULL DEFAULT '',
+				token_version       BIGINT NOT NULL DEFAULT 0,
+				totp_enabled        BOOLEAN NOT NULL DEFAULT FALSE,
+				totp_secret         TEXT NOT NULL DEFAULT '',
+				totp_pending_secret TEXT NOT NULL DEFAULT '',
+				created_at          TIMESTAMPTZ NOT NULL
+			);
+			CREATE INDEX users_email ON users (email);
+			CREATE TABLE recovery_codes (
+				user_id TEXT NOT NULL REFERENCES users (id),
+				hash    TEXT NOT NULL,
+				PRIMARY KEY (user_id, hash)
+			);
+			CREATE TABLE images (
+				id         TEXT PRIMARY KEY,
+				title      TEXT NOT NULL DEFAULT '',
+				backend    TEXT NOT NULL,
+				object_key TEXT NOT NULL DEFAULT '',
+				likes      BIGINT NOT NULL DEFAULT 0,
+				user_id    TEXT NOT NULL REFERENCES users (id),
+				created_at TIMESTAMPTZ NOT NULL
+			);
+			CREATE INDEX images_created_at ON images (created_at);
+			CREATE INDEX images_user_id ON images (user_id, created_at);
+		`,
+	},
+	{
+		sqlite:   `ALTER TABLE users ADD COLUMN totp_last_step BIGINT NOT NULL DEFAULT 0;`,
+		postgres: `ALTER TABLE users ADD COLUMN totp_last_step BIGINT NOT NULL DEFAULT 0;`,
+	},
+	{
+		sqlite:   `CREATE UNIQUE INDEX users_verified_email ON users (email) WHERE email_verified;`,
+		postgres: `CREATE UNIQUE INDEX users_verified_email ON users (email) WHERE email_verified;`,
+	},
+	{
+		sqlite: `
+			CREATE TABLE sessions (
+				id           TEXT PRIMARY KEY,
+				user_id      TEXT NOT NULL REFERENCES users (id),
+				token_hash   TEXT NOT NULL DEFAULT '',
+				revoked      BOOLEAN NOT NULL DEFAULT FALSE,
+				user_agent   TEXT NOT NULL DEFAULT '',
+				ip           TEXT NOT NULL DEFAULT '',
+				expires_at   TIMESTAMP NOT NULL,
+				last_used_at TIMESTAMP NOT NULL,
+				created_at   TIMESTAMP NOT NULL
+			);
+			CREATE INDEX sessions_user_id ON sessions (user_id);
+			CREATE TABLE session_used_hashes (
+				session_id TEXT NOT NULL REFERENCES sessions (id) ON DELETE CASCADE,
+				position   INTEGER NOT NULL,
+				hash       TEXT NOT NULL,
+				PRIMARY KEY (session_id, position)
+			);
+			CREATE TABLE revoked_tokens (
+				jti        TEXT PRIMARY KEY,
+				user_id    TEXT NOT NULL REFERENCES users (id),
+				expires_at TIMESTAMP NOT NULL,
+				created_at TIMESTAMP NOT NULL
+			);
+			CREATE INDEX revoked_tokens_expires_at ON revoked_tokens (expires_at);
+		`,
+		postgres: `
+			CREATE TABLE sessions (
+				id           TEXT PRIMARY KEY,
+				user_id      TEXT NOT NULL REFERENCES users (id),
+				token_hash   TEXT NOT NULL DEFAULT '',
+				revoked      BOOLEAN NOT NULL DEFAULT FALSE,
+				user_agent   TEXT NOT NULL DEFAULT '',
+				ip           TEXT NOT NULL DEFAULT '',
+				expires_at   TIMESTAMPTZ NOT NULL,
+				last_used_at TIMESTAMPTZ NOT NULL,
+				created_at   TIMESTAMPTZ NOT NULL
+			);
+			CREATE INDEX sessions_user_id ON sessions (user_id);
+			CREATE TABLE session_used_hashes (
+				session_id TEXT NOT NULL REFERENCES sessions (id) ON DELETE CASCADE,
+				position   INTEGER NOT NULL,
+				hash       TEXT NOT NULL,
+				PRIMARY KEY (session_id, position)
+			);
+			CREATE TABLE revoked_tokens (
+				jti        TEXT PRIMARY KEY,
+				user_id    TEXT NOT NULL REFERENCES users (id),
+				expires_at TIMESTAMPTZ NOT NULL,
+				created_at TIMESTAMPTZ NOT NULL
+			);
+			CREATE INDEX revoked_tokens_expires_at ON revoked_tokens (expires_at);
+		`,
+	},
+	{
+		sqlite: `
+			CREATE TABLE signin_attempts (
+				throttle_key    TEXT PRIMARY KEY,
+				failures        BIGINT NOT NULL,
+				last_failure_at TIMESTAMP NOT NULL,
+				expires_at      TIMESTAMP NOT NULL
+			);
+			CREATE INDEX signin_attempts_expires_at ON signin_attempts (expires_at);
+		`,
+		postgres: `
+			CREATE TABLE signin_attempts (
+				throttle_key    TEXT PRIMARY KEY,
+				failures        BIGINT NOT NULL,
+				last_failure_at TIMESTAMPTZ NOT NULL,
+				expires_at      TIMESTAMPTZ NOT NULL
+			);
+			CREATE INDEX signin_attempts_expires_at ON signin_attempts (expires_at);
+		`,
+	},
+	{
+		sqlite: `
+			CREATE TABLE api_keys (
+				id           TEXT PRIMARY KEY,
+				user_id      TEXT NOT NULL REFERENCES users (id),
+				name         TEXT NOT NULL,
+				prefix       TEXT NOT NULL UNIQUE,
+				key_hash     TEXT NOT NULL,
+				last_used_at TIMESTAMP NOT NULL,
+				created_at   TIMESTAMP NOT NULL
+			);
+			CREATE INDEX api_keys_user_id ON api_keys (user_id);
+			CREATE TABLE api_key_scopes (
+				api_key_id TEXT NOT NULL REFERENCES api_keys (id) ON DELETE CASCADE,
+				position   INTEGER NOT NULL,
+				scope      TEXT NOT NULL,
+				PRIMARY KEY (api_key_id, position)
+			);
+		`,
+		postgres: `
+			CREATE TABLE api_keys (
+				id           TEXT PRIMARY KEY,
+				user_id      TEXT NOT NULL REFERENCES users (id),
+				name         TEXT NOT NULL,
+				prefix       TEXT NOT NULL UNIQUE,
+				key_hash     TEXT NOT NULL,
+				last_used_at TIMESTAMPTZ NOT NULL,
+				created_at   TIMESTAMPTZ NOT NULL
+			);
+			CREATE INDEX api_keys_user_id ON api_keys (user_id);
+			CREATE TABLE api_key_scopes (
+				api_key_id TEXT NOT NULL REFERENCES api_keys (id) ON DELETE CASCADE,
+				position   INTEGER NOT NULL,
+				scope      TEXT NOT NULL,
+				PRIMARY KEY (api_key_id, position)
+			);
+		`,
+	},
+	{
+		sqlite: `
+			CREATE TABLE credentials (
+				id            TEXT PRIMARY KEY,
+				user_id       TEXT NOT NULL REFERENCES users (id),
+				credential_id TEXT NOT NULL UNIQUE,
+				name          TEXT NOT NULL,
+				credential    TEXT NOT NULL,
+				last_used_at  TIMESTAMP NOT NULL,
+				created_at    TIMESTAMP NOT NULL
+			);
+			CREATE INDEX credentials_user_id ON credentials (user_id);
+			CREATE TABLE webauthn_challenges (
+				id         TEXT PRIMARY KEY,
+				kind       TEXT NOT NULL,
+				session    TEXT NOT NULL,
+				expires_at TIMESTAMP NOT NULL,
+				created_at TIMESTAMP NOT NULL
+			);
+			CREATE INDEX webauthn_challenges_expires_at ON webauthn_challenges (expires_at);
+		`,
+		postgres: `
+			CREATE TABLE credentials (
+				id            TEXT PRIMARY KEY,
+				user_id       TEXT NOT NULL REFERENCES users (id),
+				credential_id TEXT NOT NULL UNIQUE,
+				name          TEXT NOT NULL,
+				credential    TEXT NOT NULL,
+				last_used_at  TIMESTAMPTZ NOT NULL,
+				created_at    TIMESTAMPTZ NOT NULL
+			);
+			CREATE INDEX credentials_user_id ON credentials (user_id);
+			CREATE TABLE webauthn_challenges (
+				id         TEXT PRIMARY KEY,
+				kind       TEXT NOT NULL,
+				session    TEXT NOT NULL,
+				expires_at TIMESTAMPTZ NOT NULL,
+				created_at TIMESTAMPTZ NOT NULL
+			);
+			CREATE INDEX webauthn_challenges_expires_at ON webauthn_challenges (expires_at);
+		`,
+	},
+	{
+		sqlite: `
+			CREATE TABLE identities (
+				id         TEXT PRIMARY KEY,
+				user_id    TEXT NOT NULL REFERENCES users (id),
+				provider   TEXT NOT NULL,
+				subject    TEXT NOT NULL,
+				email      TEXT NOT NULL DEFAULT '',
+				created_at TIMESTAMP NOT NULL,
+				UNIQUE (provider, subject)
+			);
+			CREATE TABLE oidc_states (
+				id         TEXT PRIMARY KEY,
+				provider   TEXT NOT NULL,
+				state      TEXT NOT NULL,
+				nonce      TEXT NOT NULL,
+				verifier   TEXT NOT NULL,
+				user_id    TEXT REFERENCES users (id),
+				expires_at TIMESTAMP NOT NULL,
+				created_at TIMESTAMP NOT NULL,
+				UNIQUE (provider, state)
+			);
+			CREATE INDEX oidc_states_expires_at ON oidc_states (expires_at);
+		`,
+		postgres: `
+			CREATE TABLE identities (
+				id         TEXT PRIMARY KEY,
+				user_id    TEXT NOT NULL REFERENCES users (id),
+				provider   TEXT NOT NULL,
+				subject    TEXT NOT NULL,
+				email      TEXT NOT NULL DEFAULT '',
+				created_at TIMESTAMPTZ NOT NULL,
+				UNIQUE (provider, subject)
+			);
+			CREATE TABLE oidc_states (
+				id         TEXT PRIMARY KEY,
+				provider   TEXT NOT NULL,
+				state      TEXT NOT NULL,
+				nonce      TEXT NOT NULL,
+				verifier   TEXT NOT NULL,
+				user_id    TEXT REFERENCES users (id),
+				expires_at TIMESTAMPTZ NOT NULL,
+				created_at TIMESTAMPTZ NOT NULL,
+				UNIQUE (provider, state)
+			);
+			CREATE INDEX oidc_states_expires_at ON oidc_states (expires_at);
+		`,
+	},
+	{
+		sqlite: `
+			CREATE TABLE passphrase_resets (
+				id         TEXT PRIMARY KEY,
+				user_id    TEXT NOT NULL REFERENCES users (id),
+				token_hash TEXT NOT NULL UNIQUE,
+				used       BOOLEAN NOT NULL DEFAULT FALSE,
+				expires_at TIMESTAMP NOT NULL,
+				created_at TIMESTAMP NOT NULL
+			);
+			CREATE TABLE email_verifications (
+				id         TEXT PRIMARY KEY,
+				user_id    TEXT NOT NULL REFERENCES users (id),
+				email      TEXT NOT NULL,
+				token_hash TEXT NOT NULL UNIQUE,
+				used       BOOLEAN NOT NULL DEFAULT FALSE,
+				expires_at TIMESTAMP NOT NULL,
+				created_at TIMESTAMP NOT NULL
+			);
+		`,
+		postgres: `
+			CREATE TABLE passphrase_resets (
+				id         TEXT PRIMARY KEY,
+				user_id    TEXT NOT NULL REFERENCES users (id),
+				token_hash TEXT NOT NULL UNIQUE,
+				used       BOOLEAN NOT NULL DEFAULT FALSE,
+				expires_at TIMESTAMPTZ NOT NULL,
+				created_at TIMESTAMPTZ NOT NULL
+			);
+			CREATE TABLE email_verifications (
+				id         TEXT PRIMARY KEY,
+				user_id    TEXT NOT NULL REFERENCES users (id),
+				email      TEXT NOT NULL,
+				token_hash TEXT NOT NULL UNIQUE,
+				used       BOOLEAN NOT NULL DEFAULT FALSE,
+				expires_at TIMESTAMPTZ NOT NULL,
+				created_at TIMESTAMPTZ NOT NULL
+			);
+		`,
+	},
+	{
+		sqlite: `
+			CREATE TABLE exports (
+				id           TEXT PRIMARY KEY,
+				user_id      TEXT NOT NULL REFERENCES users (id),
+				status       TEXT NOT NULL,
+				object_key   TEXT NOT NULL DEFAULT '',
+				created_at   TIMESTAMP NOT NULL,
+				completed_at TIMESTAMP NOT NULL,
+				expires_at   TIMESTAMP NOT NULL
+			);
+			CREATE INDEX exports_status ON exports (status, user_id);
+		`,
+		postgres: `
+			CREATE TABLE exports (
+				id           TEXT PRIMARY KEY,
+				user_id      TEXT NOT NULL REFERENCES users (id),
+				status       TEXT NOT NULL,
+				object_key   TEXT NOT NULL DEFAULT '',
+				created_at   TIMESTAMPTZ NOT NULL,
+				completed_at TIMESTAMPTZ NOT NULL,
+				expires_at   TIMESTAMPTZ NOT NULL
+			);
+			CREATE INDEX exports_status ON exports (status, user_id);
+		`,
+	},
+	{
+		sqlite: `
+			CREATE TABLE clover_import (
+				dir         TEXT NOT NULL,
+				imported_at TIMESTAMP NOT NULL
+			);
+		`,
+		postgres: `
+			CREATE TABLE clover_import (
+				dir         TEXT NOT NULL,
+				imported_at TIMESTAMPTZ NOT NULL
+			);
+		`,
+	},
+}
+
+// brings the schema up to date in one transaction. on postgres replicas
+// starting at the same time wait for the first one to finish.
+func migrate(db *sql.DB, driver string) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, applied_at TIMESTAMP NOT NULL)`)
+	if err != nil {
+		return fmt.Errorf("creating schema_migrations: %w", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if driver == pkg.DatabasePostgres {
+		if _, err := tx.Exec(`LOCK TABLE schema_migrations IN EXCLUSIVE MODE`); err != nil {
+			return err
+		}
+	}
+
+	var current int
+	err = tx.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current)
+	if err != nil {
+		return err
+	}
+
+	for i := current; i < len(migrations); i++ {
+		schema := migrations[i].sqlite
+		if driver == pkg.DatabasePostgres {
+			schema = migrations[i].postgres
+		}
+
+		if _, err := tx.Exec(schema); err != nil {
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+
+		_, err = tx.Exec(rebind(driver, `INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`), i+1, time.Now().UTC())
+		if err != nil {
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,273 @@
+package repository
+
+import (
+	"cloudbuddy/internal/pkg"
+	"errors"
+	"slices"
+	"time"
+)
+
+// returned by updates of records which don't exist. lookups return nil
+// instead.
+var ErrNotFound = errors.New("not found")
+
+// returned by UserRepository.Create when another user has the username key
+var ErrUsernameTaken = errors.New("username taken")
+
+// the data layer the handlers work with, see NewCloverRepositories,
+// NewSqlRepositories and NewMemoryRepositories
+type Repositories struct {
+	Images             ImageRepository
+	Users              UserRepository
+	Sessions           SessionRepository
+	RevokedTokens      RevokedTokenRepository
+	SigninAttempts     SigninAttemptRepository
+	ApiKeys            ApiKeyRepository
+	Credentials        CredentialRepository
+	WebAuthnChallenges WebAuthnChallengeRepository
+	Identities         IdentityRepository
+	OidcStates         OidcStateRepository
+	PassphraseResets   PassphraseResetRepository
+	EmailVerifications EmailVerificationRepository
+	Exports            ExportRepository
+}
+
+// images are returned without Url, it is resolved from Key and Backend when
+// they are served
+type ImageRepository interface {
+	FindById(id string) (*pkg.Image, error)
+	// newest first
+	List(offset int, limit int) ([]pkg.Image, error)
+	// the images of a user, newest first
+	ListByUser(userId string) ([]pkg.Image, error)
+	Count() (int, error)
+	// stores a new image, UUID is set if it's empty
+	Create(image *pkg.Image) error
+	SetKey(id string, key string) error
+	SetTitle(id string, title string) error
+	// adds delta to the likes of the image
+	AddLikes(id string, delta int64) error
+	Delete(id string) error
+}
+
+type UserRepository interface {
+	FindById(id string) (*pkg.User, error)
+	FindByUsernameKey(key string) (*pkg.User, error)
+	// the user who verified email, unverified addresses don't count
+	FindByVerifiedEmail(email string) (*pkg.User, error)
+	// newest first
+	List() ([]pkg.User, error)
+	// stores a new user, UUID is set if it's empty. ErrUsernameTaken if
+	// another user has the same UsernameKey.
+	Create(user *pkg.User) error
+	SetRole(id string, role string) error
+	SetPassphrase(id string, hash string) error
+	// sets the passphrase and revokes every token issued before, returns
+	// the new token version
+	ChangePassphrase(id string, hash string) (int64, error)
+	// revokes every token issued so far, returns the new token version
+	RevokeTokens(id string) (int64, error)
+	// sets a new, unverified email
+	SetEmail(id string, email string) error
+	// marks email verified if it is still the user's email and nobody else
+	// verified it first, reports whether it was. the address is taken from
+	// other users who set it without verifying it.
+	VerifyEmail(id string, email string) (bool, error)
+	SetTotpPendingSecret(id string, secret string) error
+	// activates secret and replaces the recovery codes, the pending secret
+	// is cleared. step is the time step of the code which confirmed it.
+	EnableTotp(id string, secret string, recoveryCodes []string, step int64) error
+	DisableTotp(id string) error
+	// records step as the last used totp time step if it is newer than the
+	// last one, reports whether it was
+	UseTotpStep(id string, step int64) (bool, error)
+	// removes the recovery code with the given hash, reports whether the
+	// user had it
+	UseRecoveryCode(id string, hash string) (bool, error)
+	AddImage(id string, imageId string) error
+	RemoveImage(id string, imageId string) error
+}
+
+// what SessionRepository.Rotate did with a refresh token
+type Rotation int
+
+const (
+	// the session is unknown, revoked or expired, or the token was never
+	// issued for it
+	RotationRejected Rotation = iota
+	Rotated
+	// the token was rotated out before and presented again, the session
+	// is revoked now
+	RotationReused
+)
+
+// counts an attempt at now on the stored entry unless policy blocks it, every
+// implementation runs it while holding on to the entry. returns until when the
+// attempt is blocked, the entry is only changed when it isn't.
+func reserve(attempt *pkg.SigninAttempt, policy pkg.ThrottlePolicy, now time.Time) time.Time {
+	// failures older than the window are forgotten, the count starts over
+	if now.Sub(attempt.LastFailureAt) > policy.Window {
+		attempt.Failures = 0
+	}
+
+	if until := policy.BlockedUntil(attempt.Failures, attempt.LastFailureAt); until.After(now) {
+		return until
+	}
+
+	attempt.Failures++
+	attempt.LastFailureAt = now
+	return time.Time{}
+}
+
+// applies a refresh to the stored session, every implementation runs it
+// while holding on to the session. the session is changed in place.
+func rotate(session *pkg.Session, hash string, newHash string, userAgent string, ip string, now time.Time) Rotation {
+	if session.Revoked || now.After(session.ExpiresAt) {
+		return RotationRejected
+	}
+
+	if session.TokenHash != hash {
+		if !slices.Contains(session.UsedHashes, hash) {
+			return RotationRejected
+		}
+
+		session.Revoked = true
+		return RotationReused
+	}
+
+	usedHashes := append(slices.Clone(session.UsedHashes), hash)
+	if len(usedHashes) > pkg.UsedRefreshHashesKept {
+		usedHashes = usedHashes[len(usedHashes)-pkg.UsedRefreshHashesKept:]
+	}
+
+	session.TokenHash = newHash
+	session.UsedHashes = usedHashes
+	session.ExpiresAt = now.Add(pkg.RefreshTokenTTL)
+	session.UserAgent = userAgent
+	session.IP = ip
+	session.LastUsedAt = now
+	return Rotated
+}
+
+type SessionRepository interface {
+	FindById(id string) (*pkg.Session, error)
+	// the user's sessions which are neither revoked nor expired, most
+	// recently used first
+	ListActive(userId string) ([]pkg.Session, error)
+	// every session of the user, revoked and expired ones included, newest
+	// first
+	ListByUser(userId string) ([]pkg.Session, error)
+	// stores a new session, UUID is set if it's empty
+	Create(session *pkg.Session) error
+	SetTokenHash(id string, hash string) error
+	// replaces the refresh token with the hash by the one with newHash and
+	// records the client using it. of two concurrent rotations with the same
+	// token only one succeeds. returns the id of the session's user.
+	Rotate(id string, hash string, newHash string, userAgent string, ip string) (string, Rotation, error)
+	// revokes the session if it is an active one of the user, reports
+	// whether it was
+	Revoke(id string, userId string) (bool, error)
+	// revokes the session if hash is the hash of its current refresh token
+	RevokeByTokenHash(id string, hash string) error
+	// revokes every session of the user except exceptId, which may be empty
+	RevokeByUser(userId string, exceptId string) error
+}
+
+type RevokedTokenRepository interface {
+	Create(token *pkg.RevokedToken) error
+	IsRevoked(jti string) (bool, error)
+}
+
+type SigninAttemptRepository interface {
+	Find(key string) (*pkg.SigninAttempt, error)
+	// counts an attempt under key at now as a failure, unless the failures
+	// counted before block it under policy. returns until when it is
+	// blocked, zero if it was counted. concurrent attempts are counted one
+	// after the other, so each of them sees the ones before.
+	Reserve(key string, policy pkg.ThrottlePolicy, now time.Time) (time.Time, error)
+	// takes back an attempt Reserve counted which didn't fail
+	Refund(key string) error
+	Delete(key string) error
+}
+
+// api keys are returned with their hash, it is never served
+type ApiKeyRepository interface {
+	FindByPrefix(prefix string) (*pkg.ApiKey, error)
+	// newest first
+	ListByUser(userId string) ([]pkg.ApiKey, error)
+	// stores a new api key, UUID is set if it's empty
+	Create(apiKey *pkg.ApiKey) error
+	SetLastUsedAt(id string, at time.Time) error
+	// deletes the api key if it belongs to the user, ErrNotFound otherwise
+	Delete(id string, userId string) error
+	DeleteByUser(userId string) error
+}
+
+type CredentialRepository interface {
+	// newest first
+	ListByUser(userId string) ([]pkg.Credential, error)
+	// stores a new credential, UUID is set if it's empty
+	Create(credential *pkg.Credential) error
+	// stores the library's record of the user's credential with the
+	// webauthn credential id after it was used at the given time,
+	// ErrNotFound if the user has no such credential
+	SetCredential(userId string, credentialId string, credential string, usedAt time.Time) error
+	// deletes the credential if it belongs to the user, ErrNotFound
+	// otherwise
+	Delete(id string, userId string) error
+}
+
+type WebAuthnChallengeRepository interface {
+	// stores a new challenge, UUID is set if it's empty
+	Create(challenge *pkg.WebAuthnChallenge) error
+	// deletes the challenge and returns it, nil if there is none. of two
+	// concurrent takes only one gets it.
+	Take(id string) (*pkg.WebAuthnChallenge, error)
+}
+
+type IdentityRepository interface {
+	FindBySubject(provider string, subject string) (*pkg.Identity, error)
+	// newest first
+	ListByUser(userId string) ([]pkg.Identity, error)
+	// stores a new identity, UUID is set if it's empty
+	Create(identity *pkg.Identity) error
+}
+
+type OidcStateRepository interface {
+	// stores a new state, UUID is set if it's empty
+	Create(state *pkg.OidcState) error
+	// deletes the state of the provider and returns it, nil if there is
+	// none. of two concurrent takes only one gets it.
+	Take(provider string, state string) (*pkg.OidcState, error)
+}
+
+type PassphraseResetRepository interface {
+	FindByTokenHash(hash string) (*pkg.PassphraseReset, error)
+	// stores a new reset, UUID is set if it's empty
+	Create(reset *pkg.PassphraseReset) error
+	// marks the reset used if it is neither used nor expired at now, along
+	// with every other unused reset of the same user. reports whether it
+	// was.
+	Use(id string, now time.Time) (bool, error)
+}
+
+type EmailVerificationRepository interface {
+	FindByTokenHash(hash string) (*pkg.EmailVerification, error)
+	// stores a new verification, UUID is set if it's empty
+	Create(verification *pkg.EmailVerification) error
+	SetUsed(id string) error
+}
+
+type ExportRepository interface {
+	FindById(id string) (*pkg.Export, error)
+	// exports with one of the statuses as stored, of every user or, if
+	// userId isn't empty, of that user
+	ListByStatus(userId string, statuses ...string) ([]pkg.Export, error)
+	// stores a new export, UUID is set if it's empty
+	Create(export *pkg.Export) error
+	// records the outcome of the export's job, expiresAt is zero unless the
+	// archive is ready
+	Finish(id string, status string, key string, completedAt time.Time, expiresAt time.Time) error
+	// sets the status and forgets the archive's key
+	SetStatus(id string, status string) error
+}
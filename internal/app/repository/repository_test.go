@@ -0,0 +1,847 @@
+package repository
+
+import (
+	"cloudbuddy/internal/pkg"
+	"database/sql"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	embeddedpostgres "github.com/fergusstrange/embedded-postgres"
+	cl "github.com/ostafen/clover/v2"
+)
+
+// every implementation runs the same tests, open returns empty repositories
+func testRepositories(t *testing.T, open func(t *testing.T) *Repositories) {
+	t.Run("users", func(t *testing.T) { testUsers(t, open(t)) })
+	t.Run("emails", func(t *testing.T) { testEmails(t, open(t)) })
+	t.Run("totp", func(t *testing.T) { testTotp(t, open(t)) })
+	t.Run("images", func(t *testing.T) { testImages(t, open(t)) })
+	t.Run("usernames", func(t *testing.T) { testUsernames(t, open(t)) })
+	t.Run("sessions", func(t *testing.T) { testSessions(t, open(t)) })
+	t.Run("throttle", func(t *testing.T) { testThrottle(t, open(t)) })
+	t.Run("api keys", func(t *testing.T) { testApiKeys(t, open(t)) })
+	t.Run("credentials", func(t *testing.T) { testCredentials(t, open(t)) })
+	t.Run("identities", func(t *testing.T) { testIdentities(t, open(t)) })
+	t.Run("single use", func(t *testing.T) { testSingleUse(t, open(t)) })
+	t.Run("exports", func(t *testing.T) { testExports(t, open(t)) })
+}
+
+func TestMemoryRepositories(t *testing.T) {
+	testRepositories(t, func(t *testing.T) *Repositories {
+		return NewMemoryRepositories()
+	})
+}
+
+func TestCloverRepositories(t *testing.T) {
+	testRepositories(t, func(t *testing.T) *Repositories {
+		return NewCloverRepositories(openTestClover(t, t.TempDir()))
+	})
+}
+
+func TestSqliteRepositories(t *testing.T) {
+	testRepositories(t, func(t *testing.T) *Repositories {
+		return NewSqlRepositories(openTestSqlite(t), pkg.DatabaseSqlite)
+	})
+}
+
+// runs against the postgres server at DATABASE_TEST_URL, every table in its
+// database is emptied. without it a throwaway server is started.
+func TestPostgresRepositories(t *testing.T) {
+	url := os.Getenv("DATABASE_TEST_URL")
+	if url == "" {
+		url = startTestPostgres(t)
+	}
+
+	testRepositories(t, func(t *testing.T) *Repositories {
+		db, err := OpenSql(pkg.DatabasePostgres, url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+
+		_, err = db.Exec(`TRUNCATE users, images, sessions, revoked_tokens, signin_attempts, webauthn_challenges, oidc_states CASCADE`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return NewSqlRepositories(db, pkg.DatabasePostgres)
+	})
+}
+
+// every connection checks foreign keys, not only the one the schema was
+// migrated on
+func TestSqliteForeignKeys(t *testing.T) {
+	repos := NewSqlRepositories(openTestSqlite(t), pkg.DatabaseSqlite)
+
+	image := &pkg.Image{Title: "image", Backend: "s3", UserId: "missing", CreatedAt: testTime}
+	if err := repos.Images.Create(image); err == nil {
+		t.Fatal("created an image of a missing user")
+	}
+
+	session := &pkg.Session{UserId: "missing", UsedHashes: []string{}, ExpiresAt: testTime, LastUsedAt: testTime, CreatedAt: testTime}
+	if err := repos.Sessions.Create(session); err == nil {
+		t.Fatal("created a session of a missing user")
+	}
+}
+
+// the binaries are downloaded on the first run and cached in the home
+// directory
+func startTestPostgres(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := uint32(listener.Addr().(*net.TCPAddr).Port)
+	listener.Close()
+
+	dir := t.TempDir()
+	cfg := embeddedpostgres.DefaultConfig().
+		Port(port).
+		RuntimePath(filepath.Join(dir, "runtime")).
+		DataPath(filepath.Join(dir, "data")).
+		Logger(io.Discard)
+
+	server := embeddedpostgres.NewDatabase(cfg)
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Stop() })
+
+	return cfg.GetConnectionURL() + "?sslmode=disable"
+}
+
+func openTestClover(t *testing.T, dir string) *cl.DB {
+	t.Helper()
+
+	db, err := OpenClover(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+func openTestSqlite(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := OpenSql(pkg.DatabaseSqlite, filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+// whole seconds in utc survive every backend unchanged
+var testTime = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+func createUser(t *testing.T, repos *Repositories, username string, age time.Duration) *pkg.User {
+	t.Helper()
+
+	user := &pkg.User{
+		Username:      username,
+		UsernameKey:   username,
+		Role:          pkg.RoleUser,
+		Passphrase:    "hash",
+		RecoveryCodes: []string{},
+		Images:        []string{},
+		CreatedAt:     testTime.Add(-age),
+	}
+	if err := repos.Users.Create(user); err != nil {
+		t.Fatal(err)
+	}
+	if user.UUID == "" {
+		t.Fatal("Create didn't set the id")
+	}
+
+	return user
+}
+
+func findUser(t *testing.T, repos *Repositories, id string) *pkg.User {
+	t.Helper()
+
+	user, err := repos.Users.FindById(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user == nil {
+		t.Fatalf("user %s not found", id)
+	}
+
+	return user
+}
+
+func testUsers(t *testing.T, repos *Repositories) {
+	alice := createUser(t, repos, "alice", 2*time.Hour)
+	bob := createUser(t, repos, "bob", time.Hour)
+
+	found := findUser(t, repos, alice.UUID)
+	if found.Username != "alice" || found.Role != pkg.RoleUser || !found.CreatedAt.Equal(alice.CreatedAt) {
+		t.Fatalf("unexpected user %+v", found)
+	}
+
+	byKey, err := repos.Users.FindByUsernameKey("bob")
+	if err != nil || byKey == nil || byKey.UUID != bob.UUID {
+		t.Fatalf("FindByUsernameKey: %+v %v", byKey, err)
+	}
+
+	missing, err := repos.Users.FindById("missing")
+	if err != nil || missing != nil {
+		t.Fatalf("FindById of a missing user: %+v %v", missing, err)
+	}
+
+	users, err := repos.Users.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || users[0].UUID != bob.UUID || users[1].UUID != alice.UUID {
+		t.Fatalf("List isn't newest first: %+v", users)
+	}
+
+	if err := repos.Users.SetRole(alice.UUID, pkg.RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	if role := findUser(t, repos, alice.UUID).Role; role != pkg.RoleAdmin {
+		t.Fatalf("want admin, got %s", role)
+	}
+
+	version, err := repos.Users.ChangePassphrase(alice.UUID, "new hash")
+	if err != nil || version != 1 {
+		t.Fatalf("ChangePassphrase: %d %v", version, err)
+	}
+	version, err = repos.Users.RevokeTokens(alice.UUID)
+	if err != nil || version != 2 {
+		t.Fatalf("RevokeTokens: %d %v", version, err)
+	}
+	found = findUser(t, repos, alice.UUID)
+	if found.Passphrase != "new hash" || found.TokenVersion != 2 {
+		t.Fatalf("unexpected passphrase or token version %+v", found)
+	}
+
+	// the sql databases list the user's rows in images instead, the images
+	// exist like they do when the handlers add them
+	var imageIds []string
+	for i := 0; i < 2; i++ {
+		image := &pkg.Image{Title: "image", Backend: "s3", UserId: alice.UUID, CreatedAt: testTime.Add(time.Duration(i) * time.Minute)}
+		if err := repos.Images.Create(image); err != nil {
+			t.Fatal(err)
+		}
+		if err := repos.Users.AddImage(alice.UUID, image.UUID); err != nil {
+			t.Fatal(err)
+		}
+		imageIds = append(imageIds, image.UUID)
+	}
+	if err := repos.Images.Delete(imageIds[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := repos.Users.RemoveImage(alice.UUID, imageIds[0]); err != nil {
+		t.Fatal(err)
+	}
+	if images := findUser(t, repos, alice.UUID).Images; !slices.Equal(images, imageIds[1:]) {
+		t.Fatalf("want %v, got %v", imageIds[1:], images)
+	}
+
+	// returned users are copies
+	found = findUser(t, repos, alice.UUID)
+	found.Images[0] = "changed"
+	if images := findUser(t, repos, alice.UUID).Images; images[0] != imageIds[1] {
+		t.Fatal("changing a returned user changed the stored one")
+	}
+
+	if err := repos.Users.SetRole("missing", pkg.RoleAdmin); err != ErrNotFound {
+		t.Fatalf("SetRole of a missing user: want ErrNotFound, got %v", err)
+	}
+	if _, err := repos.Users.RevokeTokens("missing"); err != ErrNotFound {
+		t.Fatalf("RevokeTokens of a missing user: want ErrNotFound, got %v", err)
+	}
+}
+
+func testEmails(t *testing.T, repos *Repositories) {
+	alice := createUser(t, repos, "alice", 0)
+	mallory := createUser(t, repos, "mallory", 0)
+
+	// mallory sets alice's address first without being able to verify it
+	if err := repos.Users.SetEmail(mallory.UUID, "alice@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := repos.Users.SetEmail(alice.UUID, "alice@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	owner, err := repos.Users.FindByVerifiedEmail("alice@example.com")
+	if err != nil || owner != nil {
+		t.Fatalf("unverified address has an owner: %+v %v", owner, err)
+	}
+
+	verified, err := repos.Users.VerifyEmail(alice.UUID, "alice@example.com")
+	if err != nil || !verified {
+		t.Fatalf("VerifyEmail: %v %v", verified, err)
+	}
+
+	owner, err = repos.Users.FindByVerifiedEmail("alice@example.com")
+	if err != nil || owner == nil || owner.UUID != alice.UUID {
+		t.Fatalf("want alice to own the address, got %+v %v", owner, err)
+	}
+	if email := findUser(t, repos, mallory.UUID).Email; email != "" {
+		t.Fatalf("mallory kept the address %q", email)
+	}
+
+	// a link mailed before alice verified doesn't work anymore
+	if err := repos.Users.SetEmail(mallory.UUID, "alice@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	verified, err = repos.Users.VerifyEmail(mallory.UUID, "alice@example.com")
+	if err != nil || verified {
+		t.Fatalf("second user verified a taken address: %v %v", verified, err)
+	}
+
+	// nor does one for an address the user changed since
+	if err := repos.Users.SetEmail(alice.UUID, "alice@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	verified, err = repos.Users.VerifyEmail(alice.UUID, "alice@example.com")
+	if err != nil || verified {
+		t.Fatalf("verified an old address: %v %v", verified, err)
+	}
+	if found := findUser(t, repos, alice.UUID); found.Email != "alice@example.org" || found.EmailVerified {
+		t.Fatalf("unexpected email state %+v", found)
+	}
+
+	if _, err := repos.Users.VerifyEmail("missing", "alice@example.org"); err != ErrNotFound {
+		t.Fatalf("VerifyEmail of a missing user: want ErrNotFound, got %v", err)
+	}
+}
+
+func testTotp(t *testing.T, repos *Repositories) {
+	alice := createUser(t, repos, "alice", 0)
+
+	if err := repos.Users.SetTotpPendingSecret(alice.UUID, "pending"); err != nil {
+		t.Fatal(err)
+	}
+	if err := repos.Users.EnableTotp(alice.UUID, "pending", []string{"code-1", "code-2"}, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	found := findUser(t, repos, alice.UUID)
+	if !found.TotpEnabled || found.TotpSecret != "pending" || found.TotpPendingSecret != "" || found.TotpLastStep != 100 {
+		t.Fatalf("unexpected totp state %+v", found)
+	}
+	if codes := found.RecoveryCodes; len(codes) != 2 {
+		t.Fatalf("want 2 recovery codes, got %v", codes)
+	}
+
+	for _, step := range []int64{99, 100} {
+		if used, err := repos.Users.UseTotpStep(alice.UUID, step); err != nil || used {
+			t.Fatalf("step %d was accepted after 100: %v", step, err)
+		}
+	}
+	if used, err := repos.Users.UseTotpStep(alice.UUID, 101); err != nil || !used {
+		t.Fatalf("step 101: %v %v", used, err)
+	}
+	if used, err := repos.Users.UseTotpStep(alice.UUID, 101); err != nil || used {
+		t.Fatalf("step 101 was accepted twice: %v", err)
+	}
+
+	if used, err := repos.Users.UseRecoveryCode(alice.UUID, "code-1"); err != nil || !used {
+		t.Fatalf("UseRecoveryCode: %v %v", used, err)
+	}
+	if used, err := repos.Users.UseRecoveryCode(alice.UUID, "code-1"); err != nil || used {
+		t.Fatalf("recovery code was used twice: %v", err)
+	}
+
+	if err := repos.Users.DisableTotp(alice.UUID); err != nil {
+		t.Fatal(err)
+	}
+	found = findUser(t, repos, alice.UUID)
+	if found.TotpEnabled || found.TotpSecret != "" || len(found.RecoveryCodes) != 0 {
+		t.Fatalf("totp still enabled %+v", found)
+	}
+}
+
+func testImages(t *testing.T, repos *Repositories) {
+	alice := createUser(t, repos, "alice", 0)
+	bob := createUser(t, repos, "bob", 0)
+
+	var ids []string
+	for i, owner := range []*pkg.User{alice, bob, alice} {
+		image := &pkg.Image{
+			Title:     "image",
+			Backend:   "s3",
+			UserId:    owner.UUID,
+			CreatedAt: testTime.Add(time.Duration(i) * time.Minute),
+		}
+		if err := repos.Images.Create(image); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, image.UUID)
+	}
+
+	count, err := repos.Images.Count()
+	if err != nil || count != 3 {
+		t.Fatalf("Count: %d %v", count, err)
+	}
+
+	images, err := repos.Images.List(1, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 2 || images[0].UUID != ids[1] || images[1].UUID != ids[0] {
+		t.Fatalf("List(1, 5) isn't the 2nd and 3rd newest: %+v", images)
+	}
+
+	images, err = repos.Images.ListByUser(alice.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 2 || images[0].UUID != ids[2] || images[1].UUID != ids[0] {
+		t.Fatalf("ListByUser isn't alice's images newest first: %+v", images)
+	}
+
+	if err := repos.Images.SetKey(ids[0], "images/key.png"); err != nil {
+		t.Fatal(err)
+	}
+	if err := repos.Images.SetTitle(ids[0], "sunset"); err != nil {
+		t.Fatal(err)
+	}
+	if err := repos.Images.AddLikes(ids[0], 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := repos.Images.AddLikes(ids[0], -1); err != nil {
+		t.Fatal(err)
+	}
+
+	image, err := repos.Images.FindById(ids[0])
+	if err != nil || image == nil {
+		t.Fatalf("FindById: %+v %v", image, err)
+	}
+	if image.Key != "images/key.png" || image.Title != "sunset" || image.Likes != 1 || image.Backend != "s3" || image.UserId != alice.UUID {
+		t.Fatalf("unexpected image %+v", image)
+	}
+
+	if err := repos.Images.Delete(ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	if image, err := repos.Images.FindById(ids[0]); err != nil || image != nil {
+		t.Fatalf("deleted image still found: %+v %v", image, err)
+	}
+	if err := repos.Images.SetTitle(ids[0], "gone"); err != ErrNotFound {
+		t.Fatalf("SetTitle of a deleted image: want ErrNotFound, got %v", err)
+	}
+}
+
+func testUsernames(t *testing.T, repos *Repositories) {
+	alice := createUser(t, repos, "alice", 0)
+
+	taken := &pkg.User{Username: "Alice", UsernameKey: "alice", Role: pkg.RoleUser, CreatedAt: testTime}
+	if err := repos.Users.Create(taken); err != ErrUsernameTaken {
+		t.Fatalf("second user with the key: want ErrUsernameTaken, got %v", err)
+	}
+
+	found, err := repos.Users.FindByUsernameKey("alice")
+	if err != nil || found == nil || found.UUID != alice.UUID {
+		t.Fatalf("the key changed hands: %+v %v", found, err)
+	}
+
+	missing, err := repos.Users.FindByUsernameKey("bob")
+	if err != nil || missing != nil {
+		t.Fatalf("FindByUsernameKey of a free key: %+v %v", missing, err)
+	}
+}
+
+func createSession(t *testing.T, repos *Repositories, userId string, hash string, lastUsed time.Time) *pkg.Session {
+	t.Helper()
+
+	session := &pkg.Session{
+		UserId:     userId,
+		TokenHash:  hash,
+		UsedHashes: []string{},
+		ExpiresAt:  lastUsed.Add(pkg.RefreshTokenTTL),
+		LastUsedAt: lastUsed,
+		CreatedAt:  lastUsed,
+	}
+	if err := repos.Sessions.Create(session); err != nil {
+		t.Fatal(err)
+	}
+
+	return session
+}
+
+func testSessions(t *testing.T, repos *Repositories) {
+	alice := createUser(t, repos, "alice", 0)
+	bob := createUser(t, repos, "bob", 0)
+	now := time.Now().UTC().Truncate(time.Second)
+
+	older := createSession(t, repos, alice.UUID, "older", now.Add(-time.Hour))
+	current := createSession(t, repos, alice.UUID, "", now)
+	other := createSession(t, repos, bob.UUID, "other", now)
+	expired := createSession(t, repos, alice.UUID, "expired", now.Add(-pkg.RefreshTokenTTL-time.Hour))
+
+	if err := repos.Sessions.SetTokenHash(current.UUID, "first"); err != nil {
+		t.Fatal(err)
+	}
+
+	active, err := repos.Sessions.ListActive(alice.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(active) != 2 || active[0].UUID != current.UUID || active[1].UUID != older.UUID {
+		t.Fatalf("ListActive isn't alice's unexpired sessions most recently used first: %+v", active)
+	}
+	all, err := repos.Sessions.ListByUser(alice.UUID)
+	if err != nil || len(all) != 3 || all[0].UUID != current.UUID || all[1].UUID != older.UUID || all[2].UUID != expired.UUID {
+		t.Fatalf("ListByUser isn't every session of alice newest first: %+v %v", all, err)
+	}
+
+	userId, rotation, err := repos.Sessions.Rotate(current.UUID, "first", "second", "agent", "10.0.0.1")
+	if err != nil || rotation != Rotated || userId != alice.UUID {
+		t.Fatalf("Rotate: %s %v %v", userId, rotation, err)
+	}
+	found, err := repos.Sessions.FindById(current.UUID)
+	if err != nil || found == nil {
+		t.Fatalf("FindById: %+v %v", found, err)
+	}
+	if found.TokenHash != "second" || !slices.Equal(found.UsedHashes, []string{"first"}) || found.UserAgent != "agent" || found.IP != "10.0.0.1" {
+		t.Fatalf("unexpected rotated session %+v", found)
+	}
+
+	if _, rotation, err := repos.Sessions.Rotate(current.UUID, "unknown", "third", "agent", "10.0.0.1"); err != nil || rotation != RotationRejected {
+		t.Fatalf("Rotate with a token never issued: %v %v", rotation, err)
+	}
+	if _, rotation, err := repos.Sessions.Rotate(expired.UUID, "expired", "third", "agent", "10.0.0.1"); err != nil || rotation != RotationRejected {
+		t.Fatalf("Rotate of an expired session: %v %v", rotation, err)
+	}
+	if _, rotation, err := repos.Sessions.Rotate("missing", "first", "third", "agent", "10.0.0.1"); err != nil || rotation != RotationRejected {
+		t.Fatalf("Rotate of a missing session: %v %v", rotation, err)
+	}
+
+	// the rotated out token comes back, the session is revoked
+	if _, rotation, err := repos.Sessions.Rotate(current.UUID, "first", "third", "agent", "10.0.0.1"); err != nil || rotation != RotationReused {
+		t.Fatalf("Rotate with a used token: %v %v", rotation, err)
+	}
+	if _, rotation, err := repos.Sessions.Rotate(current.UUID, "second", "third", "agent", "10.0.0.1"); err != nil || rotation != RotationRejected {
+		t.Fatalf("Rotate of a revoked session: %v %v", rotation, err)
+	}
+	if found, _ := repos.Sessions.FindById(current.UUID); found == nil || !found.Revoked {
+		t.Fatalf("session wasn't revoked on reuse: %+v", found)
+	}
+
+	if revoked, err := repos.Sessions.Revoke(older.UUID, bob.UUID); err != nil || revoked {
+		t.Fatalf("revoked someone else's session: %v %v", revoked, err)
+	}
+	if revoked, err := repos.Sessions.Revoke(older.UUID, alice.UUID); err != nil || !revoked {
+		t.Fatalf("Revoke: %v %v", revoked, err)
+	}
+	if revoked, err := repos.Sessions.Revoke(older.UUID, alice.UUID); err != nil || revoked {
+		t.Fatalf("revoked a session twice: %v %v", revoked, err)
+	}
+
+	if err := repos.Sessions.RevokeByTokenHash(other.UUID, "wrong"); err != nil {
+		t.Fatal(err)
+	}
+	if found, _ := repos.Sessions.FindById(other.UUID); found == nil || found.Revoked {
+		t.Fatalf("revoked by the wrong token: %+v", found)
+	}
+	if err := repos.Sessions.RevokeByTokenHash(other.UUID, "other"); err != nil {
+		t.Fatal(err)
+	}
+	if found, _ := repos.Sessions.FindById(other.UUID); found == nil || !found.Revoked {
+		t.Fatalf("RevokeByTokenHash didn't revoke: %+v", found)
+	}
+
+	kept := createSession(t, repos, alice.UUID, "kept", now)
+	dropped := createSession(t, repos, alice.UUID, "dropped", now)
+	if err := repos.Sessions.RevokeByUser(alice.UUID, kept.UUID); err != nil {
+		t.Fatal(err)
+	}
+	active, err = repos.Sessions.ListActive(alice.UUID)
+	if err != nil || len(active) != 1 || active[0].UUID != kept.UUID {
+		t.Fatalf("RevokeByUser left %+v %v, dropped %s", active, err, dropped.UUID)
+	}
+
+	if err := repos.RevokedTokens.Create(&pkg.RevokedToken{Jti: "jti", UserId: alice.UUID, ExpiresAt: now.Add(time.Hour), CreatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+	if revoked, err := repos.RevokedTokens.IsRevoked("jti"); err != nil || !revoked {
+		t.Fatalf("IsRevoked: %v %v", revoked, err)
+	}
+	if revoked, err := repos.RevokedTokens.IsRevoked("other"); err != nil || revoked {
+		t.Fatalf("IsRevoked of a token never revoked: %v %v", revoked, err)
+	}
+}
+
+func testThrottle(t *testing.T, repos *Repositories) {
+	now := time.Now().UTC().Truncate(time.Second)
+	policy := pkg.ThrottlePolicy{FreeAttempts: 2, BaseDelay: time.Minute, MaxDelay: time.Hour, LockoutAfter: 10, LockoutDuration: time.Hour, Window: time.Hour}
+
+	for i := 0; i < 3; i++ {
+		if until, err := repos.SigninAttempts.Reserve("ip:10.0.0.1", policy, now.Add(time.Duration(i)*time.Second)); err != nil || !until.IsZero() {
+			t.Fatalf("Reserve %d: %v %v", i, until, err)
+		}
+	}
+
+	attempt, err := repos.SigninAttempts.Find("ip:10.0.0.1")
+	if err != nil || attempt == nil {
+		t.Fatalf("Find: %+v %v", attempt, err)
+	}
+	if attempt.Failures != 3 || !attempt.LastFailureAt.Equal(now.Add(2*time.Second)) {
+		t.Fatalf("unexpected attempt %+v", attempt)
+	}
+
+	// the third failure is past the free attempts, the next one has to wait
+	// and isn't counted
+	until, err := repos.SigninAttempts.Reserve("ip:10.0.0.1", policy, now.Add(3*time.Second))
+	if err != nil || !until.Equal(now.Add(2*time.Second+time.Minute)) {
+		t.Fatalf("Reserve while blocked: %v %v", until, err)
+	}
+	if attempt, _ := repos.SigninAttempts.Find("ip:10.0.0.1"); attempt == nil || attempt.Failures != 3 {
+		t.Fatalf("blocked attempt was counted: %+v", attempt)
+	}
+
+	if err := repos.SigninAttempts.Refund("ip:10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if attempt, _ := repos.SigninAttempts.Find("ip:10.0.0.1"); attempt == nil || attempt.Failures != 2 {
+		t.Fatalf("Refund: %+v", attempt)
+	}
+
+	// a failure after the window counts from one again
+	if until, err := repos.SigninAttempts.Reserve("ip:10.0.0.1", policy, now.Add(2*time.Hour)); err != nil || !until.IsZero() {
+		t.Fatalf("Reserve after the window: %v %v", until, err)
+	}
+	if attempt, _ := repos.SigninAttempts.Find("ip:10.0.0.1"); attempt == nil || attempt.Failures != 1 {
+		t.Fatalf("failures outside the window still count: %+v", attempt)
+	}
+
+	if err := repos.SigninAttempts.Delete("ip:10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if attempt, err := repos.SigninAttempts.Find("ip:10.0.0.1"); err != nil || attempt != nil {
+		t.Fatalf("deleted attempt still found: %+v %v", attempt, err)
+	}
+	if err := repos.SigninAttempts.Refund("ip:10.0.0.1"); err != nil {
+		t.Fatalf("Refund of a missing attempt: %v", err)
+	}
+}
+
+func testApiKeys(t *testing.T, repos *Repositories) {
+	alice := createUser(t, repos, "alice", 0)
+	bob := createUser(t, repos, "bob", 0)
+
+	var keys []*pkg.ApiKey
+	for i, prefix := range []string{"first", "second"} {
+		apiKey := &pkg.ApiKey{
+			UserId:    alice.UUID,
+			Name:      prefix,
+			Prefix:    prefix,
+			KeyHash:   "hash-" + prefix,
+			Scopes:    []string{pkg.ScopeImagesWrite, pkg.ScopeImagesDelete},
+			CreatedAt: testTime.Add(time.Duration(i) * time.Minute),
+		}
+		if err := repos.ApiKeys.Create(apiKey); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, apiKey)
+	}
+
+	found, err := repos.ApiKeys.FindByPrefix("first")
+	if err != nil || found == nil {
+		t.Fatalf("FindByPrefix: %+v %v", found, err)
+	}
+	if found.UUID != keys[0].UUID || found.KeyHash != "hash-first" || !slices.Equal(found.Scopes, keys[0].Scopes) {
+		t.Fatalf("unexpected api key %+v", found)
+	}
+
+	if err := repos.ApiKeys.SetLastUsedAt(keys[0].UUID, testTime.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	listed, err := repos.ApiKeys.ListByUser(alice.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 2 || listed[0].UUID != keys[1].UUID || !listed[1].LastUsedAt.Equal(testTime.Add(time.Hour)) {
+		t.Fatalf("ListByUser isn't alice's keys newest first: %+v", listed)
+	}
+
+	if err := repos.ApiKeys.Delete(keys[0].UUID, bob.UUID); err != ErrNotFound {
+		t.Fatalf("deleting someone else's key: want ErrNotFound, got %v", err)
+	}
+	if err := repos.ApiKeys.Delete(keys[0].UUID, alice.UUID); err != nil {
+		t.Fatal(err)
+	}
+	if err := repos.ApiKeys.DeleteByUser(alice.UUID); err != nil {
+		t.Fatal(err)
+	}
+	if listed, err := repos.ApiKeys.ListByUser(alice.UUID); err != nil || len(listed) != 0 {
+		t.Fatalf("keys left after DeleteByUser: %+v %v", listed, err)
+	}
+}
+
+// a credential is only updated for the user it belongs to
+func testCredentials(t *testing.T, repos *Repositories) {
+	alice := createUser(t, repos, "alice", 0)
+	bob := createUser(t, repos, "bob", 0)
+
+	credential := &pkg.Credential{UserId: alice.UUID, CredentialId: "credential", Name: "Passkey", Credential: "{}", LastUsedAt: testTime, CreatedAt: testTime}
+	if err := repos.Credentials.Create(credential); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repos.Credentials.SetCredential(bob.UUID, "credential", `{"bob":true}`, testTime.Add(time.Hour)); err != ErrNotFound {
+		t.Fatalf("SetCredential of another user: want ErrNotFound, got %v", err)
+	}
+	if err := repos.Credentials.SetCredential(alice.UUID, "credential", `{"alice":true}`, testTime.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	listed, err := repos.Credentials.ListByUser(alice.UUID)
+	if err != nil || len(listed) != 1 || listed[0].Credential != `{"alice":true}` || !listed[0].LastUsedAt.Equal(testTime.Add(time.Hour)) {
+		t.Fatalf("ListByUser: %+v %v", listed, err)
+	}
+}
+
+func testIdentities(t *testing.T, repos *Repositories) {
+	alice := createUser(t, repos, "alice", 0)
+	bob := createUser(t, repos, "bob", 0)
+
+	var identities []*pkg.Identity
+	for i, owner := range []*pkg.User{alice, alice, bob} {
+		identity := &pkg.Identity{UserId: owner.UUID, Provider: "google", Subject: "subject-" + strconv.Itoa(i), CreatedAt: testTime.Add(time.Duration(i) * time.Minute)}
+		if err := repos.Identities.Create(identity); err != nil {
+			t.Fatal(err)
+		}
+		identities = append(identities, identity)
+	}
+
+	found, err := repos.Identities.FindBySubject("google", "subject-2")
+	if err != nil || found == nil || found.UserId != bob.UUID {
+		t.Fatalf("FindBySubject: %+v %v", found, err)
+	}
+	if found, err := repos.Identities.FindBySubject("github", "subject-2"); err != nil || found != nil {
+		t.Fatalf("FindBySubject of another provider: %+v %v", found, err)
+	}
+
+	listed, err := repos.Identities.ListByUser(alice.UUID)
+	if err != nil || len(listed) != 2 || listed[0].UUID != identities[1].UUID || listed[1].UUID != identities[0].UUID {
+		t.Fatalf("ListByUser isn't alice's identities newest first: %+v %v", listed, err)
+	}
+}
+
+// challenges, oidc states and passphrase resets can only be used once
+func testSingleUse(t *testing.T, repos *Repositories) {
+	alice := createUser(t, repos, "alice", 0)
+	now := time.Now().UTC().Truncate(time.Second)
+
+	challenge := &pkg.WebAuthnChallenge{Kind: "login", Session: "{}", ExpiresAt: now.Add(time.Minute), CreatedAt: now}
+	if err := repos.WebAuthnChallenges.Create(challenge); err != nil {
+		t.Fatal(err)
+	}
+	taken, err := repos.WebAuthnChallenges.Take(challenge.UUID)
+	if err != nil || taken == nil || taken.Kind != "login" || taken.Session != "{}" {
+		t.Fatalf("Take: %+v %v", taken, err)
+	}
+	if taken, err := repos.WebAuthnChallenges.Take(challenge.UUID); err != nil || taken != nil {
+		t.Fatalf("challenge taken twice: %+v %v", taken, err)
+	}
+
+	// states of a signed in user link an identity, the others don't belong
+	// to anyone yet
+	for _, userId := range []string{"", alice.UUID} {
+		state := &pkg.OidcState{Provider: "google", State: "state-" + userId, Nonce: "nonce", Verifier: "verifier", UserId: userId, ExpiresAt: now.Add(time.Minute), CreatedAt: now}
+		if err := repos.OidcStates.Create(state); err != nil {
+			t.Fatal(err)
+		}
+		if taken, err := repos.OidcStates.Take("github", state.State); err != nil || taken != nil {
+			t.Fatalf("state of another provider taken: %+v %v", taken, err)
+		}
+		taken, err := repos.OidcStates.Take("google", state.State)
+		if err != nil || taken == nil || taken.UserId != userId || taken.Verifier != "verifier" {
+			t.Fatalf("Take: %+v %v", taken, err)
+		}
+		if taken, err := repos.OidcStates.Take("google", state.State); err != nil || taken != nil {
+			t.Fatalf("state taken twice: %+v %v", taken, err)
+		}
+	}
+
+	// using a reset uses up the other resets of the same user as well
+	bob := createUser(t, repos, "bob", 0)
+	var resets []*pkg.PassphraseReset
+	for i, userId := range []string{alice.UUID, alice.UUID, bob.UUID} {
+		reset := &pkg.PassphraseReset{UserId: userId, TokenHash: "reset-" + strconv.Itoa(i), ExpiresAt: now.Add(time.Hour), CreatedAt: now}
+		if err := repos.PassphraseResets.Create(reset); err != nil {
+			t.Fatal(err)
+		}
+		resets = append(resets, reset)
+	}
+	reset := resets[0]
+	found, err := repos.PassphraseResets.FindByTokenHash("reset-0")
+	if err != nil || found == nil || found.UUID != reset.UUID {
+		t.Fatalf("FindByTokenHash: %+v %v", found, err)
+	}
+	if used, err := repos.PassphraseResets.Use(reset.UUID, now.Add(2*time.Hour)); err != nil || used {
+		t.Fatalf("expired reset was used: %v %v", used, err)
+	}
+	if used, err := repos.PassphraseResets.Use(reset.UUID, now); err != nil || !used {
+		t.Fatalf("Use: %v %v", used, err)
+	}
+	if used, err := repos.PassphraseResets.Use(reset.UUID, now); err != nil || used {
+		t.Fatalf("reset was used twice: %v %v", used, err)
+	}
+	if used, err := repos.PassphraseResets.Use(resets[1].UUID, now); err != nil || used {
+		t.Fatalf("other reset of the user was used: %v %v", used, err)
+	}
+	if used, err := repos.PassphraseResets.Use(resets[2].UUID, now); err != nil || !used {
+		t.Fatalf("reset of another user: %v %v", used, err)
+	}
+}
+
+func testExports(t *testing.T, repos *Repositories) {
+	alice := createUser(t, repos, "alice", 0)
+	bob := createUser(t, repos, "bob", 0)
+
+	var exports []*pkg.Export
+	for i, owner := range []*pkg.User{alice, alice, bob} {
+		export := &pkg.Export{UserId: owner.UUID, Status: pkg.ExportStatusPending, CreatedAt: testTime.Add(time.Duration(i) * time.Minute)}
+		if err := repos.Exports.Create(export); err != nil {
+			t.Fatal(err)
+		}
+		exports = append(exports, export)
+	}
+
+	if err := repos.Exports.Finish(exports[0].UUID, pkg.ExportStatusReady, "exports/a.zip", testTime.Add(time.Hour), testTime.Add(25*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	found, err := repos.Exports.FindById(exports[0].UUID)
+	if err != nil || found == nil {
+		t.Fatalf("FindById: %+v %v", found, err)
+	}
+	if found.Status != pkg.ExportStatusReady || found.Key != "exports/a.zip" || !found.ExpiresAt.Equal(testTime.Add(25*time.Hour)) {
+		t.Fatalf("unexpected export %+v", found)
+	}
+
+	pending, err := repos.Exports.ListByStatus(alice.UUID, pkg.ExportStatusPending)
+	if err != nil || len(pending) != 1 || pending[0].UUID != exports[1].UUID {
+		t.Fatalf("ListByStatus of alice: %+v %v", pending, err)
+	}
+	all, err := repos.Exports.ListByStatus("", pkg.ExportStatusPending, pkg.ExportStatusReady)
+	if err != nil || len(all) != 3 {
+		t.Fatalf("ListByStatus of everyone: %+v %v", all, err)
+	}
+
+	if err := repos.Exports.SetStatus(exports[0].UUID, pkg.ExportStatusExpired); err != nil {
+		t.Fatal(err)
+	}
+	if found, _ := repos.Exports.FindById(exports[0].UUID); found == nil || found.Status != pkg.ExportStatusExpired || found.Key != "" {
+		t.Fatalf("SetStatus kept the key: %+v", found)
+	}
+}
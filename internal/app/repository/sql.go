@@ -0,0 +1,1224 @@
+package repository
+
+import (
+	"cloudbuddy/internal/pkg"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	cl "github.com/ostafen/clover/v2"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// opens the sqlite file or postgres server at url and migrates its schema.
+// driver is pkg.DatabaseSqlite or pkg.DatabasePostgres.
+func OpenSql(driver string, url string) (*sql.DB, error) {
+	var name string
+	switch driver {
+	case pkg.DatabaseSqlite:
+		name = "sqlite"
+		url = sqliteDsn(url)
+	case pkg.DatabasePostgres:
+		name = "pgx"
+	default:
+		return nil, fmt.Errorf("unsupported database driver %s", driver)
+	}
+
+	db, err := sql.Open(name, url)
+	if err != nil {
+		return nil, err
+	}
+
+	// sqlite takes one writer at a time, a single connection queues them
+	// instead of failing with SQLITE_BUSY
+	if driver == pkg.DatabaseSqlite {
+		db.SetMaxOpenConns(1)
+	}
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("connecting to %s: %w", driver, err)
+	}
+
+	if err := migrate(db, driver); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating %s: %w", driver, err)
+	}
+
+	return db, nil
+}
+
+// sqlite leaves foreign keys unchecked unless every connection turns them
+// on, the driver does that for the pragmas in the dsn
+func sqliteDsn(url string) string {
+	separator := "?"
+	if strings.Contains(url, "?") {
+		separator = "&"
+	}
+
+	return url + separator + "_pragma=foreign_keys(1)"
+}
+
+// keeps everything in a database opened with OpenSql
+func NewSqlRepositories(db *sql.DB, driver string) *Repositories {
+	return newSqlRepositories(db, driver)
+}
+
+func newSqlRepositories(db sqlConn, driver string) *Repositories {
+	store := sqlStore{db: db, driver: driver}
+
+	return &Repositories{
+		Images:             &sqlImages{store},
+		Users:              &sqlUsers{store},
+		Sessions:           &sqlSessions{store},
+		RevokedTokens:      &sqlRevokedTokens{store},
+		SigninAttempts:     &sqlSigninAttempts{store},
+		ApiKeys:            &sqlApiKeys{store},
+		Credentials:        &sqlCredentials{store},
+		WebAuthnChallenges: &sqlWebAuthnChallenges{store},
+		Identities:         &sqlIdentities{store},
+		OidcStates:         &sqlOidcStates{store},
+		PassphraseResets:   &sqlPassphraseResets{store},
+		EmailVerifications: &sqlEmailVerifications{store},
+		Exports:            &sqlExports{store},
+	}
+}
+
+// a *sql.DB, or the *sql.Tx the clover import runs in
+type sqlConn interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+type sqlStore struct {
+	db     sqlConn
+	driver string
+}
+
+func (s sqlStore) exec(query string, args ...interface{}) (sql.Result, error) {
+	return s.db.Exec(rebind(s.driver, query), args...)
+}
+
+func (s sqlStore) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return s.db.Query(rebind(s.driver, query), args...)
+}
+
+func (s sqlStore) queryRow(query string, args ...interface{}) *sql.Row {
+	return s.db.QueryRow(rebind(s.driver, query), args...)
+}
+
+// runs an update of a single row, ErrNotFound if there is none
+func (s sqlStore) updateOne(query string, args ...interface{}) error {
+	result, err := s.exec(query, args...)
+	if err != nil {
+		return err
+	}
+
+	return expectRow(result)
+}
+
+// runs fn in a transaction, or in the one the store already is in
+func (s sqlStore) inTx(fn func(tx *sql.Tx) error) error {
+	if tx, ok := s.db.(*sql.Tx); ok {
+		return fn(tx)
+	}
+
+	tx, err := s.db.(*sql.DB).Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func expectRow(result sql.Result) error {
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// reports whether err is a unique constraint failing, on either database
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == "23505"
+	}
+
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE || sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY
+	}
+
+	return false
+}
+
+// queries are written with ? placeholders, postgres wants $1, $2, ...
+func rebind(driver string, query string) string {
+	if driver != pkg.DatabasePostgres {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r != '?' {
+			b.WriteRune(r)
+			continue
+		}
+
+		n++
+		b.WriteString("$" + strconv.Itoa(n))
+	}
+
+	return b.String()
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+type sqlImages struct {
+	sqlStore
+}
+
+const imageColumns = `id, title, backend, object_key, likes, user_id, created_at`
+
+func scanImage(row scanner) (*pkg.Image, error) {
+	var image pkg.Image
+	err := row.Scan(&image.UUID, &image.Title, &image.Backend, &image.Key, &image.Likes, &image.UserId, &image.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &image, nil
+}
+
+func (r *sqlImages) FindById(id string) (*pkg.Image, error) {
+	image, err := scanImage(r.queryRow(`SELECT `+imageColumns+` FROM images WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return image, err
+}
+
+func (r *sqlImages) List(offset int, limit int) ([]pkg.Image, error) {
+	return r.list(`SELECT `+imageColumns+` FROM images ORDER BY created_at DESC LIMIT ? OFFSET ?`, limit, offset)
+}
+
+func (r *sqlImages) ListByUser(userId string) ([]pkg.Image, error) {
+	return r.list(`SELECT `+imageColumns+` FROM images WHERE user_id = ? ORDER BY created_at DESC`, userId)
+}
+
+func (r *sqlImages) list(query string, args ...interface{}) ([]pkg.Image, error) {
+	rows, err := r.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	images := []pkg.Image{}
+	for rows.Next() {
+		image, err := scanImage(rows)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, *image)
+	}
+
+	return images, rows.Err()
+}
+
+func (r *sqlImages) Count() (int, error) {
+	var count int
+	err := r.queryRow(`SELECT COUNT(*) FROM images`).Scan(&count)
+	return count, err
+}
+
+func (r *sqlImages) Create(image *pkg.Image) error {
+	if image.UUID == "" {
+		image.UUID = cl.NewObjectId()
+	}
+
+	_, err := r.exec(`INSERT INTO images (`+imageColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		image.UUID, image.Title, image.Backend, image.Key, image.Likes, image.UserId, image.CreatedAt.UTC())
+	return err
+}
+
+func (r *sqlImages) SetKey(id string, key string) error {
+	return r.updateOne(`UPDATE images SET object_key = ? WHERE id = ?`, key, id)
+}
+
+func (r *sqlImages) SetTitle(id string, title string) error {
+	return r.updateOne(`UPDATE images SET title = ? WHERE id = ?`, title, id)
+}
+
+func (r *sqlImages) AddLikes(id string, delta int64) error {
+	return r.updateOne(`UPDATE images SET likes = likes + ? WHERE id = ?`, delta, id)
+}
+
+func (r *sqlImages) Delete(id string) error {
+	_, err := r.exec(`DELETE FROM images WHERE id = ?`, id)
+	return err
+}
+
+type sqlUsers struct {
+	sqlStore
+}
+
+const userColumns = `id, username, username_key, fullname, email, email_verified, role, passphrase, token_version, totp_enabled, totp_secret, totp_pending_secret, totp_last_step, created_at`
+
+func scanUser(row scanner) (*pkg.User, error) {
+	var user pkg.User
+	err := row.Scan(&user.UUID, &user.Username, &user.UsernameKey, &user.Fullname, &user.Email, &user.EmailVerified, &user.Role,
+		&user.Passphrase, &user.TokenVersion, &user.TotpEnabled, &user.TotpSecret, &user.TotpPendingSecret, &user.TotpLastStep, &user.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+func (r *sqlUsers) FindById(id string) (*pkg.User, error) {
+	return r.findOne(`SELECT `+userColumns+` FROM users WHERE id = ?`, id)
+}
+
+func (r *sqlUsers) FindByUsernameKey(key string) (*pkg.User, error) {
+	return r.findOne(`SELECT `+userColumns+` FROM users WHERE username_key = ?`, key)
+}
+
+func (r *sqlUsers) FindByVerifiedEmail(email string) (*pkg.User, error) {
+	return r.findOne(`SELECT `+userColumns+` FROM users WHERE email = ? AND email_verified = ?`, email, true)
+}
+
+func (r *sqlUsers) findOne(query string, args ...interface{}) (*pkg.User, error) {
+	user, err := scanUser(r.queryRow(query, args...))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.loadLists(user); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func (r *sqlUsers) List() ([]pkg.User, error) {
+	rows, err := r.query(`SELECT ` + userColumns + ` FROM users ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []pkg.User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, *user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// sqlite has a single connection, the rows have to be closed before the
+	// lists are loaded
+	rows.Close()
+
+	for i := range users {
+		if err := r.loadLists(&users[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return users, nil
+}
+
+// fills in the recovery codes and images, which live in their own tables
+func (r *sqlUsers) loadLists(user *pkg.User) error {
+	var err error
+
+	user.RecoveryCodes, err = r.column(`SELECT hash FROM recovery_codes WHERE user_id = ? ORDER BY hash`, user.UUID)
+	if err != nil {
+		return err
+	}
+
+	user.Images, err = r.column(`SELECT id FROM images WHERE user_id = ? ORDER BY created_at`, user.UUID)
+	return err
+}
+
+func (s sqlStore) column(query string, args ...interface{}) ([]string, error) {
+	rows, err := s.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	strs := []string{}
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		strs = append(strs, s)
+	}
+
+	return strs, rows.Err()
+}
+
+func (r *sqlUsers) exists(id string) error {
+	var one int
+	err := r.queryRow(`SELECT 1 FROM users WHERE id = ?`, id).Scan(&one)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+
+	return err
+}
+
+func (r *sqlUsers) Create(user *pkg.User) error {
+	if user.UUID == "" {
+		user.UUID = cl.NewObjectId()
+	}
+
+	err := r.inTx(func(tx *sql.Tx) error {
+		_, err := tx.Exec(rebind(r.driver, `INSERT INTO users (`+userColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+			user.UUID, user.Username, user.UsernameKey, user.Fullname, user.Email, user.EmailVerified, user.Role,
+			user.Passphrase, user.TokenVersion, user.TotpEnabled, user.TotpSecret, user.TotpPendingSecret, user.TotpLastStep, user.CreatedAt.UTC())
+		if err != nil {
+			return err
+		}
+
+		return r.insertRecoveryCodes(tx, user.UUID, user.RecoveryCodes)
+	})
+	// both databases name the violated constraint after the column
+	if isUniqueViolation(err) && strings.Contains(err.Error(), "username_key") {
+		return ErrUsernameTaken
+	}
+
+	return err
+}
+
+func (r *sqlUsers) insertRecoveryCodes(tx *sql.Tx, id string, hashes []string) error {
+	for _, hash := range hashes {
+		_, err := tx.Exec(rebind(r.driver, `INSERT INTO recovery_codes (user_id, hash) VALUES (?, ?)`), id, hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *sqlUsers) SetRole(id string, role string) error {
+	return r.updateOne(`UPDATE users SET role = ? WHERE id = ?`, role, id)
+}
+
+func (r *sqlUsers) SetPassphrase(id string, hash string) error {
+	return r.updateOne(`UPDATE users SET passphrase = ? WHERE id = ?`, hash, id)
+}
+
+func (r *sqlUsers) ChangePassphrase(id string, hash string) (int64, error) {
+	return r.bumpTokenVersion(`UPDATE users SET passphrase = ?, token_version = token_version + 1 WHERE id = ? RETURNING token_version`, hash, id)
+}
+
+func (r *sqlUsers) RevokeTokens(id string) (int64, error) {
+	return r.bumpTokenVersion(`UPDATE users SET token_version = token_version + 1 WHERE id = ? RETURNING token_version`, id)
+}
+
+func (r *sqlUsers) bumpTokenVersion(query string, args ...interface{}) (int64, error) {
+	var version int64
+	err := r.queryRow(query, args...).Scan(&version)
+	if err == sql.ErrNoRows {
+		return 0, ErrNotFound
+	}
+
+	return version, err
+}
+
+func (r *sqlUsers) SetEmail(id string, email string) error {
+	return r.updateOne(`UPDATE users SET email = ?, email_verified = ? WHERE id = ?`, email, false, id)
+}
+
+// users_verified_email settles two users verifying the same address at once
+func (r *sqlUsers) VerifyEmail(id string, email string) (bool, error) {
+	err := r.inTx(func(tx *sql.Tx) error {
+		result, err := tx.Exec(rebind(r.driver, `UPDATE users SET email_verified = ? WHERE id = ? AND email = ?
+			AND NOT EXISTS (SELECT 1 FROM users WHERE email = ? AND email_verified = ? AND id <> ?)`), true, id, email, email, true, id)
+		if err != nil {
+			return err
+		}
+		if err := expectRow(result); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(rebind(r.driver, `UPDATE users SET email = '' WHERE email = ? AND id <> ?`), email, id)
+		return err
+	})
+	if err == ErrNotFound {
+		return false, r.exists(id)
+	}
+	if isUniqueViolation(err) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+func (r *sqlUsers) SetTotpPendingSecret(id string, secret string) error {
+	return r.updateOne(`UPDATE users SET totp_pending_secret = ? WHERE id = ?`, secret, id)
+}
+
+func (r *sqlUsers) EnableTotp(id string, secret string, recoveryCodes []string, step int64) error {
+	return r.replaceTotp(id, recoveryCodes, `UPDATE users SET totp_enabled = ?, totp_secret = ?, totp_pending_secret = '', totp_last_step = ? WHERE id = ?`, true, secret, step, id)
+}
+
+func (r *sqlUsers) DisableTotp(id string) error {
+	return r.replaceTotp(id, nil, `UPDATE users SET totp_enabled = ?, totp_secret = '', totp_pending_secret = '' WHERE id = ?`, false, id)
+}
+
+// runs the update of the totp state and replaces the recovery codes together
+func (r *sqlUsers) replaceTotp(id string, recoveryCodes []string, query string, args ...interface{}) error {
+	return r.inTx(func(tx *sql.Tx) error {
+		result, err := tx.Exec(rebind(r.driver, query), args...)
+		if err != nil {
+			return err
+		}
+		if err := expectRow(result); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(rebind(r.driver, `DELETE FROM recovery_codes WHERE user_id = ?`), id)
+		if err != nil {
+			return err
+		}
+
+		return r.insertRecoveryCodes(tx, id, recoveryCodes)
+	})
+}
+
+// the condition makes the step single-use, of two concurrent signins with
+// the same code only one updates the row
+func (r *sqlUsers) UseTotpStep(id string, step int64) (bool, error) {
+	err := r.updateOne(`UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?`, step, id, step)
+	if err == ErrNotFound {
+		return false, r.exists(id)
+	}
+
+	return err == nil, err
+}
+
+// deleting the row is what makes a code single-use, of two concurrent
+// signins with the same code only one deletes it
+func (r *sqlUsers) UseRecoveryCode(id string, hash string) (bool, error) {
+	err := r.updateOne(`DELETE FROM recovery_codes WHERE user_id = ? AND hash = ?`, id, hash)
+	if err == ErrNotFound {
+		return false, r.exists(id)
+	}
+
+	return err == nil, err
+}
+
+// images belong to their user through images.user_id, there is nothing else
+// to keep up to date
+func (r *sqlUsers) AddImage(id string, imageId string) error {
+	return r.exists(id)
+}
+
+func (r *sqlUsers) RemoveImage(id string, imageId string) error {
+	return r.exists(id)
+}
+
+// reads every row of the query with scan. the rows are closed before it
+// returns, sqlite's single connection is free for the next query then.
+func queryAll[T any](s sqlStore, scan func(row scanner) (*T, error), query string, args ...interface{}) ([]T, error) {
+	rows, err := s.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := []T{}
+	for rows.Next() {
+		value, err := scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, *value)
+	}
+
+	return values, rows.Err()
+}
+
+// reads the row of the query with scan, nil if there is none
+func queryOne[T any](s sqlStore, scan func(row scanner) (*T, error), query string, args ...interface{}) (*T, error) {
+	value, err := scan(s.queryRow(query, args...))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return value, err
+}
+
+// records which only matter until they expire are deleted whenever new ones
+// are stored
+func (s sqlStore) deleteExpired(table string) error {
+	_, err := s.exec(`DELETE FROM `+table+` WHERE expires_at < ?`, time.Now().UTC())
+	return err
+}
+
+// the row is locked for the rest of the transaction on postgres, sqlite's
+// transactions hold the only connection anyway
+func (s sqlStore) forUpdate() string {
+	if s.driver == pkg.DatabasePostgres {
+		return ` FOR UPDATE`
+	}
+
+	return ``
+}
+
+// a column which is NULL rather than empty
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+type sqlSessions struct {
+	sqlStore
+}
+
+const sessionColumns = `id, user_id, token_hash, revoked, user_agent, ip, expires_at, last_used_at, created_at`
+
+func scanSession(row scanner) (*pkg.Session, error) {
+	var session pkg.Session
+	err := row.Scan(&session.UUID, &session.UserId, &session.TokenHash, &session.Revoked, &session.UserAgent, &session.IP,
+		&session.ExpiresAt, &session.LastUsedAt, &session.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+func (r *sqlSessions) FindById(id string) (*pkg.Session, error) {
+	session, err := queryOne(r.sqlStore, scanSession, `SELECT `+sessionColumns+` FROM sessions WHERE id = ?`, id)
+	if err != nil || session == nil {
+		return nil, err
+	}
+
+	session.UsedHashes, err = r.usedHashes(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+func (r *sqlSessions) ListActive(userId string) ([]pkg.Session, error) {
+	sessions, err := queryAll(r.sqlStore, scanSession, `SELECT `+sessionColumns+` FROM sessions
+		WHERE user_id = ? AND revoked = ? AND expires_at > ? ORDER BY last_used_at DESC`, userId, false, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+
+	return r.withUsedHashes(sessions)
+}
+
+func (r *sqlSessions) ListByUser(userId string) ([]pkg.Session, error) {
+	sessions, err := queryAll(r.sqlStore, scanSession, `SELECT `+sessionColumns+` FROM sessions WHERE user_id = ? ORDER BY created_at DESC`, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.withUsedHashes(sessions)
+}
+
+func (r *sqlSessions) withUsedHashes(sessions []pkg.Session) ([]pkg.Session, error) {
+	var err error
+	for i := range sessions {
+		sessions[i].UsedHashes, err = r.usedHashes(sessions[i].UUID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return sessions, nil
+}
+
+func (r *sqlSessions) usedHashes(id string) ([]string, error) {
+	return r.column(`SELECT hash FROM session_used_hashes WHERE session_id = ? ORDER BY position`, id)
+}
+
+func (r *sqlSessions) Create(session *pkg.Session) error {
+	if session.UUID == "" {
+		session.UUID = cl.NewObjectId()
+	}
+
+	return r.inTx(func(tx *sql.Tx) error {
+		_, err := tx.Exec(rebind(r.driver, `INSERT INTO sessions (`+sessionColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+			session.UUID, session.UserId, session.TokenHash, session.Revoked, session.UserAgent, session.IP,
+			session.ExpiresAt.UTC(), session.LastUsedAt.UTC(), session.CreatedAt.UTC())
+		if err != nil {
+			return err
+		}
+
+		return r.insertUsedHashes(tx, session.UUID, session.UsedHashes)
+	})
+}
+
+func (r *sqlSessions) insertUsedHashes(tx *sql.Tx, id string, hashes []string) error {
+	for i, hash := range hashes {
+		_, err := tx.Exec(rebind(r.driver, `INSERT INTO session_used_hashes (session_id, position, hash) VALUES (?, ?, ?)`), id, i, hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *sqlSessions) SetTokenHash(id string, hash string) error {
+	return r.updateOne(`UPDATE sessions SET token_hash = ? WHERE id = ?`, hash, id)
+}
+
+// the session row stays locked from reading it until the rotation is stored,
+// a concurrent refresh with the same token waits and then finds it used
+func (r *sqlSessions) Rotate(id string, hash string, newHash string, userAgent string, ip string) (string, Rotation, error) {
+	var userId string
+	rotation := RotationRejected
+
+	err := r.inTx(func(tx *sql.Tx) error {
+		store := sqlStore{db: tx, driver: r.driver}
+
+		session, err := queryOne(store, scanSession, `SELECT `+sessionColumns+` FROM sessions WHERE id = ?`+store.forUpdate(), id)
+		if err != nil || session == nil {
+			return err
+		}
+
+		session.UsedHashes, err = store.column(`SELECT hash FROM session_used_hashes WHERE session_id = ? ORDER BY position`, id)
+		if err != nil {
+			return err
+		}
+
+		userId = session.UserId
+		rotation = rotate(session, hash, newHash, userAgent, ip, time.Now())
+		if rotation == RotationRejected {
+			return nil
+		}
+
+		_, err = store.exec(`UPDATE sessions SET token_hash = ?, revoked = ?, user_agent = ?, ip = ?, expires_at = ?, last_used_at = ? WHERE id = ?`,
+			session.TokenHash, session.Revoked, session.UserAgent, session.IP, session.ExpiresAt.UTC(), session.LastUsedAt.UTC(), id)
+		if err != nil {
+			return err
+		}
+
+		_, err = store.exec(`DELETE FROM session_used_hashes WHERE session_id = ?`, id)
+		if err != nil {
+			return err
+		}
+
+		return r.insertUsedHashes(tx, id, session.UsedHashes)
+	})
+	if err != nil {
+		return "", RotationRejected, err
+	}
+
+	return userId, rotation, nil
+}
+
+func (r *sqlSessions) Revoke(id string, userId string) (bool, error) {
+	err := r.updateOne(`UPDATE sessions SET revoked = ? WHERE id = ? AND user_id = ? AND revoked = ?`, true, id, userId, false)
+	if err == ErrNotFound {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+func (r *sqlSessions) RevokeByTokenHash(id string, hash string) error {
+	_, err := r.exec(`UPDATE sessions SET revoked = ? WHERE id = ? AND token_hash = ?`, true, id, hash)
+	return err
+}
+
+func (r *sqlSessions) RevokeByUser(userId string, exceptId string) error {
+	_, err := r.exec(`UPDATE sessions SET revoked = ? WHERE user_id = ? AND id <> ?`, true, userId, exceptId)
+	return err
+}
+
+type sqlRevokedTokens struct {
+	sqlStore
+}
+
+func (r *sqlRevokedTokens) Create(token *pkg.RevokedToken) error {
+	if err := r.deleteExpired("revoked_tokens"); err != nil {
+		return err
+	}
+
+	_, err := r.exec(`INSERT INTO revoked_tokens (jti, user_id, expires_at, created_at) VALUES (?, ?, ?, ?)`,
+		token.Jti, token.UserId, token.ExpiresAt.UTC(), token.CreatedAt.UTC())
+	return err
+}
+
+func (r *sqlRevokedTokens) IsRevoked(jti string) (bool, error) {
+	var one int
+	err := r.queryRow(`SELECT 1 FROM revoked_tokens WHERE jti = ?`, jti).Scan(&one)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+type sqlSigninAttempts struct {
+	sqlStore
+}
+
+func scanSigninAttempt(row scanner) (*pkg.SigninAttempt, error) {
+	var attempt pkg.SigninAttempt
+	if err := row.Scan(&attempt.Key, &attempt.Failures, &attempt.LastFailureAt); err != nil {
+		return nil, err
+	}
+
+	return &attempt, nil
+}
+
+func (r *sqlSigninAttempts) Find(key string) (*pkg.SigninAttempt, error) {
+	return queryOne(r.sqlStore, scanSigninAttempt, `SELECT throttle_key, failures, last_failure_at FROM signin_attempts WHERE throttle_key = ?`, key)
+}
+
+// the row is created empty first and stays locked from reading it until the
+// attempt is counted, a concurrent attempt waits and then sees this one
+func (r *sqlSigninAttempts) Reserve(key string, policy pkg.ThrottlePolicy, now time.Time) (time.Time, error) {
+	if err := r.deleteExpired("signin_attempts"); err != nil {
+		return time.Time{}, err
+	}
+
+	var until time.Time
+	err := r.inTx(func(tx *sql.Tx) error {
+		store := sqlStore{db: tx, driver: r.driver}
+
+		_, err := store.exec(`INSERT INTO signin_attempts (throttle_key, failures, last_failure_at, expires_at) VALUES (?, 0, ?, ?)
+			ON CONFLICT (throttle_key) DO NOTHING`, key, now.UTC(), now.Add(policy.Window).UTC())
+		if err != nil {
+			return err
+		}
+
+		attempt, err := queryOne(store, scanSigninAttempt, `SELECT throttle_key, failures, last_failure_at FROM signin_attempts
+			WHERE throttle_key = ?`+store.forUpdate(), key)
+		if err != nil {
+			return err
+		}
+
+		if until = reserve(attempt, policy, now); !until.IsZero() {
+			return nil
+		}
+
+		_, err = store.exec(`UPDATE signin_attempts SET failures = ?, last_failure_at = ?, expires_at = ? WHERE throttle_key = ?`,
+			attempt.Failures, attempt.LastFailureAt.UTC(), now.Add(policy.Window).UTC(), key)
+		return err
+	})
+
+	return until, err
+}
+
+func (r *sqlSigninAttempts) Refund(key string) error {
+	_, err := r.exec(`UPDATE signin_attempts SET failures = failures - 1 WHERE throttle_key = ? AND failures > 0`, key)
+	return err
+}
+
+func (r *sqlSigninAttempts) Delete(key string) error {
+	_, err := r.exec(`DELETE FROM signin_attempts WHERE throttle_key = ?`, key)
+	return err
+}
+
+type sqlApiKeys struct {
+	sqlStore
+}
+
+const apiKeyColumns = `id, user_id, name, prefix, key_hash, last_used_at, created_at`
+
+func scanApiKey(row scanner) (*pkg.ApiKey, error) {
+	var apiKey pkg.ApiKey
+	err := row.Scan(&apiKey.UUID, &apiKey.UserId, &apiKey.Name, &apiKey.Prefix, &apiKey.KeyHash, &apiKey.LastUsedAt, &apiKey.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &apiKey, nil
+}
+
+func (r *sqlApiKeys) FindByPrefix(prefix string) (*pkg.ApiKey, error) {
+	apiKey, err := queryOne(r.sqlStore, scanApiKey, `SELECT `+apiKeyColumns+` FROM api_keys WHERE prefix = ?`, prefix)
+	if err != nil || apiKey == nil {
+		return nil, err
+	}
+
+	apiKey.Scopes, err = r.scopes(apiKey.UUID)
+	if err != nil {
+		return nil, err
+	}
+
+	return apiKey, nil
+}
+
+func (r *sqlApiKeys) ListByUser(userId string) ([]pkg.ApiKey, error) {
+	apiKeys, err := queryAll(r.sqlStore, scanApiKey, `SELECT `+apiKeyColumns+` FROM api_keys WHERE user_id = ? ORDER BY created_at DESC`, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range apiKeys {
+		apiKeys[i].Scopes, err = r.scopes(apiKeys[i].UUID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return apiKeys, nil
+}
+
+func (r *sqlApiKeys) scopes(id string) ([]string, error) {
+	return r.column(`SELECT scope FROM api_key_scopes WHERE api_key_id = ? ORDER BY position`, id)
+}
+
+func (r *sqlApiKeys) Create(apiKey *pkg.ApiKey) error {
+	if apiKey.UUID == "" {
+		apiKey.UUID = cl.NewObjectId()
+	}
+
+	return r.inTx(func(tx *sql.Tx) error {
+		_, err := tx.Exec(rebind(r.driver, `INSERT INTO api_keys (`+apiKeyColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?)`),
+			apiKey.UUID, apiKey.UserId, apiKey.Name, apiKey.Prefix, apiKey.KeyHash, apiKey.LastUsedAt.UTC(), apiKey.CreatedAt.UTC())
+		if err != nil {
+			return err
+		}
+
+		for i, scope := range apiKey.Scopes {
+			_, err := tx.Exec(rebind(r.driver, `INSERT INTO api_key_scopes (api_key_id, position, scope) VALUES (?, ?, ?)`), apiKey.UUID, i, scope)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (r *sqlApiKeys) SetLastUsedAt(id string, at time.Time) error {
+	return r.updateOne(`UPDATE api_keys SET last_used_at = ? WHERE id = ?`, at.UTC(), id)
+}
+
+// the scopes go with the key, api_key_scopes cascades
+func (r *sqlApiKeys) Delete(id string, userId string) error {
+	return r.updateOne(`DELETE FROM api_keys WHERE id = ? AND user_id = ?`, id, userId)
+}
+
+func (r *sqlApiKeys) DeleteByUser(userId string) error {
+	_, err := r.exec(`DELETE FROM api_keys WHERE user_id = ?`, userId)
+	return err
+}
+
+type sqlCredentials struct {
+	sqlStore
+}
+
+const credentialColumns = `id, user_id, credential_id, name, credential, last_used_at, created_at`
+
+func scanCredential(row scanner) (*pkg.Credential, error) {
+	var credential pkg.Credential
+	err := row.Scan(&credential.UUID, &credential.UserId, &credential.CredentialId, &credential.Name, &credential.Credential,
+		&credential.LastUsedAt, &credential.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &credential, nil
+}
+
+func (r *sqlCredentials) ListByUser(userId string) ([]pkg.Credential, error) {
+	return queryAll(r.sqlStore, scanCredential, `SELECT `+credentialColumns+` FROM credentials WHERE user_id = ? ORDER BY created_at DESC`, userId)
+}
+
+func (r *sqlCredentials) Create(credential *pkg.Credential) error {
+	if credential.UUID == "" {
+		credential.UUID = cl.NewObjectId()
+	}
+
+	_, err := r.exec(`INSERT INTO credentials (`+credentialColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		credential.UUID, credential.UserId, credential.CredentialId, credential.Name, credential.Credential,
+		credential.LastUsedAt.UTC(), credential.CreatedAt.UTC())
+	return err
+}
+
+func (r *sqlCredentials) SetCredential(userId string, credentialId string, credential string, usedAt time.Time) error {
+	return r.updateOne(`UPDATE credentials SET credential = ?, last_used_at = ? WHERE credential_id = ? AND user_id = ?`,
+		credential, usedAt.UTC(), credentialId, userId)
+}
+
+func (r *sqlCredentials) Delete(id string, userId string) error {
+	return r.updateOne(`DELETE FROM credentials WHERE id = ? AND user_id = ?`, id, userId)
+}
+
+type sqlWebAuthnChallenges struct {
+	sqlStore
+}
+
+const webAuthnChallengeColumns = `id, kind, session, expires_at, created_at`
+
+func scanWebAuthnChallenge(row scanner) (*pkg.WebAuthnChallenge, error) {
+	var challenge pkg.WebAuthnChallenge
+	err := row.Scan(&challenge.UUID, &challenge.Kind, &challenge.Session, &challenge.ExpiresAt, &challenge.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &challenge, nil
+}
+
+func (r *sqlWebAuthnChallenges) Create(challenge *pkg.WebAuthnChallenge) error {
+	if challenge.UUID == "" {
+		challenge.UUID = cl.NewObjectId()
+	}
+
+	if err := r.deleteExpired("webauthn_challenges"); err != nil {
+		return err
+	}
+
+	_, err := r.exec(`INSERT INTO webauthn_challenges (`+webAuthnChallengeColumns+`) VALUES (?, ?, ?, ?, ?)`,
+		challenge.UUID, challenge.Kind, challenge.Session, challenge.ExpiresAt.UTC(), challenge.CreatedAt.UTC())
+	return err
+}
+
+// only one of two concurrent deletes returns the row
+func (r *sqlWebAuthnChallenges) Take(id string) (*pkg.WebAuthnChallenge, error) {
+	return queryOne(r.sqlStore, scanWebAuthnChallenge, `DELETE FROM webauthn_challenges WHERE id = ? RETURNING `+webAuthnChallengeColumns, id)
+}
+
+type sqlIdentities struct {
+	sqlStore
+}
+
+const identityColumns = `id, user_id, provider, subject, email, created_at`
+
+func scanIdentity(row scanner) (*pkg.Identity, error) {
+	var identity pkg.Identity
+	err := row.Scan(&identity.UUID, &identity.UserId, &identity.Provider, &identity.Subject, &identity.Email, &identity.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &identity, nil
+}
+
+func (r *sqlIdentities) FindBySubject(provider string, subject string) (*pkg.Identity, error) {
+	return queryOne(r.sqlStore, scanIdentity, `SELECT `+identityColumns+` FROM identities WHERE provider = ? AND subject = ?`, provider, subject)
+}
+
+func (r *sqlIdentities) ListByUser(userId string) ([]pkg.Identity, error) {
+	return queryAll(r.sqlStore, scanIdentity, `SELECT `+identityColumns+` FROM identities WHERE user_id = ? ORDER BY created_at DESC`, userId)
+}
+
+func (r *sqlIdentities) Create(identity *pkg.Identity) error {
+	if identity.UUID == "" {
+		identity.UUID = cl.NewObjectId()
+	}
+
+	_, err := r.exec(`INSERT INTO identities (`+identityColumns+`) VALUES (?, ?, ?, ?, ?, ?)`,
+		identity.UUID, identity.UserId, identity.Provider, identity.Subject, identity.Email, identity.CreatedAt.UTC())
+	return err
+}
+
+type sqlOidcStates struct {
+	sqlStore
+}
+
+const oidcStateColumns = `id, provider, state, nonce, verifier, user_id, expires_at, created_at`
+
+// user_id is NULL for logins which don't link an identity
+func scanOidcState(row scanner) (*pkg.OidcState, error) {
+	var state pkg.OidcState
+	var userId sql.NullString
+	err := row.Scan(&state.UUID, &state.Provider, &state.State, &state.Nonce, &state.Verifier, &userId, &state.ExpiresAt, &state.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	state.UserId = userId.String
+	return &state, nil
+}
+
+func (r *sqlOidcStates) Create(state *pkg.OidcState) error {
+	if state.UUID == "" {
+		state.UUID = cl.NewObjectId()
+	}
+
+	if err := r.deleteExpired("oidc_states"); err != nil {
+		return err
+	}
+
+	_, err := r.exec(`INSERT INTO oidc_states (`+oidcStateColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		state.UUID, state.Provider, state.State, state.Nonce, state.Verifier, nullString(state.UserId), state.ExpiresAt.UTC(), state.CreatedAt.UTC())
+	return err
+}
+
+// only one of two concurrent deletes returns the row
+func (r *sqlOidcStates) Take(provider string, state string) (*pkg.OidcState, error) {
+	return queryOne(r.sqlStore, scanOidcState, `DELETE FROM oidc_states WHERE provider = ? AND state = ? RETURNING `+oidcStateColumns, provider, state)
+}
+
+type sqlPassphraseResets struct {
+	sqlStore
+}
+
+const passphraseResetColumns = `id, user_id, token_hash, used, expires_at, created_at`
+
+func scanPassphraseReset(row scanner) (*pkg.PassphraseReset, error) {
+	var reset pkg.PassphraseReset
+	err := row.Scan(&reset.UUID, &reset.UserId, &reset.TokenHash, &reset.Used, &reset.ExpiresAt, &reset.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &reset, nil
+}
+
+func (r *sqlPassphraseResets) FindByTokenHash(hash string) (*pkg.PassphraseReset, error) {
+	return queryOne(r.sqlStore, scanPassphraseReset, `SELECT `+passphraseResetColumns+` FROM passphrase_resets WHERE token_hash = ?`, hash)
+}
+
+func (r *sqlPassphraseResets) Create(reset *pkg.PassphraseReset) error {
+	if reset.UUID == "" {
+		reset.UUID = cl.NewObjectId()
+	}
+
+	_, err := r.exec(`INSERT INTO passphrase_resets (`+passphraseResetColumns+`) VALUES (?, ?, ?, ?, ?, ?)`,
+		reset.UUID, reset.UserId, reset.TokenHash, reset.Used, reset.ExpiresAt.UTC(), reset.CreatedAt.UTC())
+	return err
+}
+
+// the condition makes the token single-use, of two concurrent resets only
+// one updates the row
+// a single statement, the reset is among the rows it changes
+func (r *sqlPassphraseResets) Use(id string, now time.Time) (bool, error) {
+	err := r.updateOne(`UPDATE passphrase_resets SET used = ? WHERE used = ? AND user_id = (
+		SELECT user_id FROM passphrase_resets WHERE id = ? AND used = ? AND expires_at >= ?)`, true, false, id, false, now.UTC())
+	if err == ErrNotFound {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+type sqlEmailVerifications struct {
+	sqlStore
+}
+
+const emailVerificationColumns = `id, user_id, email, token_hash, used, expires_at, created_at`
+
+func scanEmailVerification(row scanner) (*pkg.EmailVerification, error) {
+	var verification pkg.EmailVerification
+	err := row.Scan(&verification.UUID, &verification.UserId, &verification.Email, &verification.TokenHash, &verification.Used,
+		&verification.ExpiresAt, &verification.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &verification, nil
+}
+
+func (r *sqlEmailVerifications) FindByTokenHash(hash string) (*pkg.EmailVerification, error) {
+	return queryOne(r.sqlStore, scanEmailVerification, `SELECT `+emailVerificationColumns+` FROM email_verifications WHERE token_hash = ?`, hash)
+}
+
+func (r *sqlEmailVerifications) Create(verification *pkg.EmailVerification) error {
+	if verification.UUID == "" {
+		verification.UUID = cl.NewObjectId()
+	}
+
+	_, err := r.exec(`INSERT INTO email_verifications (`+emailVerificationColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		verification.UUID, verification.UserId, verification.Email, verification.TokenHash, verification.Used,
+		verification.ExpiresAt.UTC(), verification.CreatedAt.UTC())
+	return err
+}
+
+func (r *sqlEmailVerifications) SetUsed(id string) error {
+	return r.updateOne(`UPDATE email_verifications SET used = ? WHERE id = ?`, true, id)
+}
+
+type sqlExports struct {
+	sqlStore
+}
+
+const exportColumns = `id, user_id, status, object_key, created_at, completed_at, expires_at`
+
+func scanExport(row scanner) (*pkg.Export, error) {
+	var export pkg.Export
+	err := row.Scan(&export.UUID, &export.UserId, &export.Status, &export.Key, &export.CreatedAt, &export.CompletedAt, &export.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &export, nil
+}
+
+func (r *sqlExports) FindById(id string) (*pkg.Export, error) {
+	return queryOne(r.sqlStore, scanExport, `SELECT `+exportColumns+` FROM exports WHERE id = ?`, id)
+}
+
+func (r *sqlExports) ListByStatus(userId string, statuses ...string) ([]pkg.Export, error) {
+	if len(statuses) == 0 {
+		return []pkg.Export{}, nil
+	}
+
+	query := `SELECT ` + exportColumns + ` FROM exports WHERE status IN (?` + strings.Repeat(`, ?`, len(statuses)-1) + `)`
+	args := make([]interface{}, 0, len(statuses)+1)
+	for _, status := range statuses {
+		args = append(args, status)
+	}
+	if userId != "" {
+		query += ` AND user_id = ?`
+		args = append(args, userId)
+	}
+
+	return queryAll(r.sqlStore, scanExport, query+` ORDER BY created_at DESC`, args...)
+}
+
+func (r *sqlExports) Create(export *pkg.Export) error {
+	if export.UUID == "" {
+		export.UUID = cl.NewObjectId()
+	}
+
+	_, err := r.exec(`INSERT INTO exports (`+exportColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		export.UUID, export.UserId, export.Status, export.Key, export.CreatedAt.UTC(), export.CompletedAt.UTC(), export.ExpiresAt.UTC())
+	return err
+}
+
+func (r *sqlExports) Finish(id string, status string, key string, completedAt time.Time, expiresAt time.Time) error {
+	return r.updateOne(`UPDATE exports SET status = ?, object_key = ?, completed_at = ?, expires_at = ? WHERE id = ?`,
+		status, key, completedAt.UTC(), expiresAt.UTC(), id)
+}
+
+func (r *sqlExports) SetStatus(id string, status string) error {
+	return r.updateOne(`UPDATE exports SET status = ?, object_key = '' WHERE id = ?`, status, id)
+}
@@ -0,0 +1,142 @@
+package routes
+
+import (
+	"cloudbuddy/internal/app/apierror"
+	"cloudbuddy/internal/app/repository"
+	"cloudbuddy/internal/pkg"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// promotes the users listed in ADMIN_USERNAMES to admins, so a fresh
+// deployment has someone to hand out roles. once there is an admin the list
+// is ignored, roles are handed out through the api from then on.
+func BootstrapAdmins(repos *repository.Repositories, cfg *pkg.Config) {
+	if len(cfg.AdminUsernames) == 0 {
+		return
+	}
+
+	users, err := repos.Users.List()
+	if err != nil {
+		log.Printf("Looking up admins failed: %v", err)
+		return
+	}
+
+	for i := range users {
+		if pkg.RoleOf(&users[i]) == pkg.RoleAdmin {
+			log.Printf("An admin exists already, not promoting %s", strings.Join(cfg.AdminUsernames, ", "))
+			return
+		}
+	}
+
+	for _, username := range cfg.AdminUsernames {
+		user, err := repos.Users.FindByUsernameKey(pkg.UsernameKey(username))
+		if err == nil && user != nil {
+			err = repos.Users.SetRole(user.UUID, pkg.RoleAdmin)
+		}
+		if err != nil {
+			log.Printf("Promoting %s to admin failed: %v", username, err)
+		}
+	}
+}
+
+// lists all users, newest first
+func GetUsers(repos *repository.Repositories) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		users, err := repos.Users.List()
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"users": users,
+		})
+	}
+}
+
+// assigns a role to a user. admins can't change their own role so there is
+// always at least one admin left.
+func ChangeUserRole(repos *repository.Repositories) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+
+		var body struct {
+			Role string `form:"role" json:"role" binding:"required"`
+		}
+
+		if !bindRequest(c, &body) {
+			return
+		}
+
+		if !pkg.ValidRole(body.Role) {
+			validationFailed(c, fieldError{Field: "role", Code: codeOneOf})
+			return
+		}
+
+		user, exists := c.Get("user")
+
+		if !exists {
+			apierror.Abort(c, apierror.ErrUnauthorized)
+			return
+		}
+
+		if user.(*pkg.User).UUID == id {
+			apierror.Abort(c, apierror.ErrConflict.WithDetail("you can't change your own role"))
+			return
+		}
+
+		err := repos.Users.SetRole(id, body.Role)
+
+		if err != nil {
+			if err == repository.ErrNotFound {
+				apierror.Abort(c, apierror.ErrUserNotFound)
+			} else {
+				apierror.Abort(c, apierror.Internal(err))
+			}
+
+			return
+		}
+
+		c.JSON(http.StatusNoContent, nil)
+	}
+}
+
+// signs a user out everywhere by revoking their sessions and tokens. their
+// api keys are deleted too, a key would otherwise outlive the revocation.
+func RevokeUserSessions(repos *repository.Repositories) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+
+		_, err := repos.Users.RevokeTokens(id)
+
+		if err != nil {
+			if err == repository.ErrNotFound {
+				apierror.Abort(c, apierror.ErrUserNotFound)
+			} else {
+				apierror.Abort(c, apierror.Internal(err))
+			}
+
+			return
+		}
+
+		err = repos.Sessions.RevokeByUser(id, "")
+
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		err = repos.ApiKeys.DeleteByUser(id)
+
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		c.JSON(http.StatusNoContent, nil)
+	}
+}
@@ -0,0 +1,87 @@
+package routes
+
+import (
+	"cloudbuddy/internal/app/middleware"
+	"cloudbuddy/internal/pkg"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRevokeUserSessionsRevokesApiKeys(t *testing.T) {
+	repos, cfg := newTestDeps(t)
+
+	admin := &pkg.User{Username: "root", UsernameKey: "root", Role: pkg.RoleAdmin, CreatedAt: time.Now()}
+	user := &pkg.User{Username: "alice", UsernameKey: "alice", Role: pkg.RoleUser, CreatedAt: time.Now()}
+	for _, u := range []*pkg.User{admin, user} {
+		if err := repos.Users.Create(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	router := newTestRouter()
+	router.POST("/me/api-keys", asUser(user), CreateApiKey(repos))
+	router.DELETE("/admin/users/:id/sessions", asUser(admin), RevokeUserSessions(repos))
+	router.PUT("/images/:id/changeTitle", middleware.ApiKeyMiddleware(repos, cfg, newTestKeyRing(t), pkg.ScopeImagesWrite), func(c *gin.Context) {
+		c.Status(http.StatusNoContent)
+	})
+
+	rec := doJson(t, router, http.MethodPost, "/me/api-keys", map[string]any{"name": "ci", "scopes": []string{pkg.ScopeImagesWrite}})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("creating api key: %d %s", rec.Code, rec.Body)
+	}
+	var created struct {
+		Key string `json:"key"`
+	}
+	decodeJson(t, rec, &created)
+
+	useKey := func() int {
+		req := httptest.NewRequest(http.MethodPut, "/images/some-image/changeTitle", nil)
+		req.Header.Set("Authorization", "ApiKey "+created.Key)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := useKey(); code != http.StatusNoContent {
+		t.Fatalf("api key before revoking: want 204, got %d", code)
+	}
+
+	if rec := doJson(t, router, http.MethodDelete, "/admin/users/"+user.UUID+"/sessions", nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("revoking: %d %s", rec.Code, rec.Body)
+	}
+
+	if code := useKey(); code != http.StatusUnauthorized {
+		t.Fatalf("api key after revoking: want 401, got %d", code)
+	}
+}
+
+func TestBootstrapAdminsOnlyWithoutAdmins(t *testing.T) {
+	repos, cfg := newTestDeps(t)
+	cfg.AdminUsernames = []string{"alice", "bob"}
+
+	alice := &pkg.User{Username: "alice", UsernameKey: "alice", Role: pkg.RoleUser, CreatedAt: time.Now()}
+	bob := &pkg.User{Username: "bob", UsernameKey: "bob", Role: pkg.RoleUser, CreatedAt: time.Now()}
+	for _, u := range []*pkg.User{alice, bob} {
+		if err := repos.Users.Create(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	BootstrapAdmins(repos, cfg)
+	if user, _ := repos.Users.FindById(alice.UUID); user.Role != pkg.RoleAdmin {
+		t.Fatalf("alice without an admin: want admin, got %s", user.Role)
+	}
+
+	// a demoted user stays demoted on the next start
+	if err := repos.Users.SetRole(bob.UUID, pkg.RoleUser); err != nil {
+		t.Fatal(err)
+	}
+	BootstrapAdmins(repos, cfg)
+	if user, _ := repos.Users.FindById(bob.UUID); user.Role != pkg.RoleUser {
+		t.Fatalf("bob with an admin: want user, got %s", user.Role)
+	}
+}
@@ -0,0 +1,133 @@
+package routes
+
+import (
+	"cloudbuddy/internal/app/apierror"
+	"cloudbuddy/internal/app/repository"
+	"cloudbuddy/internal/pkg"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// creates a named api key with the requested scopes, see pkg.ApiKeyScopes.
+// the key itself is only part of this response.
+func CreateApiKey(repos *repository.Repositories) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var body struct {
+			Name   string   `form:"name" json:"name" binding:"required,max=100"`
+			Scopes []string `form:"scopes" json:"scopes" binding:"required,min=1"`
+		}
+
+		if !bindRequest(c, &body) {
+			return
+		}
+
+		var errs []fieldError
+		for i, scope := range body.Scopes {
+			if !pkg.ValidScope(scope) {
+				errs = append(errs, fieldError{Field: "scopes[" + strconv.Itoa(i) + "]", Code: codeOneOf})
+			}
+		}
+		if len(errs) > 0 {
+			validationFailed(c, errs...)
+			return
+		}
+
+		user, exists := c.Get("user")
+
+		if !exists {
+			apierror.Abort(c, apierror.ErrUnauthorized)
+			return
+		}
+
+		userId := user.(*pkg.User).UUID
+
+		key, prefix, hash, err := pkg.GenerateApiKey()
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		apiKey := &pkg.ApiKey{
+			UserId:    userId,
+			Name:      body.Name,
+			Prefix:    prefix,
+			KeyHash:   hash,
+			Scopes:    body.Scopes,
+			CreatedAt: time.Now(),
+		}
+		err = repos.ApiKeys.Create(apiKey)
+
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"uuid":       apiKey.UUID,
+			"name":       apiKey.Name,
+			"prefix":     prefix,
+			"scopes":     apiKey.Scopes,
+			"created_at": apiKey.CreatedAt,
+			"key":        key,
+		})
+	}
+}
+
+// lists the api keys of the authenticated user
+func GetApiKeys(repos *repository.Repositories) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		user, exists := c.Get("user")
+
+		if !exists {
+			apierror.Abort(c, apierror.ErrUnauthorized)
+			return
+		}
+
+		userId := user.(*pkg.User).UUID
+
+		apiKeys, err := repos.ApiKeys.ListByUser(userId)
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		if apiKeys == nil {
+			apiKeys = []pkg.ApiKey{}
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"api_keys": apiKeys,
+		})
+	}
+}
+
+// revokes one of the authenticated user's api keys
+func DeleteApiKey(repos *repository.Repositories) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+		user, exists := c.Get("user")
+
+		if !exists {
+			apierror.Abort(c, apierror.ErrUnauthorized)
+			return
+		}
+
+		userId := user.(*pkg.User).UUID
+
+		err := repos.ApiKeys.Delete(id, userId)
+		if err == repository.ErrNotFound {
+			apierror.Abort(c, apierror.ErrApiKeyNotFound)
+			return
+		}
+
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		c.JSON(http.StatusNoContent, nil)
+	}
+}
@@ -0,0 +1,62 @@
+package routes
+
+import (
+	"cloudbuddy/internal/app/middleware"
+	"cloudbuddy/internal/pkg"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestReadScopeGatesApiKeyReads(t *testing.T) {
+	repos, _ := newTestDeps(t)
+
+	user := &pkg.User{Username: "alice", UsernameKey: "alice", Role: pkg.RoleUser, CreatedAt: time.Now()}
+	if err := repos.Users.Create(user); err != nil {
+		t.Fatal(err)
+	}
+
+	router := newTestRouter()
+	router.POST("/me/api-keys", asUser(user), CreateApiKey(repos))
+	router.GET("/images", middleware.OptionalApiKeyMiddleware(repos, pkg.ScopeImagesRead), func(c *gin.Context) {
+		c.Status(http.StatusNoContent)
+	})
+
+	createKey := func(scope string) string {
+		rec := doJson(t, router, http.MethodPost, "/me/api-keys", map[string]any{"name": scope, "scopes": []string{scope}})
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("creating api key: %d %s", rec.Code, rec.Body)
+		}
+		var created struct {
+			Key string `json:"key"`
+		}
+		decodeJson(t, rec, &created)
+		return created.Key
+	}
+
+	list := func(authorization string) int {
+		req := httptest.NewRequest(http.MethodGet, "/images", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := list(""); code != http.StatusNoContent {
+		t.Fatalf("anonymous read: want 204, got %d", code)
+	}
+	if code := list("ApiKey " + createKey(pkg.ScopeImagesRead)); code != http.StatusNoContent {
+		t.Fatalf("read with images:read: want 204, got %d", code)
+	}
+	if code := list("ApiKey " + createKey(pkg.ScopeImagesWrite)); code != http.StatusForbidden {
+		t.Fatalf("read without images:read: want 403, got %d", code)
+	}
+	if code := list("ApiKey cb_unknown_key"); code != http.StatusUnauthorized {
+		t.Fatalf("read with an unknown key: want 401, got %d", code)
+	}
+}
@@ -1,194 +1,413 @@
 package routes
 
 import (
+	"cloudbuddy/internal/app/apierror"
+	"cloudbuddy/internal/app/repository"
 	"cloudbuddy/internal/pkg"
+	"log"
 	"net/http"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	cl "github.com/ostafen/clover/v2"
-	"github.com/ostafen/clover/v2/document"
-	q "github.com/ostafen/clover/v2/query"
-	"golang.org/x/crypto/bcrypt"
 )
 
-func Signup(db *cl.DB) func(c *gin.Context) {
+func Signup(repos *repository.Repositories, cfg *pkg.Config, keyRing *pkg.KeyRing) func(c *gin.Context) {
 	return func(c *gin.Context) {
-		username := c.PostForm("username")
-		passphrase := c.PostForm("passphrase")
+		var body struct {
+			Username   string `form:"username" json:"username" binding:"required"`
+			Passphrase string `form:"passphrase" json:"passphrase" binding:"required"`
+			Email      string `form:"email" json:"email"`
+		}
 
-		if username == "" {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"message": "username is required",
-			})
+		if !bindRequest(c, &body) {
 			return
 		}
-		if passphrase == "" {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"message": "passphrase is required",
-			})
+
+		username, usernameKey, err := pkg.NormalizeUsername(body.Username)
+		if err != nil {
+			usernameErr := err.(*pkg.UsernameError)
+			validationFailed(c, fieldError{Field: "username", Code: usernameErr.Code, Message: usernameErr.Message})
 			return
 		}
-		// validate password
-		if len(passphrase) < 8 {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"message": "passphrase must be at least 8 characters long",
-			})
+
+		passphrase := body.Passphrase
+		if !checkPassphrasePolicy(c, cfg, "passphrase", passphrase, username) {
 			return
 		}
 
-		doc, err := db.FindFirst(q.NewQuery("users").Where(q.Field("username").Eq(username)))
+		existing, err := findUserByUsername(repos, username)
 
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"message": "An error occurred on the server",
-			})
+			apierror.Abort(c, apierror.Internal(err))
 			return
 		}
 
-		if doc != nil {
-			c.JSON(http.StatusConflict, gin.H{
-				"message": "A user with that username already exists",
-			})
+		if existing != nil {
+			apierror.Abort(c, apierror.ErrUsernameTaken)
 			return
 		}
 
+		// email is optional, when given it has to be verified through the
+		// link mailed to it
+		var mailer pkg.Mailer
+		email := body.Email
+		if email != "" {
+			var ok bool
+			email, ok = pkg.NormalizeEmail(email)
+			if !ok {
+				validationFailed(c, fieldError{Field: "email", Code: codeInvalid})
+				return
+			}
+
+			existing, err = repos.Users.FindByVerifiedEmail(email)
+			if err != nil {
+				apierror.Abort(c, apierror.Internal(err))
+				return
+			}
+
+			if existing != nil {
+				apierror.Abort(c, apierror.ErrEmailTaken)
+				return
+			}
+
+			mailer, err = pkg.NewMailer(cfg.Mail)
+			if err != nil {
+				apierror.Abort(c, apierror.Internal(err))
+				return
+			}
+		}
+
 		// hash password
-		hashedPassphrase, err := pkg.HashPassword(passphrase)
+		hashedPassphrase, err := pkg.HashPassword(cfg.Argon2, passphrase)
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		newUser := &pkg.User{
+			Username:    username,
+			UsernameKey: usernameKey,
+			Passphrase:  hashedPassphrase,
+			Fullname:    "", // TODO set fullname
+			Email:       email,
+			Role:        pkg.RoleUser,
+			Images:      []string{},
+			CreatedAt:   time.Now(),
+		}
+
+		err = repos.Users.Create(newUser)
+
+		// the username can be taken between the lookup and the insert
+		if err == repository.ErrUsernameTaken {
+			apierror.Abort(c, apierror.ErrUsernameTaken)
+			return
+		}
+
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"message": "An error occurred while hashing passphrase",
-			})
+			apierror.Abort(c, apierror.Internal(err))
 			return
 		}
 
-		newUser := document.NewDocument()
-		newUser.Set("username", username)
-		newUser.Set("passphrase", hashedPassphrase)
-		newUser.Set("fullname", "") // TODO set fullname
-		newUser.Set("images", []string{})
-		newUser.Set("created_at", time.Now())
+		newUserId := newUser.UUID
 
-		newUserId, err := db.InsertOne("users", newUser)
+		if mailer != nil {
+			go sendEmailVerification(repos, cfg, mailer, newUserId, email)
+		}
 
+		sessionId, refreshToken, err := createSession(repos, c, newUserId)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"message": "An error occurred while creating a new user",
-			})
+			apierror.Abort(c, apierror.Internal(err))
 			return
 		}
 
-		token, err := pkg.GenerateJwtToken(newUserId)
+		token, err := pkg.GenerateJwtToken(keyRing, cfg.Jwt, newUserId, 0, sessionId)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"message": "An error occurred while generating jwt token",
-			})
+			apierror.Abort(c, apierror.Internal(err))
 			return
 		}
 
-		c.SetSameSite(http.SameSiteLaxMode)
-		c.SetCookie("Authorization", token, 3600*24*7, "", "", false, true)
+		err = setAuthCookies(c, cfg, token, refreshToken)
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
 
 		c.JSON(http.StatusCreated, gin.H{
-			"uuid":       newUserId,
-			"username":   newUser.Get("username"),
-			"fullname":   newUser.Get("fullname"),
-			"created_at": newUser.Get("created_at"),
-			"token":      token,
+			"uuid":           newUserId,
+			"username":       newUser.Username,
+			"fullname":       newUser.Fullname,
+			"email":          newUser.Email,
+			"email_verified": newUser.EmailVerified,
+			"role":           newUser.Role,
+			"created_at":     newUser.CreatedAt,
+			"token":          token,
+			"refresh_token":  refreshToken,
 		})
 	}
 }
 
-func Signin(db *cl.DB) func(c *gin.Context) {
+func Signin(repos *repository.Repositories, cfg *pkg.Config, keyRing *pkg.KeyRing) func(c *gin.Context) {
 	return func(c *gin.Context) {
 		var credentials struct {
-			Username   string `json:"username"`
-			Passphrase string `json:"passphrase"`
+			Username   string `form:"username" json:"username" binding:"required"`
+			Passphrase string `form:"passphrase" json:"passphrase" binding:"required"`
+		}
+
+		if !bindRequest(c, &credentials) {
+			return
+		}
+
+		keys := signinThrottleKeys(c, credentials.Username)
+		if !reserveSigninAttempt(c, repos, keys) {
+			return
 		}
 
-		err := c.BindJSON(&credentials)
+		user, err := findUserByUsername(repos, credentials.Username)
+
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"message": err.Error(),
-			})
+			apierror.Abort(c, apierror.Internal(err))
 			return
 		}
 
-		if credentials.Username == "" {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"message": "username is required",
-			})
+		// users created through an identity provider have no passphrase
+		if user == nil || user.Passphrase == "" {
+			pkg.DummyCheckPassword(cfg.Argon2, credentials.Passphrase)
+			apierror.Abort(c, apierror.ErrInvalidCredentials)
 			return
 		}
-		if credentials.Passphrase == "" {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"message": "passphrase is required",
-			})
+
+		match, err := pkg.CheckHashPassword(credentials.Passphrase, user.Passphrase)
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
 			return
 		}
-		// validate password
-		if len(credentials.Passphrase) < 8 {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"message": "passphrase must be at least 8 characters long",
-			})
+
+		if !match {
+			apierror.Abort(c, apierror.ErrInvalidCredentials)
 			return
 		}
 
-		user, err := db.FindFirst(q.NewQuery("users").Where(q.Field("username").Eq(credentials.Username)))
+		// hashes from bcrypt or with outdated parameters are replaced while
+		// the passphrase is at hand
+		if pkg.NeedsRehash(cfg.Argon2, user.Passphrase) {
+			rehashPassphrase(repos, cfg, user.UUID, credentials.Passphrase)
+		}
+
+		err = resetSigninFailures(repos, keys)
+		if err != nil {
+			log.Println(err)
+		}
+
+		signinOrChallenge(c, repos, cfg, keyRing, user)
+	}
+}
+
+// responds with 400 and every reason the passphrase was rejected for as
+// errors of field, if it doesn't meet the passphrase policy
+func checkPassphrasePolicy(c *gin.Context, cfg *pkg.Config, field string, passphrase string, username string) bool {
+	problems, err := cfg.Passphrase.Check(passphrase, username)
+	if err != nil {
+		apierror.Abort(c, apierror.Internal(err))
+		return false
+	}
+
+	if len(problems) > 0 {
+		var errs []fieldError
+		for _, problem := range problems {
+			errs = append(errs, fieldError{Field: field, Code: problem.Code, Message: problem.Message})
+		}
+		validationFailed(c, errs...)
+		return false
+	}
+
+	return true
+}
+
+func rehashPassphrase(repos *repository.Repositories, cfg *pkg.Config, userId string, passphrase string) {
+	hashedPassphrase, err := pkg.HashPassword(cfg.Argon2, passphrase)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	err = repos.Users.SetPassphrase(userId, hashedPassphrase)
+	if err != nil {
+		log.Printf("Rehashing passphrase failed (user _id: %s): %v", userId, err)
+	}
+}
 
+// confirms a sensitive change of the authenticated user. users with a
+// passphrase have to send it, users without one must have signed in within
+// pkg.RecentSigninWindow. the request is aborted and false returned otherwise.
+func confirmIdentity(c *gin.Context, repos *repository.Repositories, user *pkg.User, field string, passphrase string) bool {
+	if user.Passphrase == "" {
+		session, err := repos.Sessions.FindById(c.GetString("session_id"))
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"message": "An error occurred on the server",
-			})
+			apierror.Abort(c, apierror.Internal(err))
+			return false
+		}
+
+		if session == nil || time.Since(session.CreatedAt) > pkg.RecentSigninWindow {
+			apierror.Abort(c, apierror.ErrRecentSigninRequired)
+			return false
+		}
+
+		return true
+	}
+
+	if passphrase == "" {
+		validationFailed(c, fieldError{Field: field, Code: codeRequired})
+		return false
+	}
+
+	match, err := pkg.CheckHashPassword(passphrase, user.Passphrase)
+	if err != nil {
+		apierror.Abort(c, apierror.Internal(err))
+		return false
+	}
+
+	if !match {
+		apierror.Abort(c, apierror.ErrPassphraseIncorrect)
+		return false
+	}
+
+	return true
+}
+
+// with two-factor enabled the first factor alone isn't enough, the client has
+// to exchange the challenge token along with a code. otherwise the user is
+// signed in right away.
+func signinOrChallenge(c *gin.Context, repos *repository.Repositories, cfg *pkg.Config, keyRing *pkg.KeyRing, user *pkg.User) {
+	if user.TotpEnabled {
+		challengeToken, err := pkg.GenerateChallengeToken(keyRing, cfg.Jwt, user.UUID)
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"two_factor_required": true,
+			"challenge_token":     challengeToken,
+		})
+		return
+	}
+
+	completeSignin(c, repos, cfg, keyRing, user)
+}
+
+// creates a session for the user and responds with the issued tokens
+func completeSignin(c *gin.Context, repos *repository.Repositories, cfg *pkg.Config, keyRing *pkg.KeyRing, user *pkg.User) {
+	sessionId, refreshToken, err := createSession(repos, c, user.UUID)
+	if err != nil {
+		apierror.Abort(c, apierror.Internal(err))
+		return
+	}
+
+	token, err := pkg.GenerateJwtToken(keyRing, cfg.Jwt, user.UUID, user.TokenVersion, sessionId)
+	if err != nil {
+		apierror.Abort(c, apierror.Internal(err))
+		return
+	}
+
+	err = setAuthCookies(c, cfg, token, refreshToken)
+	if err != nil {
+		apierror.Abort(c, apierror.Internal(err))
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"uuid":          user.UUID,
+		"username":      user.Username,
+		"fullname":      user.Fullname,
+		"role":          pkg.RoleOf(user),
+		"created_at":    user.CreatedAt,
+		"token":         token,
+		"refresh_token": refreshToken,
+	})
+}
+
+// changes the passphrase of the authenticated user. every token issued before
+// the change stops working, all other sessions are revoked and the user's api
+// keys deleted. a fresh access token is returned for the current client.
+func ChangePassphrase(repos *repository.Repositories, cfg *pkg.Config, keyRing *pkg.KeyRing) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var body struct {
+			OldPassphrase string `form:"old_passphrase" json:"old_passphrase" binding:"required"`
+			NewPassphrase string `form:"new_passphrase" json:"new_passphrase" binding:"required"`
+		}
+
+		if !bindRequest(c, &body) {
 			return
 		}
 
-		if user == nil {
-			c.JSON(http.StatusNotFound, gin.H{
-				"message": "username or passphrase is incorrect",
-			})
+		u, exists := c.Get("user")
+
+		if !exists {
+			apierror.Abort(c, apierror.ErrUnauthorized)
 			return
 		}
 
-		match, err := pkg.CheckHashPassword(credentials.Passphrase, user.Get("passphrase").(string))
+		user := u.(*pkg.User)
+		userId := user.UUID
+
+		if !checkPassphrasePolicy(c, cfg, "new_passphrase", body.NewPassphrase, user.Username) {
+			return
+		}
+
+		match, err := pkg.CheckHashPassword(body.OldPassphrase, user.Passphrase)
 		if err != nil {
-			if err == bcrypt.ErrMismatchedHashAndPassword {
-				c.JSON(http.StatusNotFound, gin.H{
-					"message": "username or password is incorrect",
-				})
-				return
-			} else {
-				c.JSON(http.StatusInternalServerError, gin.H{
-					"message": "An error occurred on the server",
-				})
-				return
-			}
+			apierror.Abort(c, apierror.Internal(err))
+			return
 		}
 
 		if !match {
-			c.JSON(http.StatusNotFound, gin.H{
-				"message": "username or passphrase is incorrect",
-			})
+			apierror.Abort(c, apierror.ErrPassphraseIncorrect)
 			return
 		}
 
-		token, err := pkg.GenerateJwtToken(user.Get("_id").(string))
+		hashedPassphrase, err := pkg.HashPassword(cfg.Argon2, body.NewPassphrase)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"message": "An error occurred while generating jwt token",
-			})
+			apierror.Abort(c, apierror.Internal(err))
 			return
 		}
 
-		c.SetSameSite(http.SameSiteLaxMode)
-		c.SetCookie("Authorization", token, 3600*24*7, "", "", false, true)
+		tokenVersion, err := repos.Users.ChangePassphrase(userId, hashedPassphrase)
 
-		c.JSON(http.StatusCreated, gin.H{
-			"uuid":       user.Get("_id").(string),
-			"username":   user.Get("username"),
-			"fullname":   user.Get("fullname"),
-			"created_at": user.Get("created_at"),
-			"token":      token,
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		// refresh tokens of every other session die with the old passphrase
+		sessionId := c.GetString("session_id")
+		err = repos.Sessions.RevokeByUser(userId, sessionId)
+
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		err = repos.ApiKeys.DeleteByUser(userId)
+
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		token, err := pkg.GenerateJwtToken(keyRing, cfg.Jwt, userId, tokenVersion, sessionId)
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		err = setAuthCookies(c, cfg, token, "")
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"token": token,
 		})
 	}
 }
@@ -0,0 +1,252 @@
+package routes
+
+import (
+	"cloudbuddy/internal/app/middleware"
+	"cloudbuddy/internal/app/repository"
+	"cloudbuddy/internal/pkg"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// the auth and session routes as main wires them
+func newAuthRouter(repos *repository.Repositories, cfg *pkg.Config, keyRing *pkg.KeyRing) *gin.Engine {
+	router := newTestRouter()
+
+	auth := router.Group("/v1/auth")
+	auth.POST("/signup", Signup(repos, cfg, keyRing))
+	auth.POST("/signin", Signin(repos, cfg, keyRing))
+	auth.POST("/refresh", Refresh(repos, cfg, keyRing))
+	auth.POST("/signout", Signout(repos, cfg, keyRing))
+
+	me := router.Group("/v1/me", middleware.DecodeJwtMiddleware(repos, cfg, keyRing))
+	me.POST("/passphrase", ChangePassphrase(repos, cfg, keyRing))
+	me.PUT("/email", ChangeEmail(repos, cfg))
+	me.GET("/sessions", GetSessions(repos))
+
+	return router
+}
+
+type tokens struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+func signup(t *testing.T, router http.Handler, username string, passphrase string) tokens {
+	t.Helper()
+
+	rec := doJson(t, router, http.MethodPost, "/v1/auth/signup", map[string]string{"username": username, "passphrase": passphrase})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("signup: %d %s", rec.Code, rec.Body)
+	}
+
+	var issued tokens
+	decodeJson(t, rec, &issued)
+	return issued
+}
+
+func signin(t *testing.T, router http.Handler, username string, passphrase string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	return doJson(t, router, http.MethodPost, "/v1/auth/signin", map[string]string{"username": username, "passphrase": passphrase})
+}
+
+// a request authenticated with the access token
+func getSessions(t *testing.T, router http.Handler, token string) int {
+	t.Helper()
+
+	return doAuthorizedJson(t, router, http.MethodGet, "/v1/me/sessions", token, nil).Code
+}
+
+func TestSignupAndSignin(t *testing.T) {
+	repos, cfg := newTestDeps(t)
+	router := newAuthRouter(repos, cfg, newTestKeyRing(t))
+
+	issued := signup(t, router, "Alice", "correct horse battery staple")
+	if code := getSessions(t, router, issued.Token); code != http.StatusOK {
+		t.Fatalf("access token from signup: want 200, got %d", code)
+	}
+
+	// usernames are unique regardless of case
+	rec := doJson(t, router, http.MethodPost, "/v1/auth/signup", map[string]string{"username": "alice", "passphrase": "another fine passphrase"})
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("taken username: want 409, got %d %s", rec.Code, rec.Body)
+	}
+
+	rec = signin(t, router, "ALICE", "correct horse battery staple")
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("signin: want 201, got %d %s", rec.Code, rec.Body)
+	}
+	var signedIn tokens
+	decodeJson(t, rec, &signedIn)
+	if code := getSessions(t, router, signedIn.Token); code != http.StatusOK {
+		t.Fatalf("access token from signin: want 200, got %d", code)
+	}
+
+	if rec := signin(t, router, "alice", "wrong passphrase"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong passphrase: want 401, got %d", rec.Code)
+	}
+	if rec := signin(t, router, "nobody", "correct horse battery staple"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("unknown user: want 401, got %d", rec.Code)
+	}
+}
+
+func TestSignupEnforcesPassphrasePolicy(t *testing.T) {
+	repos, cfg := newTestDeps(t)
+	router := newAuthRouter(repos, cfg, newTestKeyRing(t))
+
+	rec := doJson(t, router, http.MethodPost, "/v1/auth/signup", map[string]string{"username": "alice", "passphrase": "alice123"})
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("weak passphrase: want 400, got %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestSigninIsThrottled(t *testing.T) {
+	repos, cfg := newTestDeps(t)
+	router := newAuthRouter(repos, cfg, newTestKeyRing(t))
+	signup(t, router, "alice", "correct horse battery staple")
+
+	// the free attempts and the first one which is delayed
+	for i := int64(0); i <= pkg.UsernameThrottle.FreeAttempts; i++ {
+		if rec := signin(t, router, "alice", "wrong passphrase"); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: want 401, got %d", i+1, rec.Code)
+		}
+	}
+
+	// even the right passphrase has to wait
+	rec := signin(t, router, "alice", "correct horse battery staple")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("want 429 with Retry-After, got %d", rec.Code)
+	}
+}
+
+// concurrent attempts are counted one after the other, they can't all slip
+// through before the first failure is recorded
+func TestConcurrentSigninsAreThrottled(t *testing.T) {
+	repos, cfg := newTestDeps(t)
+	router := newAuthRouter(repos, cfg, newTestKeyRing(t))
+	signup(t, router, "alice", "correct horse battery staple")
+
+	const attempts = 20
+	codes := make(chan int, attempts)
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- signin(t, router, "alice", "wrong passphrase").Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	checked := int64(0)
+	for code := range codes {
+		if code == http.StatusUnauthorized {
+			checked++
+		}
+	}
+	if checked != pkg.UsernameThrottle.FreeAttempts+1 {
+		t.Fatalf("want %d attempts checked, got %d", pkg.UsernameThrottle.FreeAttempts+1, checked)
+	}
+}
+
+func TestChangePassphraseRevokesOtherTokens(t *testing.T) {
+	repos, cfg := newTestDeps(t)
+	router := newAuthRouter(repos, cfg, newTestKeyRing(t))
+
+	first := signup(t, router, "alice", "correct horse battery staple")
+	rec := signin(t, router, "alice", "correct horse battery staple")
+	var second tokens
+	decodeJson(t, rec, &second)
+
+	alice, err := repos.Users.FindByUsernameKey("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiKey := &pkg.ApiKey{UserId: alice.UUID, Name: "ci", Prefix: "cb_ci", KeyHash: "hash", Scopes: []string{pkg.ScopeImagesWrite}, CreatedAt: time.Now()}
+	if err := repos.ApiKeys.Create(apiKey); err != nil {
+		t.Fatal(err)
+	}
+
+	rec = doAuthorizedJson(t, router, http.MethodPost, "/v1/me/passphrase", second.Token, map[string]string{"old_passphrase": "correct horse battery staple", "new_passphrase": "a whole new passphrase"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("changing passphrase: %d %s", rec.Code, rec.Body)
+	}
+	var changed tokens
+	decodeJson(t, rec, &changed)
+
+	if code := getSessions(t, router, first.Token); code != http.StatusUnauthorized {
+		t.Fatalf("token issued before the change: want 401, got %d", code)
+	}
+	if code := getSessions(t, router, changed.Token); code != http.StatusOK {
+		t.Fatalf("token issued with the change: want 200, got %d", code)
+	}
+	if keys, err := repos.ApiKeys.ListByUser(alice.UUID); err != nil || len(keys) != 0 {
+		t.Fatalf("api keys left after the change: %+v %v", keys, err)
+	}
+
+	if rec := signin(t, router, "alice", "correct horse battery staple"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("old passphrase: want 401, got %d", rec.Code)
+	}
+	if rec := signin(t, router, "alice", "a whole new passphrase"); rec.Code != http.StatusCreated {
+		t.Fatalf("new passphrase: want 201, got %d", rec.Code)
+	}
+}
+
+func TestChangeEmailRequiresPassphrase(t *testing.T) {
+	repos, cfg := newTestDeps(t)
+	router := newAuthRouter(repos, cfg, newTestKeyRing(t))
+
+	issued := signup(t, router, "alice", "correct horse battery staple")
+
+	changeEmail := func(passphrase string) int {
+		body := map[string]string{"email": "alice@example.com", "passphrase": passphrase}
+		return doAuthorizedJson(t, router, http.MethodPut, "/v1/me/email", issued.Token, body).Code
+	}
+
+	if code := changeEmail(""); code != http.StatusBadRequest {
+		t.Fatalf("without passphrase: want 400, got %d", code)
+	}
+	if code := changeEmail("wrong passphrase"); code != http.StatusForbidden {
+		t.Fatalf("wrong passphrase: want 403, got %d", code)
+	}
+	if code := changeEmail("correct horse battery staple"); code != http.StatusAccepted {
+		t.Fatalf("correct passphrase: want 202, got %d", code)
+	}
+}
+
+// users without a passphrase have to have signed in recently instead
+func TestChangeEmailWithoutPassphraseRequiresRecentSignin(t *testing.T) {
+	repos, cfg := newTestDeps(t)
+
+	user := &pkg.User{Username: "alice", UsernameKey: "alice", Role: pkg.RoleUser, CreatedAt: time.Now()}
+	if err := repos.Users.Create(user); err != nil {
+		t.Fatal(err)
+	}
+
+	changeEmail := func(signedInAt time.Time) int {
+		session := &pkg.Session{UserId: user.UUID, UsedHashes: []string{}, ExpiresAt: time.Now().Add(time.Hour), LastUsedAt: signedInAt, CreatedAt: signedInAt}
+		if err := repos.Sessions.Create(session); err != nil {
+			t.Fatal(err)
+		}
+
+		router := newTestRouter()
+		router.PUT("/me/email", asUser(user), func(c *gin.Context) {
+			c.Set("session_id", session.UUID)
+		}, ChangeEmail(repos, cfg))
+
+		return doJson(t, router, http.MethodPut, "/me/email", map[string]string{"email": "alice@example.com"}).Code
+	}
+
+	if code := changeEmail(time.Now().Add(-time.Hour)); code != http.StatusForbidden {
+		t.Fatalf("signed in an hour ago: want 403, got %d", code)
+	}
+	if code := changeEmail(time.Now()); code != http.StatusAccepted {
+		t.Fatalf("signed in just now: want 202, got %d", code)
+	}
+}
@@ -0,0 +1,196 @@
+package routes
+
+import (
+	"cloudbuddy/internal/app/apierror"
+	"cloudbuddy/internal/app/repository"
+	"cloudbuddy/internal/pkg"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const emailVerificationTTL = time.Hour * 24
+
+// creates a verification token for email and mails the link to it
+func sendEmailVerification(repos *repository.Repositories, cfg *pkg.Config, mailer pkg.Mailer, userId string, email string) {
+	token, err := pkg.RandomToken(32)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	err = repos.EmailVerifications.Create(&pkg.EmailVerification{
+		UserId:    userId,
+		Email:     email,
+		TokenHash: pkg.HashToken(token),
+		ExpiresAt: time.Now().Add(emailVerificationTTL),
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	body := "Please confirm this is the email address of your CloudBuddy account by opening this link:\n" +
+		pkg.TokenLink(cfg.Mail.EmailVerificationUrl, token) + "\n\n" +
+		"The link is valid for 24 hours."
+
+	err = mailer.Send(email, "Verify your CloudBuddy email", body)
+	if err != nil {
+		log.Printf("Sending verification mail failed (user _id: %s): %v", userId, err)
+	}
+}
+
+// marks the email a verification token was issued for as verified, as long
+// as it is still the user's current address and nobody verified it before
+func VerifyEmail(repos *repository.Repositories) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		token := c.Query("token")
+		if token == "" {
+			validationFailed(c, fieldError{Field: "token", Code: codeRequired})
+			return
+		}
+
+		verification, err := repos.EmailVerifications.FindByTokenHash(pkg.HashToken(token))
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		if verification == nil || verification.Used || time.Now().After(verification.ExpiresAt) {
+			apierror.Abort(c, apierror.ErrVerificationTokenInvalid)
+			return
+		}
+
+		email := verification.Email
+		verified, err := repos.Users.VerifyEmail(verification.UserId, email)
+
+		if err != nil && err != repository.ErrNotFound {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		if !verified {
+			apierror.Abort(c, apierror.ErrVerificationTokenInvalid)
+			return
+		}
+
+		err = repos.EmailVerifications.SetUsed(verification.UUID)
+
+		if err != nil {
+			log.Println(err)
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"email":          email,
+			"email_verified": true,
+		})
+	}
+}
+
+// mails a new verification link to the authenticated user's current email
+func ResendEmailVerification(repos *repository.Repositories, cfg *pkg.Config) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		u, exists := c.Get("user")
+
+		if !exists {
+			apierror.Abort(c, apierror.ErrUnauthorized)
+			return
+		}
+
+		user := u.(*pkg.User)
+
+		email := user.Email
+		if email == "" {
+			apierror.Abort(c, apierror.ErrEmailMissing)
+			return
+		}
+
+		if user.EmailVerified {
+			apierror.Abort(c, apierror.ErrEmailAlreadyVerified)
+			return
+		}
+
+		mailer, err := pkg.NewMailer(cfg.Mail)
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		go sendEmailVerification(repos, cfg, mailer, user.UUID, email)
+
+		c.JSON(http.StatusAccepted, gin.H{
+			"message": "a verification link has been sent",
+		})
+	}
+}
+
+// sets a new email address for the authenticated user. the current passphrase
+// confirms the change, see confirmIdentity. the address starts out unverified
+// and a verification link is mailed to it.
+func ChangeEmail(repos *repository.Repositories, cfg *pkg.Config) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var body struct {
+			Email      string `form:"email" json:"email" binding:"required"`
+			Passphrase string `form:"passphrase" json:"passphrase"`
+		}
+
+		if !bindRequest(c, &body) {
+			return
+		}
+
+		email, ok := pkg.NormalizeEmail(body.Email)
+		if !ok {
+			validationFailed(c, fieldError{Field: "email", Code: codeInvalid})
+			return
+		}
+
+		u, exists := c.Get("user")
+
+		if !exists {
+			apierror.Abort(c, apierror.ErrUnauthorized)
+			return
+		}
+
+		user := u.(*pkg.User)
+		userId := user.UUID
+
+		if !confirmIdentity(c, repos, user, "passphrase", body.Passphrase) {
+			return
+		}
+
+		// unverified addresses don't hold on to an address, whoever
+		// verifies it first gets it
+		existing, err := repos.Users.FindByVerifiedEmail(email)
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		if existing != nil && existing.UUID != userId {
+			apierror.Abort(c, apierror.ErrEmailTaken)
+			return
+		}
+
+		mailer, err := pkg.NewMailer(cfg.Mail)
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		err = repos.Users.SetEmail(userId, email)
+
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		go sendEmailVerification(repos, cfg, mailer, userId, email)
+
+		c.JSON(http.StatusAccepted, gin.H{
+			"message": "a verification link has been sent to the new email",
+		})
+	}
+}
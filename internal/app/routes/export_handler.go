@@ -0,0 +1,321 @@
+package routes
+
+import (
+	"archive/zip"
+	"bytes"
+	"cloudbuddy/internal/app/apierror"
+	"cloudbuddy/internal/app/repository"
+	"cloudbuddy/internal/pkg"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// how long a download link handed out by GetExport stays valid
+const exportLinkExpiry = 15 * time.Minute
+
+// how long an archive is kept once it's ready, CleanupExports deletes it after
+const exportRetention = 24 * time.Hour
+
+// exports still pending after this long lost their job to a restart and count
+// as failed
+const exportTimeout = 30 * time.Minute
+
+// starts a background job which archives everything we store about the user.
+// if the user already has a pending export, that one is returned instead.
+func RequestExport(repos *repository.Repositories, cfg *pkg.Config, urls pkg.UrlResolver) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		if !exportsEnabled(c, cfg) {
+			return
+		}
+
+		user, exists := c.Get("user")
+
+		if !exists {
+			apierror.Abort(c, apierror.ErrUnauthorized)
+			return
+		}
+
+		userId := user.(*pkg.User).UUID
+
+		pending, err := repos.Exports.ListByStatus(userId, pkg.ExportStatusPending)
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		for _, export := range pending {
+			export = currentExport(export)
+			if export.Status == pkg.ExportStatusPending {
+				c.JSON(http.StatusAccepted, export)
+				return
+			}
+		}
+
+		export := &pkg.Export{
+			UserId:    userId,
+			Status:    pkg.ExportStatusPending,
+			CreatedAt: time.Now(),
+		}
+		err = repos.Exports.Create(export)
+
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		go runExport(repos, cfg, urls, export.UUID, userId)
+
+		c.JSON(http.StatusAccepted, export)
+	}
+}
+
+// reports the state of an export and, once it's ready, a time-limited
+// download link for the archive.
+func GetExport(repos *repository.Repositories, cfg *pkg.Config) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		if !exportsEnabled(c, cfg) {
+			return
+		}
+
+		id := c.Param("id")
+		user, exists := c.Get("user")
+
+		if !exists {
+			apierror.Abort(c, apierror.ErrUnauthorized)
+			return
+		}
+
+		userId := user.(*pkg.User).UUID
+
+		stored, err := repos.Exports.FindById(id)
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		if stored == nil || stored.UserId != userId {
+			apierror.Abort(c, apierror.ErrExportNotFound)
+			return
+		}
+
+		export := currentExport(*stored)
+
+		if export.Status != pkg.ExportStatusReady {
+			c.JSON(http.StatusOK, export)
+			return
+		}
+
+		url, err := pkg.PresignBucketObject(cfg.Bucket.Exports(), export.Key, exportLinkExpiry)
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"uuid":         export.UUID,
+			"user_id":      export.UserId,
+			"status":       export.Status,
+			"created_at":   export.CreatedAt,
+			"completed_at": export.CompletedAt,
+			"download_url": url,
+			"expires_at":   time.Now().Add(exportLinkExpiry),
+		})
+	}
+}
+
+// responds and returns false when there is no bucket to keep exports in
+func exportsEnabled(c *gin.Context, cfg *pkg.Config) bool {
+	if !cfg.Bucket.ExportsEnabled() {
+		apierror.Abort(c, apierror.ErrExportsDisabled)
+		return false
+	}
+
+	return true
+}
+
+// reads an export the way it stands now. CleanupExports only catches up with
+// timed out and expired exports every so often.
+func currentExport(export pkg.Export) pkg.Export {
+	now := time.Now()
+	switch {
+	case export.Status == pkg.ExportStatusPending && now.After(export.CreatedAt.Add(exportTimeout)):
+		export.Status = pkg.ExportStatusFailed
+	case export.Status == pkg.ExportStatusReady && !export.ExpiresAt.IsZero() && now.After(export.ExpiresAt):
+		export.Status = pkg.ExportStatusExpired
+	}
+
+	return export
+}
+
+func runExport(repos *repository.Repositories, cfg *pkg.Config, urls pkg.UrlResolver, exportId string, userId string) {
+	status := pkg.ExportStatusReady
+	key := cfg.Bucket.ObjectKey("exports/" + exportId + ".zip")
+
+	archive, err := buildExportArchive(repos, cfg, urls, userId)
+	if err == nil {
+		err = pkg.UploadBytesToBucket(cfg.Bucket.Exports(), key, archive, "application/zip")
+	}
+
+	if err != nil {
+		log.Printf("Building export failed (export _id: %s), (user _id: %s): %v", exportId, userId, err)
+		status = pkg.ExportStatusFailed
+		key = ""
+	}
+
+	now := time.Now()
+	var expiresAt time.Time
+	if status == pkg.ExportStatusReady {
+		expiresAt = now.Add(exportRetention)
+	}
+
+	err = repos.Exports.Finish(exportId, status, key, now, expiresAt)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// runs CleanupExports now and then every interval, for the lifetime of the
+// process
+func RunExportCleanup(repos *repository.Repositories, cfg *pkg.Config, interval time.Duration) {
+	for {
+		CleanupExports(repos, cfg)
+		time.Sleep(interval)
+	}
+}
+
+// marks exports whose job never finished as failed and deletes the archives
+// of exports past their retention
+func CleanupExports(repos *repository.Repositories, cfg *pkg.Config) {
+	exports, err := repos.Exports.ListByStatus("", pkg.ExportStatusPending, pkg.ExportStatusReady)
+	if err != nil {
+		log.Printf("Cleaning up exports failed: %v", err)
+		return
+	}
+
+	for _, stored := range exports {
+		export := currentExport(stored)
+		if export.Status == stored.Status {
+			continue
+		}
+
+		if export.Status == pkg.ExportStatusExpired {
+			if err := pkg.DeleteFromBucket(cfg.Bucket.Exports(), export.Key); err != nil {
+				log.Printf("Deleting export %s failed: %v", export.UUID, err)
+				continue
+			}
+		}
+
+		err := repos.Exports.SetStatus(export.UUID, export.Status)
+		if err != nil {
+			log.Printf("Cleaning up export %s failed: %v", export.UUID, err)
+		}
+	}
+}
+
+// zips everything stored about the user: the account, images with their
+// original files, sessions, api keys, passkeys and linked identities. secrets
+// like passphrase, token and key hashes are left out by the json encoding of
+// each record. likes are anonymous counters on the images and comments don't
+// exist, so there is nothing of either to export.
+func buildExportArchive(repos *repository.Repositories, cfg *pkg.Config, urls pkg.UrlResolver, userId string) ([]byte, error) {
+	user, err := repos.Users.FindById(userId)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, errors.New("user not found")
+	}
+
+	images, err := repos.Images.ListByUser(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range images {
+		if err := resolveImageUrl(urls, &images[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	sessions, err := repos.Sessions.ListByUser(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	apiKeys, err := repos.ApiKeys.ListByUser(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	credentials, err := repos.Credentials.ListByUser(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	identities, err := repos.Identities.ListByUser(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	records := []struct {
+		name string
+		v    interface{}
+	}{
+		{"user.json", user},
+		{"images.json", images},
+		{"sessions.json", sessions},
+		{"api_keys.json", apiKeys},
+		{"passkeys.json", credentials},
+		{"identities.json", identities},
+	}
+	for _, record := range records {
+		if err := writeZipJSON(zw, record.name, record.v); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, image := range images {
+		if image.Key == "" || image.Backend != pkg.StorageBackendS3 {
+			continue
+		}
+
+		body, err := pkg.DownloadFromBucket(cfg.Bucket, image.Key)
+		if err != nil {
+			return nil, err
+		}
+
+		w, err := zw.Create("images/" + path.Base(image.Key))
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(body); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func writeZipJSON(zw *zip.Writer, name string, v interface{}) error {
+	w, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -1,67 +1,60 @@
 package routes
 
 import (
+	"cloudbuddy/internal/app/apierror"
+	"cloudbuddy/internal/app/repository"
 	"cloudbuddy/internal/pkg"
 	"log"
+	"mime/multipart"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/joho/godotenv"
-	cl "github.com/ostafen/clover/v2"
-	"github.com/ostafen/clover/v2/document"
-	q "github.com/ostafen/clover/v2/query"
 )
 
 var ImagesCount = -1
 
-func GetImageById(db *cl.DB) func(c *gin.Context) {
+func GetImageById(repos *repository.Repositories, urls pkg.UrlResolver) func(c *gin.Context) {
 	return func(c *gin.Context) {
 		id := c.Param("id")
-		doc, err := db.FindFirst(q.NewQuery("images").Where(q.Field("_id").Eq(id)))
+		image, err := repos.Images.FindById(id)
 
-		if doc == nil {
-			c.JSON(http.StatusNotFound, gin.H{
-				"message": "cloud not found :(",
-			})
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		if image == nil {
+			apierror.Abort(c, apierror.ErrImageNotFound)
 			return
 		}
 
+		err = resolveImageUrl(urls, image)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"message": "An unexpected error occured",
-			})
+			apierror.Abort(c, apierror.Internal(err))
 			return
 		}
 
-		c.JSON(http.StatusOK, pkg.Image{
-			UUID:      doc.Get("_id").(string),
-			Title:     doc.Get("title").(string),
-			Url:       doc.Get("url").(string),
-			Likes:     doc.Get("likes").(int64),
-			UserId:    doc.Get("user_id").(string),
-			CreatedAt: doc.Get("created_at").(time.Time),
-		})
+		c.JSON(http.StatusOK, image)
 	}
 }
 
 // returns all images.
 // limit default is 5.
 // offset default is 0.
-func GetAllImages(db *cl.DB) func(c *gin.Context) {
+func GetAllImages(repos *repository.Repositories, urls pkg.UrlResolver) func(c *gin.Context) {
 	return func(c *gin.Context) {
 		offsetQuery := c.Query("offset")
 		offset, err := strconv.Atoi(offsetQuery)
 		limit := 5
-		if err != nil {
+		if err != nil || offset < 0 {
 			offset = 0
 		}
-		docs, err := db.FindAll(q.NewQuery("images").Sort(q.SortOption{Field: "created_at", Direction: -1}).Skip(offset).Limit(limit))
+		images, err := repos.Images.List(offset, limit)
 		if ImagesCount == -1 {
-			count, err := db.Count(q.NewQuery("images"))
+			count, err := repos.Images.Count()
 			if err != nil {
 				log.Println(err)
 			} else {
@@ -69,31 +62,17 @@ func GetAllImages(db *cl.DB) func(c *gin.Context) {
 			}
 		}
 
-		var images []pkg.Image = []pkg.Image{}
-
-		for _, doc := range docs {
-			images = append(images, pkg.Image{
-				UUID:      doc.Get("_id").(string),
-				Title:     doc.Get("title").(string),
-				Url:       doc.Get("url").(string),
-				Likes:     doc.Get("likes").(int64),
-				UserId:    doc.Get("user_id").(string),
-				CreatedAt: doc.Get("created_at").(time.Time),
-			})
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
 		}
 
-		if err != nil {
-			if err == cl.ErrCollectionNotExist {
-				c.JSON(http.StatusNotFound, gin.H{
-					"message": err.Error(),
-				})
-			} else {
-				c.JSON(http.StatusInternalServerError, gin.H{
-					"message": "wtf",
-				})
+		for i := range images {
+			err = resolveImageUrl(urls, &images[i])
+			if err != nil {
+				apierror.Abort(c, apierror.Internal(err))
+				return
 			}
-
-			return
 		}
 
 		c.JSON(http.StatusOK, gin.H{
@@ -103,160 +82,114 @@ func GetAllImages(db *cl.DB) func(c *gin.Context) {
 	}
 }
 
-func PostImage(db *cl.DB) func(c *gin.Context) {
+func PostImage(repos *repository.Repositories, cfg *pkg.Config, urls pkg.UrlResolver) func(c *gin.Context) {
 	return func(c *gin.Context) {
-		title := c.PostForm("title")
-		file, err := c.FormFile("image")
-		if err != nil {
-			c.JSON(http.StatusNotAcceptable, gin.H{
-				"message": err.Error(),
-			})
+		// the image itself can only come as multipart form
+		var body struct {
+			Title string                `form:"title" json:"title"`
+			Image *multipart.FileHeader `form:"image" json:"-" binding:"required"`
+		}
+
+		if !bindRequest(c, &body) {
 			return
 		}
+
+		title, file := body.Title, body.Image
 		if !strings.HasPrefix(file.Header.Get("Content-Type"), "image/") {
-			c.JSON(http.StatusUnsupportedMediaType, gin.H{
-				"message": "Uploaded file must be an image",
-			})
+			apierror.Abort(c, apierror.ErrUnsupportedMediaType.WithDetail("uploaded file must be an image"))
 			return
 		}
 
-		user, exists := c.Get("user")
+		u, exists := c.Get("user")
 
 		if !exists {
-			c.JSON(http.StatusUnauthorized, gin.H{
-				"message": "unauthorized",
-			})
+			apierror.Abort(c, apierror.ErrUnauthorized)
 			return
 		}
 
-		userId, ok := user.(*document.Document).Get("_id").(string)
+		user := u.(*pkg.User)
 
-		if !ok {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"message": "Something went wrong on the server",
-			})
+		if cfg.Mail.RequireVerifiedEmail && !user.EmailVerified {
+			apierror.Abort(c, apierror.ErrEmailNotVerified.WithDetail("verify your email before uploading images"))
 			return
 		}
 
-		doc := document.NewDocument()
-		doc.Set("title", title)
-		doc.Set("url", "")
-		doc.Set("likes", 0)
-		doc.Set("user_id", userId)
-		doc.Set("created_at", time.Now())
-		docId, err := db.InsertOne("images", doc)
+		image := &pkg.Image{
+			Title:     title,
+			Backend:   pkg.StorageBackendS3,
+			UserId:    user.UUID,
+			CreatedAt: time.Now(),
+		}
+		err := repos.Images.Create(image)
 
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"message": "An error occured while creating a new image record",
-			})
+			apierror.Abort(c, apierror.Internal(err))
 			return
 		}
 
-		err = pkg.UploadToBucket(file, docId)
+		key, err := pkg.UploadToBucket(cfg.Bucket, file, image.UUID)
 		if err != nil {
-			log.Println(err)
-			innerErr := db.DeleteById("images", docId)
-			if innerErr != nil {
+			// drop the record of the image which never made it to the bucket
+			if innerErr := repos.Images.Delete(image.UUID); innerErr != nil {
 				log.Println(innerErr)
-				c.JSON(http.StatusInternalServerError, gin.H{
-					"message": "An error occured while deleting temporary created image record",
-				})
-				return
 			}
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"message": "An error occured while uploading image to the bucket",
-			})
+			apierror.Abort(c, apierror.Internal(err))
 			return
 		}
 
-		err = godotenv.Load()
+		err = repos.Images.SetKey(image.UUID, key)
+
 		if err != nil {
-			log.Println(err)
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"message": "An error occured",
-			})
+			apierror.Abort(c, apierror.Internal(err))
 			return
 		}
 
-		url := strings.Join([]string{
-			os.Getenv("BUCKET_ENDPOINT") + "/" + os.Getenv("BUCKET_NAME"),
-			"/cloudbuddy/",
-			docId,
-			"-",
-			file.Filename,
-		}, "")
+		image.Key = key
+		ImagesCount += 1
 
-		err = db.UpdateById("images", docId, func(doc *document.Document) *document.Document {
-			doc.Set("url", url)
-			return doc
-		})
+		err = repos.Users.AddImage(user.UUID, image.UUID)
 
 		if err != nil {
-			if err == cl.ErrDocumentNotExist {
-				log.Println(err)
-				c.JSON(http.StatusInternalServerError, gin.H{
-					"message": "Image upload failed",
-				})
-				return
-			} else {
-				c.JSON(http.StatusInternalServerError, gin.H{
-					"message": "An error occured",
-				})
-				return
-			}
+			apierror.Abort(c, apierror.Internal(err))
+			return
 		}
 
-		ImagesCount += 1
-
-		err = db.UpdateById("users", userId, func(doc *document.Document) *document.Document {
-			interfaceSlice := doc.Get("images").([]interface{})
-			imageSlice, ok := pkg.ConvertInterfaceSliceToXSlice[string](interfaceSlice)
-			if !ok {
-				log.Printf("Appending image _id to user.images failed (image _id: %s), (user _id: %s)", docId, userId)
-				return doc
-			}
-
-			imageSlice = append(imageSlice, docId)
-			doc.Set("images", imageSlice)
-			return doc
-		})
-
+		err = resolveImageUrl(urls, image)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"message": "An error occured",
-			})
+			apierror.Abort(c, apierror.Internal(err))
 			return
 		}
 
-		c.JSON(http.StatusCreated, pkg.Image{
-			UUID:      doc.Get("_id").(string),
-			Title:     doc.Get("title").(string),
-			Url:       url,
-			UserId:    doc.Get("user_id").(string),
-			Likes:     doc.Get("likes").(int64),
-			CreatedAt: doc.Get("created_at").(time.Time),
-		})
+		c.JSON(http.StatusCreated, image)
 	}
 }
 
-func LikeImage(db *cl.DB) func(c *gin.Context) {
+// images only store where their object is kept, the url is resolved on every
+// response. images still being uploaded have no url yet.
+func resolveImageUrl(urls pkg.UrlResolver, image *pkg.Image) error {
+	if image.Key == "" {
+		return nil
+	}
+
+	url, err := urls.Resolve(image.Backend, image.Key)
+	if err != nil {
+		return err
+	}
+
+	image.Url = url
+	return nil
+}
+
+func LikeImage(repos *repository.Repositories) func(c *gin.Context) {
 	return func(c *gin.Context) {
 		id := c.Param("id")
-		err := db.UpdateById("images", id, func(doc *document.Document) *document.Document {
-			doc.Set("likes", doc.Get("likes").(int64)+1)
-			return doc
-		})
+		err := repos.Images.AddLikes(id, 1)
 
 		if err != nil {
-			if err == cl.ErrDocumentNotExist {
-				c.JSON(http.StatusNotFound, gin.H{
-					"message": "cloud not found :(",
-				})
+			if err == repository.ErrNotFound {
+				apierror.Abort(c, apierror.ErrImageNotFound)
 			} else {
-				c.JSON(http.StatusInternalServerError, gin.H{
-					"message": "wtf",
-				})
+				apierror.Abort(c, apierror.Internal(err))
 			}
 
 			return
@@ -266,23 +199,16 @@ func LikeImage(db *cl.DB) func(c *gin.Context) {
 	}
 }
 
-func DislikeImage(db *cl.DB) func(c *gin.Context) {
+func DislikeImage(repos *repository.Repositories) func(c *gin.Context) {
 	return func(c *gin.Context) {
 		id := c.Param("id")
-		err := db.UpdateById("images", id, func(doc *document.Document) *document.Document {
-			doc.Set("likes", doc.Get("likes").(int64)-1)
-			return doc
-		})
+		err := repos.Images.AddLikes(id, -1)
 
 		if err != nil {
-			if err == cl.ErrDocumentNotExist {
-				c.JSON(http.StatusNotFound, gin.H{
-					"message": "cloud not found :(",
-				})
+			if err == repository.ErrNotFound {
+				apierror.Abort(c, apierror.ErrImageNotFound)
 			} else {
-				c.JSON(http.StatusInternalServerError, gin.H{
-					"message": "wtf",
-				})
+				apierror.Abort(c, apierror.Internal(err))
 			}
 
 			return
@@ -292,72 +218,47 @@ func DislikeImage(db *cl.DB) func(c *gin.Context) {
 	}
 }
 
-func DeleteImage(db *cl.DB) func(c *gin.Context) {
+func DeleteImage(repos *repository.Repositories) func(c *gin.Context) {
 	return func(c *gin.Context) {
 		id := c.Param("id")
 
 		user, exists := c.Get("user")
 
 		if !exists {
-			c.JSON(http.StatusUnauthorized, gin.H{
-				"message": "unauthorized",
-			})
+			apierror.Abort(c, apierror.ErrUnauthorized)
 			return
 		}
 
-		userId, ok := user.(*document.Document).Get("_id").(string)
-
-		if !ok {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"message": "Something went wrong on the server",
-			})
+		image, err := repos.Images.FindById(id)
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
 			return
 		}
-
-		image, err := db.FindFirst(q.NewQuery("images").Where(q.Field("_id").Eq(id).And(q.Field("user_id").Eq(userId))))
 		if image == nil {
-			c.JSON(http.StatusNotFound, gin.H{
-				"message": "image not found",
-			})
+			apierror.Abort(c, apierror.ErrImageNotFound)
 			return
 		}
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"message": "something went wrong on the server",
-			})
+
+		// moderators may remove anyone's images
+		if !pkg.CanActOn(user.(*pkg.User), image.UserId, pkg.PermissionDeleteAnyImage) {
+			apierror.Abort(c, apierror.ErrForbidden.WithDetail("you are not allowed to delete this image"))
 			return
 		}
 
 		// TODO delete image from bucket
 
-		err = db.DeleteById("images", image.ObjectId())
+		err = repos.Images.Delete(image.UUID)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"message": "something went wrong on the server while deleting the image",
-			})
+			apierror.Abort(c, apierror.Internal(err))
 			return
 		}
 
 		ImagesCount -= 1
 
-		err = db.UpdateById("users", userId, func(doc *document.Document) *document.Document {
-			interfaceSlice := doc.Get("images").([]interface{})
-			imageSlice, ok := pkg.ConvertInterfaceSliceToXSlice[string](interfaceSlice)
-			if !ok {
-				log.Printf("Removing image _id from user.images failed (image _id: %s), (user _id: %s)", image.ObjectId(), userId)
-				return doc
-			}
-
-			imageSlice = pkg.RemoveByValue(imageSlice, image.ObjectId())
-			doc.Set("images", imageSlice)
-			return doc
-		})
+		err = repos.Users.RemoveImage(image.UserId, image.UUID)
 
 		if err != nil {
-			log.Println(err)
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"message": "An error occured",
-			})
+			apierror.Abort(c, apierror.Internal(err))
 			return
 		}
 
@@ -365,42 +266,48 @@ func DeleteImage(db *cl.DB) func(c *gin.Context) {
 	}
 }
 
-func ChangeImageTitle(db *cl.DB) func(c *gin.Context) {
+func ChangeImageTitle(repos *repository.Repositories) func(c *gin.Context) {
 	return func(c *gin.Context) {
 		id := c.Param("id")
-		title := c.PostForm("title")
+		// like on upload the title may be empty
+		var body struct {
+			Title string `form:"title" json:"title"`
+		}
+
+		if !bindRequest(c, &body) {
+			return
+		}
+
+		title := body.Title
 		user, exists := c.Get("user")
 
 		if !exists {
-			c.JSON(http.StatusUnauthorized, gin.H{
-				"message": "unauthorized",
-			})
+			apierror.Abort(c, apierror.ErrUnauthorized)
 			return
 		}
 
-		userId, ok := user.(*document.Document).Get("_id").(string)
+		image, err := repos.Images.FindById(id)
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+		if image == nil {
+			apierror.Abort(c, apierror.ErrImageNotFound)
+			return
+		}
 
-		if !ok {
-			c.JSON(http.StatusUnauthorized, gin.H{
-				"message": "unauthorized",
-			})
+		if !pkg.CanActOn(user.(*pkg.User), image.UserId, pkg.PermissionEditAnyImage) {
+			apierror.Abort(c, apierror.ErrForbidden.WithDetail("you are not allowed to change this image"))
 			return
 		}
 
-		err := db.UpdateFunc(q.NewQuery("images").Where(q.Field("_id").Eq(id).And(q.Field("user_id").Eq(userId))), func(doc *document.Document) *document.Document {
-			doc.Set("title", title)
-			return doc
-		})
+		err = repos.Images.SetTitle(id, title)
 
 		if err != nil {
-			if err == cl.ErrDocumentNotExist {
-				c.JSON(http.StatusNotFound, gin.H{
-					"message": "cloud not found :(",
-				})
+			if err == repository.ErrNotFound {
+				apierror.Abort(c, apierror.ErrImageNotFound)
 			} else {
-				c.JSON(http.StatusInternalServerError, gin.H{
-					"message": "wtf",
-				})
+				apierror.Abort(c, apierror.Internal(err))
 			}
 
 			return
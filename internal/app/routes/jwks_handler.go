@@ -0,0 +1,19 @@
+package routes
+
+import (
+	"cloudbuddy/internal/pkg"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// publishes the public keys access tokens are signed with so other services
+// can verify them
+func GetJwks(keyRing *pkg.KeyRing) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		c.Header("Cache-Control", "public, max-age=300")
+		c.JSON(http.StatusOK, gin.H{
+			"keys": keyRing.Jwks(),
+		})
+	}
+}
@@ -0,0 +1,263 @@
+package routes
+
+import (
+	"cloudbuddy/internal/app/apierror"
+	"cloudbuddy/internal/app/repository"
+	"cloudbuddy/internal/pkg"
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/oauth2"
+)
+
+// how long the user has to complete the login at the identity provider
+const oidcStateTTL = 10 * time.Minute
+
+// binds a login to the browser that started it, holds the hash of the state.
+// without it anyone could send a victim the callback url of their own login.
+const (
+	oidcStateCookie     = "OidcState"
+	oidcStateCookiePath = "/v1/auth/oidc"
+)
+
+var usernameUnsafeChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+
+// redirects to the identity provider. when the request is authenticated the
+// resulting identity is linked to the current user instead of signing in.
+func StartOidc(repos *repository.Repositories, cfg *pkg.Config) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		provider, err := pkg.LoadOidcProvider(c.Request.Context(), cfg.Oidc, c.Param("provider"))
+		if err != nil {
+			if err == pkg.ErrUnknownOidcProvider {
+				apierror.Abort(c, apierror.ErrUnknownOidcProvider)
+				return
+			}
+
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		state, err := pkg.RandomToken(32)
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+		nonce, err := pkg.RandomToken(32)
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+		verifier := oauth2.GenerateVerifier()
+
+		userId := ""
+		if user, exists := c.Get("user"); exists {
+			userId = user.(*pkg.User).UUID
+		}
+
+		err = repos.OidcStates.Create(&pkg.OidcState{
+			Provider:  provider.Name,
+			State:     state,
+			Nonce:     nonce,
+			Verifier:  verifier,
+			UserId:    userId,
+			ExpiresAt: time.Now().Add(oidcStateTTL),
+			CreatedAt: time.Now(),
+		})
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		c.SetSameSite(http.SameSiteLaxMode)
+		c.SetCookie(oidcStateCookie, pkg.HashToken(state), int(oidcStateTTL.Seconds()), oidcStateCookiePath, cfg.Cookie.Domain, cfg.Cookie.Secure, true)
+
+		c.Redirect(http.StatusFound, provider.AuthCodeUrl(state, nonce, verifier))
+	}
+}
+
+// handles the redirect back from the identity provider. the id token is
+// verified, then the matching user is signed in, linked or created.
+func OidcCallback(repos *repository.Repositories, cfg *pkg.Config, keyRing *pkg.KeyRing) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		if errorCode := c.Query("error"); errorCode != "" {
+			apierror.Abort(c, apierror.ErrIdentityProvider.WithDetail("identity provider returned an error: "+errorCode))
+			return
+		}
+
+		state := c.Query("state")
+		code := c.Query("code")
+		if state == "" || code == "" {
+			apierror.Abort(c, apierror.ErrBadRequest.WithDetail("state and code are required"))
+			return
+		}
+
+		// the state has to come back to the browser it was handed to
+		stateHash, _ := c.Cookie(oidcStateCookie)
+		c.SetSameSite(http.SameSiteLaxMode)
+		c.SetCookie(oidcStateCookie, "", -1, oidcStateCookiePath, cfg.Cookie.Domain, cfg.Cookie.Secure, true)
+		if subtle.ConstantTimeCompare([]byte(stateHash), []byte(pkg.HashToken(state))) != 1 {
+			apierror.Abort(c, apierror.ErrOidcStateInvalid)
+			return
+		}
+
+		provider, err := pkg.LoadOidcProvider(c.Request.Context(), cfg.Oidc, c.Param("provider"))
+		if err != nil {
+			if err == pkg.ErrUnknownOidcProvider {
+				apierror.Abort(c, apierror.ErrUnknownOidcProvider)
+				return
+			}
+
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		// states are single use
+		stateRecord, err := repos.OidcStates.Take(provider.Name, state)
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		if stateRecord == nil || time.Since(stateRecord.CreatedAt) > oidcStateTTL {
+			apierror.Abort(c, apierror.ErrOidcStateInvalid)
+			return
+		}
+
+		claims, err := provider.Exchange(c.Request.Context(), code, stateRecord.Verifier, stateRecord.Nonce)
+		if err != nil {
+			log.Printf("oidc exchange with %s failed: %v", provider.Name, err)
+			apierror.Abort(c, apierror.ErrIdentityProvider)
+			return
+		}
+
+		linkUserId := stateRecord.UserId
+
+		identity, err := repos.Identities.FindBySubject(provider.Name, claims.Subject)
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		var userId string
+
+		switch {
+		case identity != nil:
+			userId = identity.UserId
+			if linkUserId != "" && linkUserId != userId {
+				apierror.Abort(c, apierror.ErrIdentityLinked)
+				return
+			}
+		case linkUserId != "":
+			userId = linkUserId
+		default:
+			userId, err = createOidcUser(repos, claims)
+			if err != nil {
+				apierror.Abort(c, apierror.Internal(err))
+				return
+			}
+		}
+
+		if identity == nil {
+			err = repos.Identities.Create(&pkg.Identity{
+				UserId:    userId,
+				Provider:  provider.Name,
+				Subject:   claims.Subject,
+				Email:     claims.Email,
+				CreatedAt: time.Now(),
+			})
+			if err != nil {
+				apierror.Abort(c, apierror.Internal(err))
+				return
+			}
+		}
+
+		user, err := repos.Users.FindById(userId)
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		if user == nil {
+			apierror.Abort(c, apierror.ErrUnauthorized.WithDetail("user corresponding to identity not found"))
+			return
+		}
+
+		signinOrChallenge(c, repos, cfg, keyRing, user)
+	}
+}
+
+// creates a user without a passphrase for a first-time social login. the
+// username is derived from the provider's claims and made unique.
+func createOidcUser(repos *repository.Repositories, claims *pkg.OidcClaims) (string, error) {
+	base := claims.PreferredUsername
+	if base == "" {
+		base, _, _ = strings.Cut(claims.Email, "@")
+	}
+	base = strings.ToLower(usernameUnsafeChars.ReplaceAllString(base, ""))
+	if len(base) > pkg.UsernameMaxLength-5 {
+		base = base[:pkg.UsernameMaxLength-5]
+	}
+
+	username, key, err := pkg.NormalizeUsername(base)
+	if err != nil {
+		base = "user"
+	}
+
+	newUser := &pkg.User{
+		Fullname:  claims.Name,
+		Role:      pkg.RoleUser,
+		Images:    []string{},
+		CreatedAt: time.Now(),
+	}
+	// only take over addresses the provider vouches for, they can be used
+	// to reset the passphrase
+	if email, ok := pkg.NormalizeEmail(claims.Email); ok && claims.EmailVerified {
+		newUser.Email = email
+	}
+
+	for i := 0; ; i++ {
+		if err == nil {
+			newUser.Username, newUser.UsernameKey = username, key
+			err = repos.Users.Create(newUser)
+			if err == nil {
+				break
+			}
+			if err != repository.ErrUsernameTaken {
+				return "", err
+			}
+		}
+		if i == 10 {
+			return "", errors.New("couldn't find a free username")
+		}
+
+		suffix, tokenErr := pkg.RandomToken(3)
+		if tokenErr != nil {
+			return "", tokenErr
+		}
+		username, key, err = pkg.NormalizeUsername(base + "-" + strings.ToLower(usernameUnsafeChars.ReplaceAllString(suffix, "")))
+	}
+
+	userId := newUser.UUID
+
+	// verified like a mailed link would be, an address someone else
+	// verified before stays theirs
+	if newUser.Email != "" {
+		verified, err := repos.Users.VerifyEmail(userId, newUser.Email)
+		if err != nil {
+			return "", err
+		}
+		if !verified {
+			if err := repos.Users.SetEmail(userId, ""); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return userId, nil
+}
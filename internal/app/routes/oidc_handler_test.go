@@ -0,0 +1,322 @@
+package routes
+
+import (
+	"cloudbuddy/internal/pkg"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const testClientId = "cloudbuddy-test"
+
+// an identity provider with discovery, a jwks and a token endpoint. logins
+// are authorized directly with authorize instead of a consent page.
+type mockIssuer struct {
+	t      *testing.T
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	// signs id tokens when set, a key missing from the jwks
+	signWith *rsa.PrivateKey
+
+	lock      sync.Mutex
+	codes     map[string]mockAuthorization
+	exchanges int
+}
+
+type mockAuthorization struct {
+	challenge string
+	nonce     string
+	claims    jwt.MapClaims
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issuer := &mockIssuer{t: t, key: key, codes: map[string]mockAuthorization{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", issuer.discovery)
+	mux.HandleFunc("/jwks", issuer.jwks)
+	mux.HandleFunc("/token", issuer.token)
+	issuer.server = httptest.NewServer(mux)
+	t.Cleanup(issuer.server.Close)
+
+	return issuer
+}
+
+func (m *mockIssuer) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]any{
+		"issuer":                                m.server.URL,
+		"authorization_endpoint":                m.server.URL + "/authorize",
+		"token_endpoint":                        m.server.URL + "/token",
+		"jwks_uri":                              m.server.URL + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (m *mockIssuer) jwks(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": "mock",
+			"n":   base64.RawURLEncoding.EncodeToString(m.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(m.key.E)).Bytes()),
+		}},
+	})
+}
+
+// redeems a code once, the pkce verifier has to match the challenge of the
+// authorization
+func (m *mockIssuer) token(w http.ResponseWriter, r *http.Request) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.exchanges++
+
+	authorization, ok := m.codes[r.FormValue("code")]
+	delete(m.codes, r.FormValue("code"))
+
+	verifierHash := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(verifierHash[:]) != authorization.challenge {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	claims := jwt.MapClaims{
+		"iss":   m.server.URL,
+		"aud":   testClientId,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": authorization.nonce,
+	}
+	for name, value := range authorization.claims {
+		claims[name] = value
+	}
+
+	signWith := m.key
+	if m.signWith != nil {
+		signWith = m.signWith
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "mock"
+	idToken, err := token.SignedString(signWith)
+	if err != nil {
+		m.t.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"access_token": "mock-access-token",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+// what the provider does when the user consents, returns the code the
+// browser is redirected back with
+func (m *mockIssuer) authorize(authUrl string, claims jwt.MapClaims) (string, string) {
+	m.t.Helper()
+
+	parsed, err := url.Parse(authUrl)
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	query := parsed.Query()
+	if !strings.HasPrefix(authUrl, m.server.URL+"/authorize") || query.Get("code_challenge_method") != "S256" {
+		m.t.Fatalf("unexpected authorization url %s", authUrl)
+	}
+
+	code, err := pkg.RandomToken(16)
+	if err != nil {
+		m.t.Fatal(err)
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.codes[code] = mockAuthorization{challenge: query.Get("code_challenge"), nonce: query.Get("nonce"), claims: claims}
+
+	return query.Get("state"), code
+}
+
+type oidcTest struct {
+	t        *testing.T
+	router   *gin.Engine
+	issuer   *mockIssuer
+	provider string
+}
+
+func newOidcTest(t *testing.T) *oidcTest {
+	repos, cfg := newTestDeps(t)
+	issuer := newMockIssuer(t)
+
+	// providers are cached by name for the whole process
+	provider := strings.ToLower(t.Name())
+	cfg.Oidc[provider] = pkg.OidcConfig{
+		Issuer:      issuer.server.URL,
+		ClientId:    testClientId,
+		RedirectUrl: "https://cloudbuddy.test/v1/auth/oidc/" + provider + "/callback",
+	}
+
+	router := newTestRouter()
+	router.GET("/v1/auth/oidc/:provider", StartOidc(repos, cfg))
+	router.GET("/v1/auth/oidc/:provider/callback", OidcCallback(repos, cfg, newTestKeyRing(t)))
+
+	return &oidcTest{t: t, router: router, issuer: issuer, provider: provider}
+}
+
+// starts a login, returns the authorization url and the state cookie
+func (o *oidcTest) start() (string, *http.Cookie) {
+	o.t.Helper()
+
+	rec := httptest.NewRecorder()
+	o.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/auth/oidc/"+o.provider, nil))
+	if rec.Code != http.StatusFound {
+		o.t.Fatalf("start: want 302, got %d %s", rec.Code, rec.Body)
+	}
+
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == oidcStateCookie {
+			if !cookie.HttpOnly {
+				o.t.Fatal("state cookie is readable by scripts")
+			}
+			return rec.Header().Get("Location"), cookie
+		}
+	}
+
+	o.t.Fatal("start didn't set the state cookie")
+	return "", nil
+}
+
+func (o *oidcTest) callback(state string, code string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	o.t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/auth/oidc/"+o.provider+"/callback?"+url.Values{"state": {state}, "code": {code}}.Encode(), nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	o.router.ServeHTTP(rec, req)
+
+	return rec
+}
+
+func aliceClaims() jwt.MapClaims {
+	return jwt.MapClaims{
+		"sub":                "alice-subject",
+		"preferred_username": "Alice",
+		"email":              "alice@example.com",
+		"email_verified":     true,
+	}
+}
+
+func TestOidcSigninCreatesUser(t *testing.T) {
+	o := newOidcTest(t)
+
+	authUrl, cookie := o.start()
+	state, code := o.issuer.authorize(authUrl, aliceClaims())
+
+	rec := o.callback(state, code, cookie)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("callback: want 201, got %d %s", rec.Code, rec.Body)
+	}
+
+	var body struct {
+		Username string `json:"username"`
+		Token    string `json:"token"`
+	}
+	decodeJson(t, rec, &body)
+	if body.Username != "alice" || body.Token == "" {
+		t.Fatalf("unexpected signin response %s", rec.Body)
+	}
+
+	// the second login finds the identity instead of creating a user
+	authUrl, cookie = o.start()
+	state, code = o.issuer.authorize(authUrl, aliceClaims())
+	rec = o.callback(state, code, cookie)
+	decodeJson(t, rec, &body)
+	if rec.Code != http.StatusCreated || body.Username != "alice" {
+		t.Fatalf("second signin: %d %s", rec.Code, rec.Body)
+	}
+}
+
+// login csrf: an attacker starts a login and hands the victim the callback
+// url, the victim's browser doesn't have the attacker's state cookie
+func TestOidcCallbackRequiresStateCookie(t *testing.T) {
+	o := newOidcTest(t)
+
+	authUrl, _ := o.start()
+	state, code := o.issuer.authorize(authUrl, aliceClaims())
+
+	rec := o.callback(state, code, nil)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "oidc_state_invalid") {
+		t.Fatalf("want oidc_state_invalid, got %d %s", rec.Code, rec.Body)
+	}
+
+	// the victim's own login in progress doesn't help either
+	_, victimCookie := o.start()
+	rec = o.callback(state, code, victimCookie)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("want 400 for another login's cookie, got %d", rec.Code)
+	}
+
+	if o.issuer.exchanges != 0 {
+		t.Fatalf("the code was exchanged %d times", o.issuer.exchanges)
+	}
+}
+
+func TestOidcStateIsSingleUse(t *testing.T) {
+	o := newOidcTest(t)
+
+	authUrl, cookie := o.start()
+	state, code := o.issuer.authorize(authUrl, aliceClaims())
+
+	if rec := o.callback(state, code, cookie); rec.Code != http.StatusCreated {
+		t.Fatalf("callback: want 201, got %d %s", rec.Code, rec.Body)
+	}
+	if rec := o.callback(state, code, cookie); rec.Code != http.StatusBadRequest {
+		t.Fatalf("replayed callback: want 400, got %d", rec.Code)
+	}
+}
+
+func TestOidcCallbackRejectsTokenNotSignedByIssuer(t *testing.T) {
+	o := newOidcTest(t)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.issuer.signWith = key
+
+	authUrl, cookie := o.start()
+	state, code := o.issuer.authorize(authUrl, aliceClaims())
+
+	if rec := o.callback(state, code, cookie); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("want 401, got %d %s", rec.Code, rec.Body)
+	}
+}
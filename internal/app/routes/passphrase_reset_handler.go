@@ -0,0 +1,174 @@
+package routes
+
+import (
+	"cloudbuddy/internal/app/apierror"
+	"cloudbuddy/internal/app/repository"
+	"cloudbuddy/internal/pkg"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const passphraseResetTTL = time.Hour
+
+// mails a passphrase reset link to the account with the given email. the
+// response is the same whether or not the account exists.
+func ForgotPassphrase(repos *repository.Repositories, cfg *pkg.Config) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var body struct {
+			Email string `form:"email" json:"email" binding:"required"`
+		}
+
+		if !bindRequest(c, &body) {
+			return
+		}
+
+		email, ok := pkg.NormalizeEmail(body.Email)
+		if !ok {
+			validationFailed(c, fieldError{Field: "email", Code: codeInvalid})
+			return
+		}
+
+		mailer, err := pkg.NewMailer(cfg.Mail)
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		// only verified addresses receive reset links
+		user, err := repos.Users.FindByVerifiedEmail(email)
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		if user != nil {
+			// mail is sent in the background so response times don't reveal
+			// whether the account exists
+			go sendPassphraseReset(repos, cfg, mailer, user.UUID, email)
+		}
+
+		c.JSON(http.StatusAccepted, gin.H{
+			"message": "if an account with that email exists, a reset link has been sent",
+		})
+	}
+}
+
+func sendPassphraseReset(repos *repository.Repositories, cfg *pkg.Config, mailer pkg.Mailer, userId string, email string) {
+	token, err := pkg.RandomToken(32)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	err = repos.PassphraseResets.Create(&pkg.PassphraseReset{
+		UserId:    userId,
+		TokenHash: pkg.HashToken(token),
+		ExpiresAt: time.Now().Add(passphraseResetTTL),
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	body := "Someone asked to reset the passphrase of your CloudBuddy account.\n\n" +
+		"Use this link within an hour to choose a new one:\n" +
+		pkg.TokenLink(cfg.Mail.PassphraseResetUrl, token) + "\n\n" +
+		"If this wasn't you, you can ignore this email."
+
+	err = mailer.Send(email, "Reset your CloudBuddy passphrase", body)
+	if err != nil {
+		log.Printf("Sending passphrase reset mail failed (user _id: %s): %v", userId, err)
+	}
+}
+
+// sets a new passphrase using a token from ForgotPassphrase. the token and
+// every other pending reset of the user are used up and, like a passphrase
+// change, every session and api key of the user is revoked.
+func ResetPassphrase(repos *repository.Repositories, cfg *pkg.Config) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var body struct {
+			Token      string `form:"token" json:"token" binding:"required"`
+			Passphrase string `form:"passphrase" json:"passphrase" binding:"required"`
+		}
+
+		if !bindRequest(c, &body) {
+			return
+		}
+
+		reset, err := repos.PassphraseResets.FindByTokenHash(pkg.HashToken(body.Token))
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		if reset == nil {
+			apierror.Abort(c, apierror.ErrResetTokenInvalid)
+			return
+		}
+
+		user, err := repos.Users.FindById(reset.UserId)
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		if user == nil {
+			apierror.Abort(c, apierror.ErrResetTokenInvalid)
+			return
+		}
+
+		// checked before the token is used up so the user can try again
+		if !checkPassphrasePolicy(c, cfg, "passphrase", body.Passphrase, user.Username) {
+			return
+		}
+
+		// mark the token used first so it can't be redeemed twice, resets
+		// requested before are used up with it
+		consumed, err := repos.PassphraseResets.Use(reset.UUID, time.Now())
+
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		if !consumed {
+			apierror.Abort(c, apierror.ErrResetTokenInvalid)
+			return
+		}
+
+		hashedPassphrase, err := pkg.HashPassword(cfg.Argon2, body.Passphrase)
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		userId := user.UUID
+
+		_, err = repos.Users.ChangePassphrase(userId, hashedPassphrase)
+
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		err = repos.Sessions.RevokeByUser(userId, "")
+
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		err = repos.ApiKeys.DeleteByUser(userId)
+
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		c.JSON(http.StatusNoContent, nil)
+	}
+}
@@ -0,0 +1,88 @@
+package routes
+
+import (
+	"cloudbuddy/internal/app/apierror"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+// request bodies are bound into structs tagged for both json and form
+// encoding, so every endpoint takes either. violated `binding` rules are
+// reported per field in the errors member of a validation_failed problem,
+// e.g. {"errors":[{"field":"username","code":"required"}]}, with the rule's
+// tag as the code.
+type fieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+const (
+	codeRequired    = "required"
+	codeMalformed   = "malformed"
+	codeInvalidType = "invalid_type"
+	codeInvalid     = "invalid"
+	codeOneOf       = "oneof"
+)
+
+func init() {
+	// report fields by the name clients send them with
+	if v, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		v.RegisterTagNameFunc(func(field reflect.StructField) string {
+			for _, tag := range []string{"json", "form"} {
+				name, _, _ := strings.Cut(field.Tag.Get(tag), ",")
+				if name != "" && name != "-" {
+					return name
+				}
+			}
+			return field.Name
+		})
+	}
+}
+
+// binds the body into req according to its content type and responds with
+// the field errors if that fails
+func bindRequest(c *gin.Context, req interface{}) bool {
+	err := c.ShouldBind(req)
+	if err == nil {
+		return true
+	}
+
+	var validationErrs validator.ValidationErrors
+	var typeErr *json.UnmarshalTypeError
+
+	switch {
+	case errors.As(err, &validationErrs):
+		var errs []fieldError
+		for _, fe := range validationErrs {
+			errs = append(errs, fieldError{Field: fieldPath(fe), Code: fe.Tag()})
+		}
+		validationFailed(c, errs...)
+	case errors.As(err, &typeErr):
+		validationFailed(c, fieldError{Field: typeErr.Field, Code: codeInvalidType})
+	default:
+		validationFailed(c, fieldError{Code: codeMalformed, Message: err.Error()})
+	}
+
+	return false
+}
+
+// the field's path below the request struct, e.g. scopes[1]
+func fieldPath(fe validator.FieldError) string {
+	_, path, found := strings.Cut(fe.Namespace(), ".")
+	if !found {
+		return fe.Field()
+	}
+
+	return path
+}
+
+func validationFailed(c *gin.Context, errs ...fieldError) {
+	apierror.Abort(c, apierror.ErrValidation.WithErrors(errs))
+}
@@ -0,0 +1,103 @@
+package routes
+
+import (
+	"bytes"
+	"cloudbuddy/internal/app/middleware"
+	"cloudbuddy/internal/app/repository"
+	"cloudbuddy/internal/pkg"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// everything is kept in memory
+func newTestDeps(t *testing.T) (*repository.Repositories, *pkg.Config) {
+	t.Helper()
+
+	cfg := pkg.DefaultConfig()
+	cfg.Argon2.Memory = 1024
+	cfg.Argon2.Iterations = 1
+
+	return repository.NewMemoryRepositories(), &cfg
+}
+
+// a key ring with a fresh Ed25519 key of its own
+func newTestKeyRing(t *testing.T) *pkg.KeyRing {
+	t.Helper()
+
+	dir := t.TempDir()
+	if _, err := pkg.GenerateSigningKey(dir, pkg.SigningAlgEdDSA); err != nil {
+		t.Fatal(err)
+	}
+
+	keyRing, err := pkg.LoadKeyRing(pkg.JwtConfig{KeysDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return keyRing
+}
+
+// a router which writes aborted errors like the server does
+func newTestRouter() *gin.Engine {
+	router := gin.New()
+	router.Use(middleware.ErrorHandler())
+
+	return router
+}
+
+// sends body as json, or no body when it is nil
+func doJson(t *testing.T, router http.Handler, method string, path string, body any) *httptest.ResponseRecorder {
+	t.Helper()
+
+	return doAuthorizedJson(t, router, method, path, "", body)
+}
+
+// like doJson with the access token as bearer token
+func doAuthorizedJson(t *testing.T, router http.Handler, method string, path string, token string, body any) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var reader *bytes.Reader
+	if body == nil {
+		reader = bytes.NewReader(nil)
+	} else {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	req := httptest.NewRequest(method, path, reader)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	return rec
+}
+
+func decodeJson(t *testing.T, rec *httptest.ResponseRecorder, v any) {
+	t.Helper()
+
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body.String(), err)
+	}
+}
+
+// makes user the authenticated user of every request
+func asUser(user *pkg.User) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("user", user)
+		c.Next()
+	}
+}
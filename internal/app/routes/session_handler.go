@@ -0,0 +1,322 @@
+package routes
+
+import (
+	"cloudbuddy/internal/app/apierror"
+	"cloudbuddy/internal/app/repository"
+	"cloudbuddy/internal/pkg"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const refreshTokenCookie = "RefreshToken"
+
+// creates a new session for the user and returns its id with the first
+// refresh token of the session. the client's user agent and ip are recorded
+// so the user can tell their sessions apart.
+func createSession(repos *repository.Repositories, c *gin.Context, userId string) (string, string, error) {
+	session := &pkg.Session{
+		UserId:     userId,
+		UsedHashes: []string{},
+		UserAgent:  c.Request.UserAgent(),
+		IP:         c.ClientIP(),
+		ExpiresAt:  time.Now().Add(pkg.RefreshTokenTTL),
+		LastUsedAt: time.Now(),
+		CreatedAt:  time.Now(),
+	}
+
+	err := repos.Sessions.Create(session)
+	if err != nil {
+		return "", "", err
+	}
+
+	refreshToken, hash, err := pkg.GenerateRefreshToken(session.UUID)
+	if err != nil {
+		return "", "", err
+	}
+
+	err = repos.Sessions.SetTokenHash(session.UUID, hash)
+	if err != nil {
+		return "", "", err
+	}
+
+	return session.UUID, refreshToken, nil
+}
+
+// sets the access and refresh token cookies together with a readable csrf
+// token cookie which browser clients echo back in the X-CSRF-Token header.
+// the refresh cookie is left alone when refreshToken is empty.
+func setAuthCookies(c *gin.Context, cfg *pkg.Config, accessToken string, refreshToken string) error {
+	options := cfg.Cookie
+
+	csrfToken, err := pkg.RandomToken(32)
+	if err != nil {
+		return err
+	}
+
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie("Authorization", accessToken, int(pkg.AccessTokenTTL.Seconds()), "", options.Domain, options.Secure, true)
+	if refreshToken != "" {
+		c.SetCookie(refreshTokenCookie, refreshToken, int(pkg.RefreshTokenTTL.Seconds()), "/v1/auth", options.Domain, options.Secure, true)
+	}
+	c.SetCookie(pkg.CsrfCookie, csrfToken, int(pkg.RefreshTokenTTL.Seconds()), "", options.Domain, options.Secure, false)
+
+	return nil
+}
+
+func clearAuthCookies(c *gin.Context, cfg *pkg.Config) {
+	options := cfg.Cookie
+
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie("Authorization", "", -1, "", options.Domain, options.Secure, true)
+	c.SetCookie(refreshTokenCookie, "", -1, "/v1/auth", options.Domain, options.Secure, true)
+	c.SetCookie(pkg.CsrfCookie, "", -1, "", options.Domain, options.Secure, false)
+}
+
+// the refresh token is read from the body, falling back to the cookie.
+// the cookie is only accepted along with a matching csrf token.
+func readRefreshToken(c *gin.Context) string {
+	var body struct {
+		RefreshToken string `form:"refresh_token" json:"refresh_token"`
+	}
+
+	if c.ShouldBind(&body) == nil && body.RefreshToken != "" {
+		return body.RefreshToken
+	}
+
+	cookie, err := c.Cookie(refreshTokenCookie)
+	if err != nil {
+		return ""
+	}
+
+	csrfCookie, _ := c.Cookie(pkg.CsrfCookie)
+	if !pkg.ValidCsrfToken(c.GetHeader(pkg.CsrfHeader), csrfCookie) {
+		return ""
+	}
+
+	return cookie
+}
+
+// exchanges a refresh token for a new access token and a new refresh token.
+// presenting a refresh token that was already rotated out means it leaked,
+// in that case the whole session is revoked.
+func Refresh(repos *repository.Repositories, cfg *pkg.Config, keyRing *pkg.KeyRing) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		refreshToken := readRefreshToken(c)
+		if refreshToken == "" {
+			validationFailed(c, fieldError{Field: "refresh_token", Code: codeRequired})
+			return
+		}
+
+		sessionId, hash, err := pkg.ParseRefreshToken(refreshToken)
+		if err != nil {
+			apierror.Abort(c, apierror.ErrRefreshTokenInvalid)
+			return
+		}
+
+		newRefreshToken, newHash, err := pkg.GenerateRefreshToken(sessionId)
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		userId, rotation, err := repos.Sessions.Rotate(sessionId, hash, newHash, c.Request.UserAgent(), c.ClientIP())
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		if rotation == repository.RotationReused {
+			log.Printf("Refresh token reuse detected, session revoked (session _id: %s)", sessionId)
+		}
+
+		if rotation != repository.Rotated {
+			clearAuthCookies(c, cfg)
+			apierror.Abort(c, apierror.ErrRefreshTokenInvalid)
+			return
+		}
+
+		user, err := repos.Users.FindById(userId)
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		if user == nil {
+			apierror.Abort(c, apierror.ErrUnauthorized.WithDetail("user corresponding to token not found"))
+			return
+		}
+
+		token, err := pkg.GenerateJwtToken(keyRing, cfg.Jwt, userId, user.TokenVersion, sessionId)
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		err = setAuthCookies(c, cfg, token, newRefreshToken)
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"token":         token,
+			"refresh_token": newRefreshToken,
+		})
+	}
+}
+
+// revokes the session the refresh token belongs to
+func Signout(repos *repository.Repositories, cfg *pkg.Config, keyRing *pkg.KeyRing) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		refreshToken := readRefreshToken(c)
+		if refreshToken == "" {
+			validationFailed(c, fieldError{Field: "refresh_token", Code: codeRequired})
+			return
+		}
+
+		sessionId, hash, err := pkg.ParseRefreshToken(refreshToken)
+		if err != nil {
+			apierror.Abort(c, apierror.ErrRefreshTokenInvalid)
+			return
+		}
+
+		err = repos.Sessions.RevokeByTokenHash(sessionId, hash)
+
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		err = revokeAccessToken(repos, cfg, keyRing, c)
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		clearAuthCookies(c, cfg)
+
+		c.JSON(http.StatusNoContent, nil)
+	}
+}
+
+// revokes the access token sent along with the request, if there is a valid
+// one, so it can't be used for the rest of its lifetime. the entry expires
+// together with the token.
+func revokeAccessToken(repos *repository.Repositories, cfg *pkg.Config, keyRing *pkg.KeyRing, c *gin.Context) error {
+	tokenString := ""
+	if scheme, token, _ := strings.Cut(c.GetHeader("Authorization"), " "); strings.EqualFold(scheme, "bearer") {
+		tokenString = token
+	} else if cookie, err := c.Cookie("Authorization"); err == nil {
+		tokenString = cookie
+	}
+
+	claims, err := pkg.ParseAccessToken(keyRing, cfg.Jwt, tokenString)
+	if err != nil {
+		return nil
+	}
+
+	return repos.RevokedTokens.Create(&pkg.RevokedToken{
+		Jti:       claims.ID,
+		UserId:    claims.Subject,
+		ExpiresAt: claims.ExpiresAt.Time.Add(pkg.TokenLeeway),
+		CreatedAt: time.Now(),
+	})
+}
+
+// lists the active sessions of the authenticated user, most recently used first
+func GetSessions(repos *repository.Repositories) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		user, exists := c.Get("user")
+
+		if !exists {
+			apierror.Abort(c, apierror.ErrUnauthorized)
+			return
+		}
+
+		userId := user.(*pkg.User).UUID
+
+		active, err := repos.Sessions.ListActive(userId)
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		currentSessionId := c.GetString("session_id")
+		var sessions []gin.H = []gin.H{}
+
+		for _, session := range active {
+			sessions = append(sessions, gin.H{
+				"uuid":         session.UUID,
+				"user_agent":   session.UserAgent,
+				"ip":           session.IP,
+				"current":      session.UUID == currentSessionId,
+				"expires_at":   session.ExpiresAt,
+				"last_used_at": session.LastUsedAt,
+				"created_at":   session.CreatedAt,
+			})
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"sessions": sessions,
+		})
+	}
+}
+
+// revokes a single session of the authenticated user
+func DeleteSession(repos *repository.Repositories, cfg *pkg.Config) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+		user, exists := c.Get("user")
+
+		if !exists {
+			apierror.Abort(c, apierror.ErrUnauthorized)
+			return
+		}
+
+		userId := user.(*pkg.User).UUID
+
+		revoked, err := repos.Sessions.Revoke(id, userId)
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		if !revoked {
+			apierror.Abort(c, apierror.ErrSessionNotFound)
+			return
+		}
+
+		if id == c.GetString("session_id") {
+			clearAuthCookies(c, cfg)
+		}
+
+		c.JSON(http.StatusNoContent, nil)
+	}
+}
+
+// signs the user out everywhere except the session making the request
+func DeleteOtherSessions(repos *repository.Repositories) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		user, exists := c.Get("user")
+
+		if !exists {
+			apierror.Abort(c, apierror.ErrUnauthorized)
+			return
+		}
+
+		userId := user.(*pkg.User).UUID
+
+		err := repos.Sessions.RevokeByUser(userId, c.GetString("session_id"))
+
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		c.JSON(http.StatusNoContent, nil)
+	}
+}
@@ -0,0 +1,95 @@
+package routes
+
+import (
+	"net/http"
+	"testing"
+)
+
+func refresh(t *testing.T, router http.Handler, refreshToken string) (int, tokens) {
+	t.Helper()
+
+	rec := doJson(t, router, http.MethodPost, "/v1/auth/refresh", map[string]string{"refresh_token": refreshToken})
+
+	var issued tokens
+	if rec.Code == http.StatusOK {
+		decodeJson(t, rec, &issued)
+	}
+	return rec.Code, issued
+}
+
+func TestRefreshRotatesTokens(t *testing.T) {
+	repos, cfg := newTestDeps(t)
+	router := newAuthRouter(repos, cfg, newTestKeyRing(t))
+	issued := signup(t, router, "alice", "correct horse battery staple")
+
+	code, rotated := refresh(t, router, issued.RefreshToken)
+	if code != http.StatusOK || rotated.RefreshToken == issued.RefreshToken {
+		t.Fatalf("refresh: want 200 and a new refresh token, got %d", code)
+	}
+	if code := getSessions(t, router, rotated.Token); code != http.StatusOK {
+		t.Fatalf("refreshed access token: want 200, got %d", code)
+	}
+
+	code, again := refresh(t, router, rotated.RefreshToken)
+	if code != http.StatusOK {
+		t.Fatalf("second refresh: want 200, got %d", code)
+	}
+
+	if code, _ := refresh(t, router, "not a refresh token"); code != http.StatusUnauthorized {
+		t.Fatalf("malformed refresh token: want 401, got %d", code)
+	}
+
+	if code := getSessions(t, router, again.Token); code != http.StatusOK {
+		t.Fatalf("access token after two refreshes: want 200, got %d", code)
+	}
+}
+
+// a refresh token used twice was stolen, either by whoever used it first or
+// second. the whole session is revoked.
+func TestRefreshTokenReuseRevokesSession(t *testing.T) {
+	repos, cfg := newTestDeps(t)
+	router := newAuthRouter(repos, cfg, newTestKeyRing(t))
+	issued := signup(t, router, "alice", "correct horse battery staple")
+
+	code, rotated := refresh(t, router, issued.RefreshToken)
+	if code != http.StatusOK {
+		t.Fatalf("refresh: want 200, got %d", code)
+	}
+
+	if code, _ := refresh(t, router, issued.RefreshToken); code != http.StatusUnauthorized {
+		t.Fatalf("reused refresh token: want 401, got %d", code)
+	}
+
+	if code, _ := refresh(t, router, rotated.RefreshToken); code != http.StatusUnauthorized {
+		t.Fatalf("refresh token of the revoked session: want 401, got %d", code)
+	}
+	if code := getSessions(t, router, rotated.Token); code != http.StatusUnauthorized {
+		t.Fatalf("access token of the revoked session: want 401, got %d", code)
+	}
+
+	// other sessions are left alone
+	rec := signin(t, router, "alice", "correct horse battery staple")
+	var other tokens
+	decodeJson(t, rec, &other)
+	if code := getSessions(t, router, other.Token); code != http.StatusOK {
+		t.Fatalf("other session: want 200, got %d", code)
+	}
+}
+
+func TestSignoutRevokesSession(t *testing.T) {
+	repos, cfg := newTestDeps(t)
+	router := newAuthRouter(repos, cfg, newTestKeyRing(t))
+	issued := signup(t, router, "alice", "correct horse battery staple")
+
+	rec := doJson(t, router, http.MethodPost, "/v1/auth/signout", map[string]string{"refresh_token": issued.RefreshToken})
+	if rec.Code >= 300 {
+		t.Fatalf("signout: %d %s", rec.Code, rec.Body)
+	}
+
+	if code, _ := refresh(t, router, issued.RefreshToken); code != http.StatusUnauthorized {
+		t.Fatalf("refresh after signout: want 401, got %d", code)
+	}
+	if code := getSessions(t, router, issued.Token); code != http.StatusUnauthorized {
+		t.Fatalf("access token after signout: want 401, got %d", code)
+	}
+}
@@ -0,0 +1,84 @@
+package routes
+
+import (
+	"cloudbuddy/internal/app/apierror"
+	"cloudbuddy/internal/app/repository"
+	"cloudbuddy/internal/pkg"
+	"log"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// failed signin attempts are counted per username and per client ip in the
+// signin attempts repository, the count starts over once its window has
+// passed without failures
+type throttleKey struct {
+	key    string
+	policy pkg.ThrottlePolicy
+}
+
+func signinThrottleKeys(c *gin.Context, username string) []throttleKey {
+	return []throttleKey{
+		{key: "username:" + pkg.UsernameKey(username), policy: pkg.UsernameThrottle},
+		{key: "ip:" + c.ClientIP(), policy: pkg.IpThrottle},
+	}
+}
+
+// counts the attempt against every key before the credentials are checked, so
+// concurrent attempts can't all pass the limits at once. the attempt counts as
+// a failure unless it is refunded. responds with 429 and returns false while
+// any of the keys is blocked, the keys counted already are refunded then.
+func reserveSigninAttempt(c *gin.Context, repos *repository.Repositories, keys []throttleKey) bool {
+	now := time.Now()
+
+	for i, key := range keys {
+		blockedUntil, err := repos.SigninAttempts.Reserve(key.key, key.policy, now)
+		if err == nil && blockedUntil.IsZero() {
+			continue
+		}
+
+		if refundErr := refundSigninAttempt(repos, keys[:i]); refundErr != nil {
+			log.Println(refundErr)
+		}
+
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return false
+		}
+
+		seconds := int(math.Ceil(time.Until(blockedUntil).Seconds()))
+		c.Header("Retry-After", strconv.Itoa(seconds))
+		apierror.Abort(c, apierror.ErrSigninThrottled.WithDetails(gin.H{
+			"retry_after": seconds,
+		}))
+		return false
+	}
+
+	return true
+}
+
+// takes back an attempt of reserveSigninAttempt which succeeded
+func refundSigninAttempt(repos *repository.Repositories, keys []throttleKey) error {
+	for _, key := range keys {
+		err := repos.SigninAttempts.Refund(key.key)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// forgets the failures of the username after a successful signin. the ip only
+// gets the attempt back, one good account shouldn't unlock guessing on others.
+func resetSigninFailures(repos *repository.Repositories, keys []throttleKey) error {
+	err := repos.SigninAttempts.Delete(keys[0].key)
+	if err != nil {
+		return err
+	}
+
+	return refundSigninAttempt(repos, keys[1:])
+}
@@ -0,0 +1,238 @@
+package routes
+
+import (
+	"cloudbuddy/internal/app/apierror"
+	"cloudbuddy/internal/app/repository"
+	"cloudbuddy/internal/pkg"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// starts totp enrollment. the returned secret only becomes active once it's
+// confirmed with a code through ConfirmTotp.
+func EnrollTotp(repos *repository.Repositories) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		u, exists := c.Get("user")
+
+		if !exists {
+			apierror.Abort(c, apierror.ErrUnauthorized)
+			return
+		}
+
+		user := u.(*pkg.User)
+
+		if user.TotpEnabled {
+			apierror.Abort(c, apierror.ErrTwoFactorEnabled)
+			return
+		}
+
+		key, err := pkg.GenerateTotpKey(user.Username)
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		err = repos.Users.SetTotpPendingSecret(user.UUID, key.Secret)
+
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"secret":      key.Secret,
+			"otpauth_url": key.Url,
+			"qr_code":     key.QrCode,
+		})
+	}
+}
+
+// enables totp after the first code generated from the pending secret checks
+// out. the recovery codes are only ever shown in this response.
+func ConfirmTotp(repos *repository.Repositories) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var body struct {
+			Code string `form:"code" json:"code" binding:"required"`
+		}
+
+		if !bindRequest(c, &body) {
+			return
+		}
+
+		u, exists := c.Get("user")
+
+		if !exists {
+			apierror.Abort(c, apierror.ErrUnauthorized)
+			return
+		}
+
+		user := u.(*pkg.User)
+
+		pendingSecret := user.TotpPendingSecret
+		if pendingSecret == "" {
+			apierror.Abort(c, apierror.ErrTwoFactorNotStarted)
+			return
+		}
+
+		// codes are as guessable here as at signin
+		keys := signinThrottleKeys(c, user.Username)
+		if !reserveSigninAttempt(c, repos, keys) {
+			return
+		}
+
+		step, ok := pkg.ValidateTotpCode(body.Code, pendingSecret, 0)
+		if !ok {
+			apierror.Abort(c, apierror.ErrCodeIncorrect)
+			return
+		}
+
+		if err := refundSigninAttempt(repos, keys); err != nil {
+			log.Println(err)
+		}
+
+		codes, hashes, err := pkg.GenerateRecoveryCodes()
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		err = repos.Users.EnableTotp(user.UUID, pendingSecret, hashes, step)
+
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"recovery_codes": codes,
+		})
+	}
+}
+
+// turns totp off, requires a current code or a recovery code
+func DisableTotp(repos *repository.Repositories) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var body struct {
+			Code string `form:"code" json:"code" binding:"required"`
+		}
+
+		if !bindRequest(c, &body) {
+			return
+		}
+
+		u, exists := c.Get("user")
+
+		if !exists {
+			apierror.Abort(c, apierror.ErrUnauthorized)
+			return
+		}
+
+		user := u.(*pkg.User)
+
+		if !user.TotpEnabled {
+			apierror.Abort(c, apierror.ErrTwoFactorDisabled)
+			return
+		}
+
+		keys := signinThrottleKeys(c, user.Username)
+		if !reserveSigninAttempt(c, repos, keys) {
+			return
+		}
+
+		ok, err := verifySecondFactor(repos, user, body.Code)
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		if !ok {
+			apierror.Abort(c, apierror.ErrCodeIncorrect)
+			return
+		}
+
+		if err := refundSigninAttempt(repos, keys); err != nil {
+			log.Println(err)
+		}
+
+		err = repos.Users.DisableTotp(user.UUID)
+
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		c.JSON(http.StatusNoContent, nil)
+	}
+}
+
+// second step of signin for users with two-factor enabled. exchanges the
+// challenge token returned by Signin and a totp or recovery code for tokens.
+func SigninTwoFactor(repos *repository.Repositories, cfg *pkg.Config, keyRing *pkg.KeyRing) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var body struct {
+			ChallengeToken string `form:"challenge_token" json:"challenge_token" binding:"required"`
+			Code           string `form:"code" json:"code" binding:"required"`
+		}
+
+		if !bindRequest(c, &body) {
+			return
+		}
+
+		userId, err := pkg.ParseChallengeToken(keyRing, cfg.Jwt, body.ChallengeToken)
+		if err != nil {
+			apierror.Abort(c, apierror.ErrChallengeInvalid)
+			return
+		}
+
+		user, err := repos.Users.FindById(userId)
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		if user == nil {
+			apierror.Abort(c, apierror.ErrChallengeInvalid)
+			return
+		}
+
+		// codes are guessable too, they count against the same limits as
+		// passphrases
+		keys := signinThrottleKeys(c, user.Username)
+		if !reserveSigninAttempt(c, repos, keys) {
+			return
+		}
+
+		ok, err := verifySecondFactor(repos, user, body.Code)
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		if !ok {
+			apierror.Abort(c, apierror.ErrInvalidCredentials.WithDetail("code is incorrect"))
+			return
+		}
+
+		err = resetSigninFailures(repos, keys)
+		if err != nil {
+			log.Println(err)
+		}
+
+		completeSignin(c, repos, cfg, keyRing, user)
+	}
+}
+
+// checks code against the user's totp secret, falling back to the recovery
+// codes. the time step of a matching totp code and a matching recovery code
+// are used up.
+func verifySecondFactor(repos *repository.Repositories, user *pkg.User, code string) (bool, error) {
+	if user.TotpSecret != "" {
+		if step, ok := pkg.ValidateTotpCode(code, user.TotpSecret, user.TotpLastStep); ok {
+			return repos.Users.UseTotpStep(user.UUID, step)
+		}
+	}
+
+	return repos.Users.UseRecoveryCode(user.UUID, pkg.HashRecoveryCode(code))
+}
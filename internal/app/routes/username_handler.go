@@ -0,0 +1,56 @@
+package routes
+
+import (
+	"cloudbuddy/internal/app/apierror"
+	"cloudbuddy/internal/app/repository"
+	"cloudbuddy/internal/pkg"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+var errUsernameTaken = &pkg.UsernameError{
+	Code:    pkg.UsernameTaken,
+	Message: "A user with that username already exists",
+}
+
+// finds a user by username regardless of case and compatibility characters
+func findUserByUsername(repos *repository.Repositories, username string) (*pkg.User, error) {
+	return repos.Users.FindByUsernameKey(pkg.UsernameKey(username))
+}
+
+// tells whether a username can be signed up with and if not, why
+func CheckUsername(repos *repository.Repositories) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		username := c.Query("username")
+
+		_, key, err := pkg.NormalizeUsername(username)
+		if err == nil {
+			var existing *pkg.User
+			existing, err = repos.Users.FindByUsernameKey(key)
+			if err != nil {
+				apierror.Abort(c, apierror.Internal(err))
+				return
+			}
+			if existing != nil {
+				err = errUsernameTaken
+			}
+		}
+
+		var usernameErr *pkg.UsernameError
+		if errors.As(err, &usernameErr) {
+			c.JSON(http.StatusOK, gin.H{
+				"username":  username,
+				"available": false,
+				"reason":    usernameErr,
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"username":  username,
+			"available": true,
+		})
+	}
+}
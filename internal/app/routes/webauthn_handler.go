@@ -0,0 +1,422 @@
+package routes
+
+import (
+	"cloudbuddy/internal/app/apierror"
+	"cloudbuddy/internal/app/repository"
+	"cloudbuddy/internal/pkg"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+const (
+	webAuthnRegistration = "registration"
+	webAuthnLogin        = "login"
+)
+
+var errChallengeNotFound = errors.New("webauthn challenge not found or expired")
+
+// starts registering a new passkey for the authenticated user. the returned
+// challenge_id has to be passed to FinishWebAuthnRegistration.
+func BeginWebAuthnRegistration(repos *repository.Repositories, cfg *pkg.Config) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		u, exists := c.Get("user")
+
+		if !exists {
+			apierror.Abort(c, apierror.ErrUnauthorized)
+			return
+		}
+
+		web, ok := relyingParty(c, cfg)
+		if !ok {
+			return
+		}
+
+		user, err := loadWebAuthnUser(repos, u.(*pkg.User))
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		exclusions := []protocol.CredentialDescriptor{}
+		for _, credential := range user.Credentials {
+			exclusions = append(exclusions, credential.Descriptor())
+		}
+
+		options, session, err := web.BeginRegistration(user,
+			webauthn.WithExclusions(exclusions),
+			webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementPreferred),
+		)
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		challengeId, err := saveWebAuthnChallenge(repos, webAuthnRegistration, session)
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"challenge_id": challengeId,
+			"options":      options,
+		})
+	}
+}
+
+// verifies the attestation sent by the authenticator and stores the new
+// credential. expects ?challenge_id= and an optional ?name= for the passkey.
+func FinishWebAuthnRegistration(repos *repository.Repositories, cfg *pkg.Config) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		u, exists := c.Get("user")
+
+		if !exists {
+			apierror.Abort(c, apierror.ErrUnauthorized)
+			return
+		}
+
+		web, ok := relyingParty(c, cfg)
+		if !ok {
+			return
+		}
+
+		session, err := takeWebAuthnChallenge(repos, webAuthnRegistration, c.Query("challenge_id"))
+		if err == errChallengeNotFound {
+			apierror.Abort(c, apierror.ErrWebAuthnChallengeInvalid)
+			return
+		}
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		user, err := loadWebAuthnUser(repos, u.(*pkg.User))
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		credential, err := web.FinishRegistration(user, *session, c.Request)
+		if err != nil {
+			apierror.Abort(c, apierror.ErrPasskeyRegistrationFailed)
+			return
+		}
+
+		encoded, err := json.Marshal(credential)
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		name := c.Query("name")
+		if name == "" {
+			name = "Passkey"
+		}
+
+		stored := &pkg.Credential{
+			UserId:       user.Id,
+			CredentialId: base64.RawURLEncoding.EncodeToString(credential.ID),
+			Name:         name,
+			Credential:   string(encoded),
+			LastUsedAt:   time.Now(),
+			CreatedAt:    time.Now(),
+		}
+		err = repos.Credentials.Create(stored)
+
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		c.JSON(http.StatusCreated, stored)
+	}
+}
+
+// starts a passkey signin. with the username of a user who has passkeys in
+// the body only that user's credentials are allowed, otherwise the
+// authenticator picks a discoverable credential.
+func BeginWebAuthnLogin(repos *repository.Repositories, cfg *pkg.Config) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var body struct {
+			Username string `form:"username" json:"username"`
+		}
+		// the body is optional
+		_ = c.ShouldBind(&body)
+
+		web, ok := relyingParty(c, cfg)
+		if !ok {
+			return
+		}
+
+		var user *pkg.WebAuthnUser
+		if body.Username != "" {
+			account, err := findUserByUsername(repos, body.Username)
+			if err != nil {
+				apierror.Abort(c, apierror.Internal(err))
+				return
+			}
+
+			if account != nil {
+				user, err = loadWebAuthnUser(repos, account)
+				if err != nil {
+					apierror.Abort(c, apierror.Internal(err))
+					return
+				}
+			}
+		}
+
+		// unknown usernames and users without passkeys get a discoverable
+		// challenge like a request without a username, so the response
+		// doesn't tell whether the username exists
+		var options *protocol.CredentialAssertion
+		var session *webauthn.SessionData
+		var err error
+		if user != nil && len(user.Credentials) > 0 {
+			options, session, err = web.BeginLogin(user)
+		} else {
+			options, session, err = web.BeginDiscoverableLogin()
+		}
+
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		challengeId, err := saveWebAuthnChallenge(repos, webAuthnLogin, session)
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"challenge_id": challengeId,
+			"options":      options,
+		})
+	}
+}
+
+// verifies the assertion and signs the user in exactly like Signin does.
+// expects ?challenge_id= from BeginWebAuthnLogin.
+func FinishWebAuthnLogin(repos *repository.Repositories, cfg *pkg.Config, keyRing *pkg.KeyRing) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		web, ok := relyingParty(c, cfg)
+		if !ok {
+			return
+		}
+
+		session, err := takeWebAuthnChallenge(repos, webAuthnLogin, c.Query("challenge_id"))
+		if err == errChallengeNotFound {
+			apierror.Abort(c, apierror.ErrWebAuthnChallengeInvalid)
+			return
+		}
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		var account *pkg.User
+		var credential *webauthn.Credential
+
+		if len(session.UserID) == 0 {
+			credential, err = web.FinishDiscoverableLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+				account, err = repos.Users.FindById(string(userHandle))
+				if err != nil {
+					return nil, err
+				}
+				if account == nil {
+					return nil, errors.New("user not found")
+				}
+
+				return loadWebAuthnUser(repos, account)
+			}, *session, c.Request)
+		} else {
+			account, err = repos.Users.FindById(string(session.UserID))
+			if err == nil && account == nil {
+				err = errors.New("user not found")
+			}
+			if err == nil {
+				var user *pkg.WebAuthnUser
+				user, err = loadWebAuthnUser(repos, account)
+				if err == nil {
+					credential, err = web.FinishLogin(user, *session, c.Request)
+				}
+			}
+		}
+
+		if err != nil {
+			apierror.Abort(c, apierror.ErrPasskeySigninFailed)
+			return
+		}
+
+		// a sign count going backwards means the authenticator was cloned
+		if credential.Authenticator.CloneWarning {
+			log.Printf("Passkey clone warning (user _id: %s)", account.UUID)
+			apierror.Abort(c, apierror.ErrPasskeySigninFailed)
+			return
+		}
+
+		encoded, err := json.Marshal(credential)
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		err = repos.Credentials.SetCredential(account.UUID, base64.RawURLEncoding.EncodeToString(credential.ID), string(encoded), time.Now())
+
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		completeSignin(c, repos, cfg, keyRing, account)
+	}
+}
+
+// lists the passkeys of the authenticated user
+func GetCredentials(repos *repository.Repositories) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		user, exists := c.Get("user")
+
+		if !exists {
+			apierror.Abort(c, apierror.ErrUnauthorized)
+			return
+		}
+
+		userId := user.(*pkg.User).UUID
+
+		credentials, err := repos.Credentials.ListByUser(userId)
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		if credentials == nil {
+			credentials = []pkg.Credential{}
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"credentials": credentials,
+		})
+	}
+}
+
+// removes one of the authenticated user's passkeys
+func DeleteCredential(repos *repository.Repositories) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+		user, exists := c.Get("user")
+
+		if !exists {
+			apierror.Abort(c, apierror.ErrUnauthorized)
+			return
+		}
+
+		userId := user.(*pkg.User).UUID
+
+		err := repos.Credentials.Delete(id, userId)
+		if err == repository.ErrNotFound {
+			apierror.Abort(c, apierror.ErrPasskeyNotFound)
+			return
+		}
+
+		if err != nil {
+			apierror.Abort(c, apierror.Internal(err))
+			return
+		}
+
+		c.JSON(http.StatusNoContent, nil)
+	}
+}
+
+func loadWebAuthnUser(repos *repository.Repositories, account *pkg.User) (*pkg.WebAuthnUser, error) {
+	credentials, err := repos.Credentials.ListByUser(account.UUID)
+	if err != nil {
+		return nil, err
+	}
+
+	user := &pkg.WebAuthnUser{
+		Id:          account.UUID,
+		Name:        account.Username,
+		DisplayName: account.Fullname,
+		Credentials: []webauthn.Credential{},
+	}
+
+	for _, stored := range credentials {
+		var credential webauthn.Credential
+		if err := json.Unmarshal([]byte(stored.Credential), &credential); err != nil {
+			return nil, err
+		}
+		user.Credentials = append(user.Credentials, credential)
+	}
+
+	return user, nil
+}
+
+// ceremony state is kept as a challenge until the client finishes the
+// ceremony or the challenge expires
+func saveWebAuthnChallenge(repos *repository.Repositories, kind string, session *webauthn.SessionData) (string, error) {
+	encoded, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+
+	challenge := &pkg.WebAuthnChallenge{
+		Kind:      kind,
+		Session:   string(encoded),
+		ExpiresAt: session.Expires,
+		CreatedAt: time.Now(),
+	}
+
+	err = repos.WebAuthnChallenges.Create(challenge)
+	return challenge.UUID, err
+}
+
+// the relying party, responds and returns false when passkeys are off
+func relyingParty(c *gin.Context, cfg *pkg.Config) (*webauthn.WebAuthn, bool) {
+	web, err := pkg.NewWebAuthn(cfg.WebAuthn)
+	if err == pkg.ErrWebAuthnDisabled {
+		apierror.Abort(c, apierror.ErrPasskeysDisabled)
+		return nil, false
+	}
+	if err != nil {
+		apierror.Abort(c, apierror.Internal(err))
+		return nil, false
+	}
+
+	return web, true
+}
+
+// loads and deletes a challenge, each one can only be used once
+func takeWebAuthnChallenge(repos *repository.Repositories, kind string, id string) (*webauthn.SessionData, error) {
+	if id == "" {
+		return nil, errChallengeNotFound
+	}
+
+	challenge, err := repos.WebAuthnChallenges.Take(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if challenge == nil || challenge.Kind != kind {
+		return nil, errChallengeNotFound
+	}
+
+	var session webauthn.SessionData
+	if err := json.Unmarshal([]byte(challenge.Session), &session); err != nil {
+		return nil, err
+	}
+
+	if !session.Expires.IsZero() && time.Now().After(session.Expires) {
+		return nil, errChallengeNotFound
+	}
+
+	return &session, nil
+}
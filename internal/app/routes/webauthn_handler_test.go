@@ -0,0 +1,375 @@
+package routes
+
+import (
+	"cloudbuddy/internal/app/repository"
+	"cloudbuddy/internal/pkg"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+const (
+	testRpId   = "cloudbuddy.test"
+	testOrigin = "https://cloudbuddy.test"
+)
+
+// a passkey held in memory, it answers ceremonies the way a browser and a
+// platform authenticator would
+type softAuthenticator struct {
+	key       *ecdsa.PrivateKey
+	id        []byte
+	userId    []byte
+	origin    string
+	signCount uint32
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		t.Fatal(err)
+	}
+
+	return &softAuthenticator{key: key, id: id, origin: testOrigin}
+}
+
+func (a *softAuthenticator) clientData(t *testing.T, kind string, challenge []byte) []byte {
+	t.Helper()
+
+	data, err := json.Marshal(map[string]string{
+		"type":      kind,
+		"challenge": base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":    a.origin,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+// rp id hash, flags and sign count
+func (a *softAuthenticator) authData(flags byte) []byte {
+	rpIdHash := sha256.Sum256([]byte(testRpId))
+
+	data := append([]byte{}, rpIdHash[:]...)
+	data = append(data, flags)
+	return binary.BigEndian.AppendUint32(data, a.signCount)
+}
+
+// the credential creation response with a "none" attestation
+func (a *softAuthenticator) attest(t *testing.T, options protocol.CredentialCreation) map[string]any {
+	t.Helper()
+
+	// the user handle arrives base64url encoded like every other binary field
+	userId, err := base64.RawURLEncoding.DecodeString(options.Response.User.ID.(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.userId = userId
+
+	publicKey, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  int64(webauthncose.P256),
+		XCoord: a.key.X.FillBytes(make([]byte, 32)),
+		YCoord: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// user present, user verified, attested credential data included
+	authData := a.authData(0x45)
+	authData = append(authData, make([]byte, 16)...)
+	authData = binary.BigEndian.AppendUint16(authData, uint16(len(a.id)))
+	authData = append(authData, a.id...)
+	authData = append(authData, publicKey...)
+
+	attestation, err := webauthncbor.Marshal(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": authData,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return map[string]any{
+		"id":    base64.RawURLEncoding.EncodeToString(a.id),
+		"rawId": base64.RawURLEncoding.EncodeToString(a.id),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(a.clientData(t, "webauthn.create", options.Response.Challenge)),
+			"attestationObject": base64.RawURLEncoding.EncodeToString(attestation),
+		},
+	}
+}
+
+// the assertion response, every assertion counts one signature
+func (a *softAuthenticator) assert(t *testing.T, options protocol.CredentialAssertion) map[string]any {
+	t.Helper()
+
+	a.signCount++
+
+	clientData := a.clientData(t, "webauthn.get", options.Response.Challenge)
+	clientDataHash := sha256.Sum256(clientData)
+
+	// user present, user verified
+	authData := a.authData(0x05)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return map[string]any{
+		"id":    base64.RawURLEncoding.EncodeToString(a.id),
+		"rawId": base64.RawURLEncoding.EncodeToString(a.id),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientData),
+			"authenticatorData": base64.RawURLEncoding.EncodeToString(authData),
+			"signature":         base64.RawURLEncoding.EncodeToString(signature),
+			"userHandle":        base64.RawURLEncoding.EncodeToString(a.userId),
+		},
+	}
+}
+
+type webAuthnTest struct {
+	t      *testing.T
+	repos  *repository.Repositories
+	router *gin.Engine
+	user   *pkg.User
+}
+
+func newWebAuthnTest(t *testing.T) *webAuthnTest {
+	repos, cfg := newTestDeps(t)
+	cfg.WebAuthn.RpId = testRpId
+	cfg.WebAuthn.RpOrigins = []string{testOrigin}
+
+	user := &pkg.User{Username: "alice", UsernameKey: "alice", Role: pkg.RoleUser, CreatedAt: time.Now()}
+	if err := repos.Users.Create(user); err != nil {
+		t.Fatal(err)
+	}
+
+	router := newTestRouter()
+	router.POST("/passkeys/begin", asUser(user), BeginWebAuthnRegistration(repos, cfg))
+	router.POST("/passkeys/finish", asUser(user), FinishWebAuthnRegistration(repos, cfg))
+	router.POST("/signin/begin", BeginWebAuthnLogin(repos, cfg))
+	router.POST("/signin/finish", FinishWebAuthnLogin(repos, cfg, newTestKeyRing(t)))
+
+	return &webAuthnTest{t: t, repos: repos, router: router, user: user}
+}
+
+func (w *webAuthnTest) register(authenticator *softAuthenticator) int {
+	var begin struct {
+		ChallengeId string                      `json:"challenge_id"`
+		Options     protocol.CredentialCreation `json:"options"`
+	}
+	rec := doJson(w.t, w.router, http.MethodPost, "/passkeys/begin", nil)
+	if rec.Code != http.StatusOK {
+		w.t.Fatalf("begin registration: %d %s", rec.Code, rec.Body)
+	}
+	decodeJson(w.t, rec, &begin)
+
+	return doJson(w.t, w.router, http.MethodPost, "/passkeys/finish?challenge_id="+begin.ChallengeId, authenticator.attest(w.t, begin.Options)).Code
+}
+
+// begins a signin, with an empty username for a discoverable credential
+func (w *webAuthnTest) beginSignin(username string) (string, protocol.CredentialAssertion) {
+	var begin struct {
+		ChallengeId string                       `json:"challenge_id"`
+		Options     protocol.CredentialAssertion `json:"options"`
+	}
+	rec := doJson(w.t, w.router, http.MethodPost, "/signin/begin", map[string]string{"username": username})
+	if rec.Code != http.StatusOK {
+		w.t.Fatalf("begin signin: %d %s", rec.Code, rec.Body)
+	}
+	decodeJson(w.t, rec, &begin)
+
+	return begin.ChallengeId, begin.Options
+}
+
+func (w *webAuthnTest) signin(authenticator *softAuthenticator, username string) int {
+	challengeId, options := w.beginSignin(username)
+	return doJson(w.t, w.router, http.MethodPost, "/signin/finish?challenge_id="+challengeId, authenticator.assert(w.t, options)).Code
+}
+
+// the stored sign count of the user's only passkey
+func (w *webAuthnTest) storedSignCount() uint32 {
+	user, err := loadWebAuthnUser(w.repos, w.user)
+	if err != nil {
+		w.t.Fatal(err)
+	}
+	if len(user.Credentials) != 1 {
+		w.t.Fatalf("want 1 credential, got %d", len(user.Credentials))
+	}
+
+	return user.Credentials[0].Authenticator.SignCount
+}
+
+func TestWebAuthnRegistrationAndSignin(t *testing.T) {
+	w := newWebAuthnTest(t)
+	authenticator := newSoftAuthenticator(t)
+
+	if code := w.register(authenticator); code != http.StatusCreated {
+		t.Fatalf("registration: want 201, got %d", code)
+	}
+
+	if code := w.signin(authenticator, "alice"); code != http.StatusCreated {
+		t.Fatalf("signin with username: want 201, got %d", code)
+	}
+	if code := w.signin(authenticator, ""); code != http.StatusCreated {
+		t.Fatalf("discoverable signin: want 201, got %d", code)
+	}
+
+	if count := w.storedSignCount(); count != 2 {
+		t.Fatalf("want sign count 2, got %d", count)
+	}
+}
+
+// unknown usernames and users without passkeys get the same discoverable
+// challenge
+func TestWebAuthnSigninDoesNotRevealUsernames(t *testing.T) {
+	w := newWebAuthnTest(t)
+
+	for _, username := range []string{"alice", "nobody"} {
+		if _, options := w.beginSignin(username); len(options.Response.AllowedCredentials) != 0 {
+			t.Fatalf("%s: want a discoverable challenge, got %d allowed credentials", username, len(options.Response.AllowedCredentials))
+		}
+	}
+
+	authenticator := newSoftAuthenticator(t)
+	if code := w.register(authenticator); code != http.StatusCreated {
+		t.Fatalf("registration: want 201, got %d", code)
+	}
+
+	// the passkey still signs in through the challenge of an unknown name
+	if code := w.signin(authenticator, "nobody"); code != http.StatusCreated {
+		t.Fatalf("signin with an unknown username: want 201, got %d", code)
+	}
+}
+
+func TestWebAuthnRegistrationRejectsWrongOrigin(t *testing.T) {
+	w := newWebAuthnTest(t)
+	authenticator := newSoftAuthenticator(t)
+	authenticator.origin = "https://evil.test"
+
+	if code := w.register(authenticator); code != http.StatusBadRequest {
+		t.Fatalf("want 400, got %d", code)
+	}
+}
+
+func TestWebAuthnSigninRejectsUnknownKey(t *testing.T) {
+	w := newWebAuthnTest(t)
+	authenticator := newSoftAuthenticator(t)
+	if code := w.register(authenticator); code != http.StatusCreated {
+		t.Fatalf("registration: want 201, got %d", code)
+	}
+
+	// same credential id, different private key
+	impostor := newSoftAuthenticator(t)
+	impostor.id = authenticator.id
+	impostor.userId = authenticator.userId
+
+	if code := w.signin(impostor, "alice"); code != http.StatusUnauthorized {
+		t.Fatalf("want 401, got %d", code)
+	}
+}
+
+func TestWebAuthnSigninRejectsSignCountGoingBack(t *testing.T) {
+	w := newWebAuthnTest(t)
+	authenticator := newSoftAuthenticator(t)
+	if code := w.register(authenticator); code != http.StatusCreated {
+		t.Fatalf("registration: want 201, got %d", code)
+	}
+
+	authenticator.signCount = 9
+	if code := w.signin(authenticator, "alice"); code != http.StatusCreated {
+		t.Fatalf("signin: want 201, got %d", code)
+	}
+
+	// a clone still signing with the count it was copied at
+	authenticator.signCount = 4
+	if code := w.signin(authenticator, "alice"); code != http.StatusUnauthorized {
+		t.Fatalf("cloned authenticator: want 401, got %d", code)
+	}
+
+	if count := w.storedSignCount(); count != 10 {
+		t.Fatalf("want sign count 10, got %d", count)
+	}
+}
+
+func TestWebAuthnChallengeIsSingleUse(t *testing.T) {
+	w := newWebAuthnTest(t)
+	authenticator := newSoftAuthenticator(t)
+	if code := w.register(authenticator); code != http.StatusCreated {
+		t.Fatalf("registration: want 201, got %d", code)
+	}
+
+	challengeId, options := w.beginSignin("alice")
+	response := authenticator.assert(t, options)
+
+	if code := doJson(t, w.router, http.MethodPost, "/signin/finish?challenge_id="+challengeId, response).Code; code != http.StatusCreated {
+		t.Fatalf("signin: want 201, got %d", code)
+	}
+	if code := doJson(t, w.router, http.MethodPost, "/signin/finish?challenge_id="+challengeId, response).Code; code != http.StatusBadRequest {
+		t.Fatalf("replayed challenge: want 400, got %d", code)
+	}
+}
+
+func TestWebAuthnChallengeExpires(t *testing.T) {
+	w := newWebAuthnTest(t)
+	authenticator := newSoftAuthenticator(t)
+	if code := w.register(authenticator); code != http.StatusCreated {
+		t.Fatalf("registration: want 201, got %d", code)
+	}
+
+	challengeId, options := w.beginSignin("alice")
+
+	// let the challenge run out without waiting for its timeout
+	challenge, err := w.repos.WebAuthnChallenges.Take(challengeId)
+	if err != nil || challenge == nil {
+		t.Fatalf("challenge not stored: %v", err)
+	}
+	var session webauthn.SessionData
+	if err := json.Unmarshal([]byte(challenge.Session), &session); err != nil {
+		t.Fatal(err)
+	}
+	session.Expires = time.Now().Add(-time.Second)
+	encoded, err := json.Marshal(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge.Session = string(encoded)
+	if err := w.repos.WebAuthnChallenges.Create(challenge); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := doJson(t, w.router, http.MethodPost, "/signin/finish?challenge_id="+challengeId, authenticator.assert(t, options)).Code; code != http.StatusBadRequest {
+		t.Fatalf("expired challenge: want 400, got %d", code)
+	}
+}
@@ -0,0 +1,66 @@
+package pkg
+
+import (
+	"crypto/subtle"
+	"strings"
+)
+
+// reading images needs no authentication, but a request which presents an api
+// key on a GET route needs a key carrying images:read
+const (
+	ScopeImagesRead   = "images:read"
+	ScopeImagesWrite  = "images:write"
+	ScopeImagesDelete = "images:delete"
+)
+
+var ApiKeyScopes = []string{ScopeImagesRead, ScopeImagesWrite, ScopeImagesDelete}
+
+const apiKeyPrefix = "cb_"
+
+// generates a new api key of the form cb_<prefix>_<secret>. the prefix is
+// stored in clear so keys can be looked up and recognized in listings, only
+// the hash of the whole key is stored.
+func GenerateApiKey() (string, string, string, error) {
+	prefix, err := RandomToken(6)
+	if err != nil {
+		return "", "", "", err
+	}
+	secret, err := RandomToken(32)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	// the prefix must not contain the separator
+	prefix = strings.ReplaceAll(prefix, "_", "-")
+	key := apiKeyPrefix + prefix + "_" + secret
+
+	return key, apiKeyPrefix + prefix, HashToken(key), nil
+}
+
+// returns the visible prefix of an api key
+func ApiKeyPrefix(key string) (string, bool) {
+	if !strings.HasPrefix(key, apiKeyPrefix) {
+		return "", false
+	}
+
+	prefix, secret, found := strings.Cut(strings.TrimPrefix(key, apiKeyPrefix), "_")
+	if !found || prefix == "" || secret == "" {
+		return "", false
+	}
+
+	return apiKeyPrefix + prefix, true
+}
+
+func CheckApiKeyHash(key string, hash string) bool {
+	return subtle.ConstantTimeCompare([]byte(HashToken(key)), []byte(hash)) == 1
+}
+
+func ValidScope(scope string) bool {
+	for _, s := range ApiKeyScopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
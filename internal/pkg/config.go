@@ -0,0 +1,370 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/joho/godotenv"
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	DatabaseClover   = "clover"
+	DatabaseSqlite   = "sqlite"
+	DatabasePostgres = "postgres"
+)
+
+// everything configurable, loaded once at startup by LoadConfig and handed
+// to whatever needs it. each setting can come from the config file or from
+// the environment variable in its env tag, the environment wins.
+//
+// DatabaseDriver picks where everything is kept: the clover database in
+// DatabaseDir, or the sqlite file or postgres server at DatabaseUrl. with
+// sqlite or postgres a clover database left in DatabaseDir is imported once.
+type Config struct {
+	Port           string   `env:"PORT" yaml:"port" toml:"port"`
+	DatabaseDir    string   `env:"DATABASE_DIR" yaml:"database_dir" toml:"database_dir"`
+	DatabaseDriver string   `env:"DATABASE_DRIVER" yaml:"database_driver" toml:"database_driver"`
+	DatabaseUrl    string   `env:"DATABASE_URL" yaml:"database_url" toml:"database_url"`
+	AdminUsernames []string `env:"ADMIN_USERNAMES" yaml:"admin_usernames" toml:"admin_usernames"`
+
+	Jwt        JwtConfig             `yaml:"jwt" toml:"jwt"`
+	Cookie     CookieOptions         `yaml:"cookie" toml:"cookie"`
+	Mail       MailConfig            `yaml:"mail" toml:"mail"`
+	Bucket     BucketConfig          `yaml:"bucket" toml:"bucket"`
+	Argon2     Argon2Params          `yaml:"argon2" toml:"argon2"`
+	Passphrase PassphrasePolicy      `yaml:"passphrase" toml:"passphrase"`
+	WebAuthn   WebAuthnConfig        `yaml:"webauthn" toml:"webauthn"`
+	Oidc       map[string]OidcConfig `yaml:"oidc" toml:"oidc"`
+}
+
+// iss and aud are checked by services verifying our tokens. see LoadKeyRing
+// for the keys.
+type JwtConfig struct {
+	KeysDir   string `env:"JWT_KEYS_DIR" yaml:"keys_dir" toml:"keys_dir"`
+	ActiveKid string `env:"JWT_ACTIVE_KID" yaml:"active_kid" toml:"active_kid"`
+	Issuer    string `env:"JWT_ISSUER" yaml:"issuer" toml:"issuer"`
+	Audience  string `env:"JWT_AUDIENCE" yaml:"audience" toml:"audience"`
+	// generate a key when KeysDir holds none, only for single instance
+	// setups where KeysDir is kept across restarts
+	GenerateKey bool `env:"JWT_GENERATE_KEY" yaml:"generate_key" toml:"generate_key"`
+}
+
+// Mailer is "log" or "smtp". the urls are the bases of the links mailed out,
+// see TokenLink.
+type MailConfig struct {
+	Mailer               string `env:"MAILER" yaml:"mailer" toml:"mailer"`
+	LogFile              string `env:"MAIL_LOG_FILE" yaml:"log_file" toml:"log_file"`
+	SmtpHost             string `env:"SMTP_HOST" yaml:"smtp_host" toml:"smtp_host"`
+	SmtpPort             string `env:"SMTP_PORT" yaml:"smtp_port" toml:"smtp_port"`
+	SmtpUsername         string `env:"SMTP_USERNAME" yaml:"smtp_username" toml:"smtp_username"`
+	SmtpPassword         string `env:"SMTP_PASSWORD" yaml:"smtp_password" toml:"smtp_password"`
+	From                 string `env:"MAIL_FROM" yaml:"from" toml:"from"`
+	RequireVerifiedEmail bool   `env:"REQUIRE_VERIFIED_EMAIL" yaml:"require_verified_email" toml:"require_verified_email"`
+	EmailVerificationUrl string `env:"EMAIL_VERIFICATION_URL" yaml:"email_verification_url" toml:"email_verification_url"`
+	PassphraseResetUrl   string `env:"PASSPHRASE_RESET_URL" yaml:"passphrase_reset_url" toml:"passphrase_reset_url"`
+}
+
+// with PathStyle objects live at <endpoint>/<bucket>/<key>, otherwise at
+// <bucket>.<endpoint host>/<key>. PublicBaseUrl, e.g. a cdn domain, replaces
+// both in the urls served to clients, see ObjectUrl. for private buckets
+// SignedUrls serves pre-signed urls valid for SignedUrlTtl seconds instead.
+// ExportsName is a private bucket for data exports, see Exports. without it
+// exports are disabled unless the image bucket is private.
+type BucketConfig struct {
+	Name          string `env:"BUCKET_NAME" yaml:"name" toml:"name"`
+	Endpoint      string `env:"BUCKET_ENDPOINT" yaml:"endpoint" toml:"endpoint"`
+	Region        string `env:"BUCKET_REGION" yaml:"region" toml:"region"`
+	PathStyle     bool   `env:"BUCKET_PATH_STYLE" yaml:"path_style" toml:"path_style"`
+	KeyPrefix     string `env:"BUCKET_KEY_PREFIX" yaml:"key_prefix" toml:"key_prefix"`
+	PublicBaseUrl string `env:"BUCKET_PUBLIC_BASE_URL" yaml:"public_base_url" toml:"public_base_url"`
+	SignedUrls    bool   `env:"BUCKET_SIGNED_URLS" yaml:"signed_urls" toml:"signed_urls"`
+	SignedUrlTtl  int    `env:"BUCKET_SIGNED_URL_TTL" yaml:"signed_url_ttl" toml:"signed_url_ttl"`
+	ExportsName   string `env:"BUCKET_EXPORTS_NAME" yaml:"exports_name" toml:"exports_name"`
+	AccessKey     string `env:"BUCKET_ACCESS_KEY" yaml:"access_key" toml:"access_key"`
+	SecretKey     string `env:"BUCKET_SECRET_KEY" yaml:"secret_key" toml:"secret_key"`
+}
+
+// passkeys are turned off unless RpId and RpOrigins are set
+type WebAuthnConfig struct {
+	RpId          string   `env:"WEBAUTHN_RP_ID" yaml:"rp_id" toml:"rp_id"`
+	RpOrigins     []string `env:"WEBAUTHN_RP_ORIGINS" yaml:"rp_origins" toml:"rp_origins"`
+	RpDisplayName string   `env:"WEBAUTHN_RP_DISPLAY_NAME" yaml:"rp_display_name" toml:"rp_display_name"`
+}
+
+// an identity provider. in the environment the providers are listed in
+// OIDC_PROVIDERS and each is configured with OIDC_<NAME>_<SETTING>, e.g.
+// OIDC_GOOGLE_CLIENT_ID.
+type OidcConfig struct {
+	Issuer       string   `env:"ISSUER" yaml:"issuer" toml:"issuer"`
+	ClientId     string   `env:"CLIENT_ID" yaml:"client_id" toml:"client_id"`
+	ClientSecret string   `env:"CLIENT_SECRET" yaml:"client_secret" toml:"client_secret"`
+	RedirectUrl  string   `env:"REDIRECT_URL" yaml:"redirect_url" toml:"redirect_url"`
+	Scopes       []string `env:"SCOPES" yaml:"scopes" toml:"scopes"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Port:           "8080",
+		DatabaseDir:    "clover-db",
+		DatabaseDriver: DatabaseClover,
+		Jwt: JwtConfig{
+			KeysDir:  "jwt-keys",
+			Issuer:   "cloudbuddy",
+			Audience: "cloudbuddy",
+		},
+		Mail: MailConfig{
+			Mailer:   "log",
+			SmtpPort: "587",
+		},
+		Bucket: BucketConfig{
+			Region:       "us-west-2",
+			PathStyle:    true,
+			KeyPrefix:    "cloudbuddy/",
+			SignedUrlTtl: 3600,
+		},
+		Argon2:     DefaultArgon2Params,
+		Passphrase: DefaultPassphrasePolicy,
+		WebAuthn: WebAuthnConfig{
+			RpDisplayName: "CloudBuddy",
+		},
+		Oidc: map[string]OidcConfig{},
+	}
+}
+
+// builds the config from the defaults, the optional config file at path
+// (.yaml, .yml or .toml), a .env file if there is one and the environment,
+// each overriding the ones before. the result is validated.
+func LoadConfig(path string) (*Config, error) {
+	cfg := DefaultConfig()
+
+	if path != "" {
+		if err := readConfigFile(path, &cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	err := godotenv.Load()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("reading .env: %w", err)
+	}
+
+	if err := loadEnv(reflect.ValueOf(&cfg).Elem(), ""); err != nil {
+		return nil, err
+	}
+	if err := loadOidcEnv(cfg.Oidc); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
+
+func readConfigFile(path string, cfg *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, cfg)
+	case ".toml":
+		err = toml.Unmarshal(data, cfg)
+	default:
+		return fmt.Errorf("config file %s must be .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// sets every field tagged with env whose variable is set. lists are comma
+// separated.
+func loadEnv(v reflect.Value, prefix string) error {
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		field := v.Field(i)
+		name, tagged := t.Field(i).Tag.Lookup("env")
+
+		if field.Kind() == reflect.Struct && !tagged {
+			if err := loadEnv(field, prefix); err != nil {
+				return err
+			}
+			continue
+		}
+		if !tagged {
+			continue
+		}
+
+		name = prefix + name
+		value, ok := os.LookupEnv(name)
+		if !ok || value == "" {
+			continue
+		}
+
+		if err := setField(field, value); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+func setField(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.New("must be a boolean")
+		}
+		field.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return errors.New("must be a number")
+		}
+		field.SetInt(int64(n))
+	case reflect.Uint8, reflect.Uint32:
+		n, err := strconv.ParseUint(value, 10, field.Type().Bits())
+		if err != nil {
+			return errors.New("must be a positive number")
+		}
+		field.SetUint(n)
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported setting type %s", field.Type())
+	}
+
+	return nil
+}
+
+// adds the providers listed in OIDC_PROVIDERS, the environment overrides
+// providers from the config file setting by setting
+func loadOidcEnv(providers map[string]OidcConfig) error {
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		provider := providers[name]
+		if err := loadEnv(reflect.ValueOf(&provider).Elem(), "OIDC_"+strings.ToUpper(name)+"_"); err != nil {
+			return err
+		}
+		providers[name] = provider
+	}
+
+	return nil
+}
+
+// reports every invalid setting at once
+func (cfg *Config) Validate() error {
+	var errs []error
+	require := func(value string, setting string) {
+		if value == "" {
+			errs = append(errs, errors.New(setting+" must be set"))
+		}
+	}
+
+	require(cfg.DatabaseDir, "DATABASE_DIR (database_dir)")
+	switch cfg.DatabaseDriver {
+	case DatabaseClover:
+	case DatabaseSqlite, DatabasePostgres:
+		require(cfg.DatabaseUrl, "DATABASE_URL (database_url)")
+	default:
+		errs = append(errs, errors.New("DATABASE_DRIVER (database_driver) must be clover, sqlite or postgres"))
+	}
+
+	require(cfg.Jwt.KeysDir, "JWT_KEYS_DIR (jwt.keys_dir)")
+	require(cfg.Jwt.Issuer, "JWT_ISSUER (jwt.issuer)")
+	require(cfg.Jwt.Audience, "JWT_AUDIENCE (jwt.audience)")
+
+	require(cfg.Bucket.Name, "BUCKET_NAME (bucket.name)")
+	require(cfg.Bucket.Endpoint, "BUCKET_ENDPOINT (bucket.endpoint)")
+	require(cfg.Bucket.Region, "BUCKET_REGION (bucket.region)")
+	require(cfg.Bucket.AccessKey, "BUCKET_ACCESS_KEY (bucket.access_key)")
+	require(cfg.Bucket.SecretKey, "BUCKET_SECRET_KEY (bucket.secret_key)")
+	if cfg.Bucket.Endpoint != "" && !isAbsoluteUrl(cfg.Bucket.Endpoint) {
+		errs = append(errs, errors.New("BUCKET_ENDPOINT (bucket.endpoint) must be an absolute url"))
+	}
+	if cfg.Bucket.PublicBaseUrl != "" && !isAbsoluteUrl(cfg.Bucket.PublicBaseUrl) {
+		errs = append(errs, errors.New("BUCKET_PUBLIC_BASE_URL (bucket.public_base_url) must be an absolute url"))
+	}
+	if cfg.Bucket.SignedUrls && cfg.Bucket.PublicBaseUrl != "" {
+		errs = append(errs, errors.New("BUCKET_SIGNED_URLS and BUCKET_PUBLIC_BASE_URL (bucket.*) can't be used together"))
+	}
+	// s3 refuses to sign urls for longer than a week
+	if cfg.Bucket.SignedUrlTtl < 1 || cfg.Bucket.SignedUrlTtl > 7*24*60*60 {
+		errs = append(errs, errors.New("BUCKET_SIGNED_URL_TTL (bucket.signed_url_ttl) must be between 1 and 604800 seconds"))
+	}
+
+	switch cfg.Mail.Mailer {
+	case "log":
+	case "smtp":
+		require(cfg.Mail.SmtpHost, "SMTP_HOST (mail.smtp_host)")
+		require(cfg.Mail.From, "MAIL_FROM (mail.from)")
+	default:
+		errs = append(errs, errors.New("MAILER (mail.mailer) must be smtp or log"))
+	}
+
+	if cfg.Argon2.Memory == 0 || cfg.Argon2.Iterations == 0 || cfg.Argon2.Parallelism == 0 {
+		errs = append(errs, errors.New("ARGON2_MEMORY, ARGON2_ITERATIONS and ARGON2_PARALLELISM (argon2.*) must be positive"))
+	}
+	// shorter salts and hashes are below what argon2id is meant to be run with
+	if cfg.Argon2.SaltLength < 16 || cfg.Argon2.KeyLength < 16 {
+		errs = append(errs, errors.New("argon2.salt_length and argon2.key_length must be at least 16"))
+	}
+
+	if cfg.Passphrase.MinLength < 1 || cfg.Passphrase.MaxLength < cfg.Passphrase.MinLength {
+		errs = append(errs, errors.New("PASSPHRASE_MIN_LENGTH must be positive and at most PASSPHRASE_MAX_LENGTH (passphrase.*)"))
+	}
+	if cfg.Passphrase.MinStrength < 0 || cfg.Passphrase.MinStrength > 4 {
+		errs = append(errs, errors.New("PASSPHRASE_MIN_STRENGTH (passphrase.min_strength) must be between 0 and 4"))
+	}
+
+	if (cfg.WebAuthn.RpId == "") != (len(cfg.WebAuthn.RpOrigins) == 0) {
+		errs = append(errs, errors.New("WEBAUTHN_RP_ID and WEBAUTHN_RP_ORIGINS (webauthn.*) must be set together"))
+	}
+
+	for name, provider := range cfg.Oidc {
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		require(provider.Issuer, prefix+"ISSUER (oidc."+name+".issuer)")
+		require(provider.ClientId, prefix+"CLIENT_ID (oidc."+name+".client_id)")
+		require(provider.RedirectUrl, prefix+"REDIRECT_URL (oidc."+name+".redirect_url)")
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config: %w", errors.Join(errs...))
+	}
+
+	return nil
+}
+
+func isAbsoluteUrl(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && u.Scheme != "" && u.Host != ""
+}
@@ -0,0 +1,57 @@
+package pkg
+
+import "testing"
+
+// the defaults plus the settings which have none
+func validConfig() Config {
+	cfg := DefaultConfig()
+	cfg.Bucket.Name = "images"
+	cfg.Bucket.ExportsName = "exports"
+	cfg.Bucket.Endpoint = "https://s3.example.com"
+	cfg.Bucket.AccessKey = "access"
+	cfg.Bucket.SecretKey = "secret"
+
+	return cfg
+}
+
+func TestValidateAcceptsDefaults(t *testing.T) {
+	cfg := validConfig()
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// without an exports bucket exports are disabled rather than the server
+// refusing to start
+func TestValidateAllowsNoExportsBucket(t *testing.T) {
+	cfg := validConfig()
+	cfg.Bucket.ExportsName = ""
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Bucket.ExportsEnabled() {
+		t.Fatal("exports enabled without a private bucket")
+	}
+}
+
+func TestValidateBoundsArgon2Params(t *testing.T) {
+	tests := map[string]func(params *Argon2Params){
+		"no memory":        func(params *Argon2Params) { params.Memory = 0 },
+		"no iterations":    func(params *Argon2Params) { params.Iterations = 0 },
+		"no parallelism":   func(params *Argon2Params) { params.Parallelism = 0 },
+		"short salt":       func(params *Argon2Params) { params.SaltLength = 8 },
+		"short key":        func(params *Argon2Params) { params.KeyLength = 15 },
+		"zero salt length": func(params *Argon2Params) { params.SaltLength = 0 },
+	}
+
+	for name, change := range tests {
+		t.Run(name, func(t *testing.T) {
+			cfg := validConfig()
+			change(&cfg.Argon2)
+
+			if err := cfg.Validate(); err == nil {
+				t.Fatalf("%+v was accepted", cfg.Argon2)
+			}
+		})
+	}
+}
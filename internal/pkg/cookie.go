@@ -0,0 +1,27 @@
+package pkg
+
+import (
+	"crypto/subtle"
+)
+
+const (
+	CsrfCookie = "CsrfToken"
+	CsrfHeader = "X-CSRF-Token"
+)
+
+// cookies are not secure and host-only unless configured otherwise, which is
+// what local development wants
+type CookieOptions struct {
+	Secure bool   `env:"COOKIE_SECURE" yaml:"secure" toml:"secure"`
+	Domain string `env:"COOKIE_DOMAIN" yaml:"domain" toml:"domain"`
+}
+
+// double-submit check: the csrf token sent in the header has to match the
+// one stored in the cookie, which a cross-site page can't read.
+func ValidCsrfToken(header string, cookie string) bool {
+	if header == "" || cookie == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(header), []byte(cookie)) == 1
+}
@@ -0,0 +1,84 @@
+package pkg
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// cheap parameters, the defaults make every hash take a while
+var testArgon2Params = Argon2Params{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+func TestHashPassword(t *testing.T) {
+	hash, err := HashPassword(testArgon2Params, "correct horse battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Fatalf("unexpected hash format %s", hash)
+	}
+
+	if ok, err := CheckHashPassword("correct horse battery staple", hash); err != nil || !ok {
+		t.Fatalf("matching passphrase: %v %v", ok, err)
+	}
+	if ok, err := CheckHashPassword("correct horse battery stapler", hash); err != nil || ok {
+		t.Fatalf("other passphrase: %v %v", ok, err)
+	}
+
+	other, err := HashPassword(testArgon2Params, "correct horse battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == hash {
+		t.Fatal("two hashes of the same passphrase share a salt")
+	}
+}
+
+func TestCheckHashPasswordAcceptsBcrypt(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2 but longer"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := CheckHashPassword("hunter2 but longer", string(hash)); err != nil || !ok {
+		t.Fatalf("matching passphrase: %v %v", ok, err)
+	}
+	if ok, err := CheckHashPassword("hunter3 but longer", string(hash)); err != nil || ok {
+		t.Fatalf("other passphrase: %v %v", ok, err)
+	}
+	if !NeedsRehash(testArgon2Params, string(hash)) {
+		t.Fatal("bcrypt hashes should be replaced")
+	}
+}
+
+func TestCheckHashPasswordRejectsUnknownFormats(t *testing.T) {
+	for _, hash := range []string{"", "plain", "$argon2i$v=19$m=1024,t=1,p=1$c2FsdA$a2V5", "$argon2id$v=16$m=1024,t=1,p=1$c2FsdA$a2V5"} {
+		if _, err := CheckHashPassword("x", hash); err != ErrUnknownHashFormat {
+			t.Errorf("%q: want ErrUnknownHashFormat, got %v", hash, err)
+		}
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	hash, err := HashPassword(testArgon2Params, "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if NeedsRehash(testArgon2Params, hash) {
+		t.Fatal("hash made with the current parameters needs a rehash")
+	}
+
+	stronger := testArgon2Params
+	stronger.Iterations = 2
+	if !NeedsRehash(stronger, hash) {
+		t.Fatal("hash made with fewer iterations doesn't need a rehash")
+	}
+
+	longer := testArgon2Params
+	longer.KeyLength = 64
+	if !NeedsRehash(longer, hash) {
+		t.Fatal("hash with a shorter key doesn't need a rehash")
+	}
+}
@@ -2,36 +2,128 @@ package pkg
 
 import (
 	"errors"
-	"os"
+	"fmt"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
-	"github.com/joho/godotenv"
 )
 
-func GenerateJwtToken(userId string) (string, error) {
-	err := godotenv.Load()
+// a challenge token proves the passphrase was correct and is only good for
+// completing a two-factor signin
+const ChallengeTokenTTL = time.Minute * 5
+
+const challengeTokenType = "2fa_challenge"
+
+var ErrInvalidChallengeToken = errors.New("invalid challenge token")
+
+var ErrInvalidAccessToken = errors.New("invalid access token")
+
+// access tokens are short-lived, clients renew them with a refresh token
+const AccessTokenTTL = time.Minute * 15
+
+// how far the clocks of issuer and verifier may drift apart
+const TokenLeeway = time.Second * 30
+
+// the claims of an access token. TokenVersion is compared with the user's
+// token_version, which is how tokens get revoked after a passphrase change.
+// SessionId ties the token to the session it was issued for.
+type AccessClaims struct {
+	TokenVersion int64  `json:"ver"`
+	SessionId    string `json:"sid"`
+	jwt.RegisteredClaims
+}
+
+// the claims of a two-factor challenge token. it is issued for its own
+// audience so it's never accepted as an access token.
+type ChallengeClaims struct {
+	Type string `json:"typ"`
+	jwt.RegisteredClaims
+}
+
+func (cfg JwtConfig) registeredClaims(subject string, audience string, ttl time.Duration) (jwt.RegisteredClaims, error) {
+	jti, err := RandomToken(16)
 	if err != nil {
-		return "", errors.New("Couldn't load environment variables")
+		return jwt.RegisteredClaims{}, err
 	}
 
-	secret := os.Getenv("JWT_SECRET")
-	if secret == "" {
-		return "", errors.New("JWT_SECRET environment variable is not set")
+	now := time.Now()
+	return jwt.RegisteredClaims{
+		ID:        jti,
+		Issuer:    cfg.Issuer,
+		Subject:   subject,
+		Audience:  jwt.ClaimStrings{audience},
+		IssuedAt:  jwt.NewNumericDate(now),
+		NotBefore: jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+	}, nil
+}
+
+func (cfg JwtConfig) parse(ring *KeyRing, tokenString string, claims jwt.Claims, audience string) error {
+	_, err := jwt.ParseWithClaims(tokenString, claims, ring.Keyfunc,
+		jwt.WithValidMethods([]string{SigningAlgEdDSA, SigningAlgRS256}),
+		jwt.WithIssuer(cfg.Issuer),
+		jwt.WithAudience(audience),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(TokenLeeway),
+	)
+	return err
+}
+
+func GenerateJwtToken(ring *KeyRing, cfg JwtConfig, userId string, tokenVersion int64, sessionId string) (string, error) {
+	registered, err := cfg.registeredClaims(userId, cfg.Audience, AccessTokenTTL)
+	if err != nil {
+		return "", err
 	}
 
-	// Generate a JWT token
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"sub": userId,
-		"exp": time.Now().Add(time.Hour*24*7).Unix() * 1000,
+	// Sign and get the complete encoded token as a string using the active key
+	return ring.Sign(AccessClaims{
+		TokenVersion:     tokenVersion,
+		SessionId:        sessionId,
+		RegisteredClaims: registered,
 	})
+}
+
+// verifies an access token. errors from validating the token wrap
+// ErrInvalidAccessToken, expired tokens also wrap jwt.ErrTokenExpired.
+func ParseAccessToken(ring *KeyRing, cfg JwtConfig, tokenString string) (*AccessClaims, error) {
+	claims := &AccessClaims{}
+	err := cfg.parse(ring, tokenString, claims, cfg.Audience)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidAccessToken, err)
+	}
+
+	if claims.Subject == "" || claims.ID == "" {
+		return nil, ErrInvalidAccessToken
+	}
 
-	// Sign and get the complete encoded token as a string using the secret
-	tokenString, err := token.SignedString([]byte(secret))
+	return claims, nil
+}
 
+// issued by Signin when the user has two-factor authentication enabled
+func GenerateChallengeToken(ring *KeyRing, cfg JwtConfig, userId string) (string, error) {
+	registered, err := cfg.registeredClaims(userId, cfg.challengeAudience(), ChallengeTokenTTL)
 	if err != nil {
 		return "", err
 	}
 
-	return tokenString, nil
+	return ring.Sign(ChallengeClaims{
+		Type:             challengeTokenType,
+		RegisteredClaims: registered,
+	})
+}
+
+// verifies a challenge token and returns the user id it was issued for
+func ParseChallengeToken(ring *KeyRing, cfg JwtConfig, tokenString string) (string, error) {
+	claims := &ChallengeClaims{}
+	err := cfg.parse(ring, tokenString, claims, cfg.challengeAudience())
+	if err != nil || claims.Type != challengeTokenType || claims.Subject == "" {
+		return "", ErrInvalidChallengeToken
+	}
+
+	return claims.Subject, nil
+}
+
+func (cfg JwtConfig) challengeAudience() string {
+	return cfg.Audience + ":" + challengeTokenType
 }
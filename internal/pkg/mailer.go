@@ -0,0 +1,107 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Mailer interface {
+	Send(to string, subject string, body string) error
+}
+
+// sends plain text mail through an smtp relay
+type SmtpMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SmtpMailer) Send(to string, subject string, body string) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+
+	msg := strings.Join([]string{
+		"From: " + m.From,
+		"To: " + to,
+		"Subject: " + subject,
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+		"",
+		body,
+	}, "\r\n")
+
+	return smtp.SendMail(m.Host+":"+m.Port, auth, m.From, []string{to}, []byte(msg))
+}
+
+// for local development: appends mail to a file, or writes it to the log when
+// no file is configured
+type LogMailer struct {
+	Path string
+	mu   sync.Mutex
+}
+
+func (m *LogMailer) Send(to string, subject string, body string) error {
+	msg := fmt.Sprintf("--- %s\nTo: %s\nSubject: %s\n\n%s\n", time.Now().Format(time.RFC3339), to, subject, body)
+
+	if m.Path == "" {
+		log.Print(msg)
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, err := os.OpenFile(m.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.WriteString(msg)
+	return err
+}
+
+// picks the mailer from cfg.Mailer, "smtp" or "log"
+func NewMailer(cfg MailConfig) (Mailer, error) {
+	switch cfg.Mailer {
+	case "", "log":
+		return &LogMailer{Path: cfg.LogFile}, nil
+	case "smtp":
+		return &SmtpMailer{
+			Host:     cfg.SmtpHost,
+			Port:     cfg.SmtpPort,
+			Username: cfg.SmtpUsername,
+			Password: cfg.SmtpPassword,
+			From:     cfg.From,
+		}, nil
+	default:
+		return nil, errors.New("mailer must be smtp or log")
+	}
+}
+
+// builds a link for emails from a base url, e.g. the passphrase reset url
+// https://cloudbuddy.app/reset gives https://cloudbuddy.app/reset?token=<token>.
+// without a base url the bare token is returned.
+func TokenLink(baseUrl string, token string) string {
+	if baseUrl == "" {
+		return token
+	}
+
+	separator := "?"
+	if strings.Contains(baseUrl, "?") {
+		separator = "&"
+	}
+
+	return baseUrl + separator + "token=" + token
+}
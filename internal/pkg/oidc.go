@@ -0,0 +1,103 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+var ErrUnknownOidcProvider = errors.New("unknown identity provider")
+
+type OidcProvider struct {
+	Name     string
+	Provider *oidc.Provider
+	Config   oauth2.Config
+}
+
+type OidcClaims struct {
+	Subject           string `json:"sub"`
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	Name              string `json:"name"`
+	PreferredUsername string `json:"preferred_username"`
+	Nonce             string `json:"nonce"`
+}
+
+// discovery documents are fetched once per provider
+var oidcProviders sync.Map
+
+// loads one of the configured identity providers. the scopes default to
+// openid, profile and email.
+func LoadOidcProvider(ctx context.Context, providers map[string]OidcConfig, name string) (*OidcProvider, error) {
+	if cached, ok := oidcProviders.Load(name); ok {
+		return cached.(*OidcProvider), nil
+	}
+
+	cfg, ok := providers[name]
+	if !ok {
+		return nil, ErrUnknownOidcProvider
+	}
+
+	scopes := cfg.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{oidc.ScopeOpenID, "profile", "email"}
+	}
+
+	provider, err := oidc.NewProvider(ctx, cfg.Issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &OidcProvider{
+		Name:     name,
+		Provider: provider,
+		Config: oauth2.Config{
+			ClientID:     cfg.ClientId,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  cfg.RedirectUrl,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       scopes,
+		},
+	}
+
+	oidcProviders.Store(name, p)
+	return p, nil
+}
+
+// builds the authorization url with state, nonce and the S256 pkce challenge
+func (p *OidcProvider) AuthCodeUrl(state string, nonce string, verifier string) string {
+	return p.Config.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+}
+
+// exchanges the authorization code and verifies the returned id token
+// against the provider's jwks, the client id and the expected nonce
+func (p *OidcProvider) Exchange(ctx context.Context, code string, verifier string, nonce string) (*OidcClaims, error) {
+	token, err := p.Config.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return nil, err
+	}
+
+	rawIdToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, errors.New("token response did not contain an id_token")
+	}
+
+	idToken, err := p.Provider.Verifier(&oidc.Config{ClientID: p.Config.ClientID}).Verify(ctx, rawIdToken)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims OidcClaims
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, err
+	}
+
+	if claims.Nonce != nonce {
+		return nil, errors.New("id token nonce does not match")
+	}
+
+	return &claims, nil
+}
@@ -0,0 +1,193 @@
+package pkg
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ccojocar/zxcvbn-go"
+)
+
+// reasons a passphrase is rejected, clients can map the codes to their own
+// messages
+const (
+	PassphraseTooShort         = "too_short"
+	PassphraseTooLong          = "too_long"
+	PassphraseTooWeak          = "too_weak"
+	PassphraseContainsUsername = "contains_username"
+	PassphraseBreached         = "breached"
+)
+
+type PassphraseProblem struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// MinLength counts characters, MaxLength bytes. MinStrength is a zxcvbn score from 0 (guessable) to 4. an empty
+// BreachedListPath turns the breach check off.
+type PassphrasePolicy struct {
+	MinLength        int    `env:"PASSPHRASE_MIN_LENGTH" yaml:"min_length" toml:"min_length"`
+	MaxLength        int    `env:"PASSPHRASE_MAX_LENGTH" yaml:"max_length" toml:"max_length"`
+	MinStrength      int    `env:"PASSPHRASE_MIN_STRENGTH" yaml:"min_strength" toml:"min_strength"`
+	BreachedListPath string `env:"BREACHED_PASSPHRASES_FILE" yaml:"breached_list" toml:"breached_list"`
+}
+
+var DefaultPassphrasePolicy = PassphrasePolicy{
+	MinLength:   8,
+	MaxLength:   256,
+	MinStrength: 2,
+}
+
+// returns everything wrong with passphrase, nothing means it's acceptable.
+// username is used both for the inclusion check and as a hint to the
+// strength estimate.
+func (policy PassphrasePolicy) Check(passphrase string, username string) ([]PassphraseProblem, error) {
+	var problems []PassphraseProblem = []PassphraseProblem{}
+
+	if utf8.RuneCountInString(passphrase) < policy.MinLength {
+		problems = append(problems, PassphraseProblem{
+			Code:    PassphraseTooShort,
+			Message: "passphrase must be at least " + strconv.Itoa(policy.MinLength) + " characters long",
+		})
+	}
+	if len(passphrase) > policy.MaxLength {
+		problems = append(problems, PassphraseProblem{
+			Code:    PassphraseTooLong,
+			Message: "passphrase must be at most " + strconv.Itoa(policy.MaxLength) + " bytes long",
+		})
+		// the estimate gets slow on long input and won't matter anyway
+		return problems, nil
+	}
+
+	if username != "" && strings.Contains(strings.ToLower(passphrase), strings.ToLower(username)) {
+		problems = append(problems, PassphraseProblem{
+			Code:    PassphraseContainsUsername,
+			Message: "passphrase must not contain the username",
+		})
+	}
+
+	if zxcvbn.PasswordStrength(passphrase, []string{username, "cloudbuddy"}).Score < policy.MinStrength {
+		problems = append(problems, PassphraseProblem{
+			Code:    PassphraseTooWeak,
+			Message: "passphrase is too easy to guess",
+		})
+	}
+
+	if policy.BreachedListPath != "" {
+		breached, err := IsPassphraseBreached(policy.BreachedListPath, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		if breached {
+			problems = append(problems, PassphraseProblem{
+				Code:    PassphraseBreached,
+				Message: "passphrase has appeared in a data breach",
+			})
+		}
+	}
+
+	return problems, nil
+}
+
+// looks the passphrase up in an offline copy of the Have I Been Pwned list,
+// one "SHA1:COUNT" line per breached password ordered by hash as written by
+// their downloader. the file is binary searched by the hash prefix, so it's
+// never read as a whole.
+func IsPassphraseBreached(path string, passphrase string) (bool, error) {
+	sum := sha1.Sum([]byte(passphrase))
+	hash := []byte(strings.ToUpper(hex.EncodeToString(sum[:])))
+
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	// the very first line isn't preceded by a newline so lineAfter never
+	// returns it
+	buf := make([]byte, 256)
+	line, err := lineAt(file, buf, 0)
+	if err != nil {
+		return false, err
+	}
+	if bytes.Equal(linePrefix(line, len(hash)), hash) {
+		return true, nil
+	}
+
+	// lineAfter only moves forward as the offset grows, so the first offset
+	// whose line doesn't sort before the hash can be binary searched
+	lo, hi := int64(0), info.Size()
+	for lo < hi {
+		mid := (lo + hi) / 2
+		line, err := lineAfter(file, buf, mid)
+		if err != nil {
+			return false, err
+		}
+
+		if line == nil || bytes.Compare(linePrefix(line, len(hash)), hash) >= 0 {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+
+	line, err = lineAfter(file, buf, lo)
+	if err != nil {
+		return false, err
+	}
+	return line != nil && bytes.Equal(linePrefix(line, len(hash)), hash), nil
+}
+
+// returns the first complete line starting after offset, nil at the end of
+// the file
+func lineAfter(file *os.File, buf []byte, offset int64) ([]byte, error) {
+	n, err := file.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	newline := bytes.IndexByte(buf[:n], '\n')
+	if newline < 0 {
+		return nil, nil
+	}
+
+	return lineAt(file, buf, offset+int64(newline)+1)
+}
+
+func lineAt(file *os.File, buf []byte, offset int64) ([]byte, error) {
+	n, err := file.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, nil
+	}
+
+	line := buf[:n]
+	if end := bytes.IndexByte(line, '\n'); end >= 0 {
+		line = line[:end]
+	}
+
+	return bytes.TrimRight(line, "\r"), nil
+}
+
+func linePrefix(line []byte, n int) []byte {
+	if end := bytes.IndexByte(line, ':'); end >= 0 {
+		line = line[:end]
+	}
+	if len(line) > n {
+		line = line[:n]
+	}
+
+	return bytes.ToUpper(line)
+}
@@ -0,0 +1,134 @@
+package pkg
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// writes a breach list in the downloader's format for the given passphrases
+func writeBreachedList(t *testing.T, passphrases []string, newline string) string {
+	t.Helper()
+
+	lines := make([]string, 0, len(passphrases))
+	for i, passphrase := range passphrases {
+		sum := sha1.Sum([]byte(passphrase))
+		lines = append(lines, strings.ToUpper(hex.EncodeToString(sum[:]))+":"+strconv.Itoa(i+1))
+	}
+	sort.Strings(lines)
+
+	path := filepath.Join(t.TempDir(), "pwned.txt")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, newline)+newline), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestIsPassphraseBreached(t *testing.T) {
+	var breached []string
+	for i := 0; i < 2000; i++ {
+		breached = append(breached, "breached-"+strconv.Itoa(i))
+	}
+
+	for name, newline := range map[string]string{"lf": "\n", "crlf": "\r\n"} {
+		t.Run(name, func(t *testing.T) {
+			path := writeBreachedList(t, breached, newline)
+
+			// every line has to be found, the first and last ones included
+			for _, passphrase := range breached {
+				found, err := IsPassphraseBreached(path, passphrase)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !found {
+					t.Fatalf("%s not found", passphrase)
+				}
+			}
+
+			for i := 0; i < 2000; i++ {
+				found, err := IsPassphraseBreached(path, "safe-"+strconv.Itoa(i))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if found {
+					t.Fatalf("safe-%d found", i)
+				}
+			}
+		})
+	}
+}
+
+func TestIsPassphraseBreachedSmallFiles(t *testing.T) {
+	empty := filepath.Join(t.TempDir(), "empty.txt")
+	if err := os.WriteFile(empty, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if found, err := IsPassphraseBreached(empty, "anything"); err != nil || found {
+		t.Fatalf("empty list: %v %v", found, err)
+	}
+
+	single := writeBreachedList(t, []string{"only"}, "\n")
+	if found, err := IsPassphraseBreached(single, "only"); err != nil || !found {
+		t.Fatalf("single line: %v %v", found, err)
+	}
+	if found, err := IsPassphraseBreached(single, "other"); err != nil || found {
+		t.Fatalf("single line, other passphrase: %v %v", found, err)
+	}
+
+	if _, err := IsPassphraseBreached(filepath.Join(t.TempDir(), "missing.txt"), "x"); err == nil {
+		t.Fatal("a missing list was not an error")
+	}
+}
+
+func TestPassphrasePolicyCheck(t *testing.T) {
+	policy := DefaultPassphrasePolicy
+	policy.BreachedListPath = writeBreachedList(t, []string{"Tr0ub4dor&3 is famous"}, "\n")
+
+	codes := func(passphrase string, username string) []string {
+		problems, err := policy.Check(passphrase, username)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var codes []string
+		for _, problem := range problems {
+			codes = append(codes, problem.Code)
+		}
+		return codes
+	}
+
+	if got := codes("correct horse battery staple", "alice"); len(got) != 0 {
+		t.Fatalf("good passphrase rejected: %v", got)
+	}
+	if got := codes("short", "alice"); !contains(got, PassphraseTooShort) {
+		t.Fatalf("want too_short, got %v", got)
+	}
+	if got := codes(strings.Repeat("a", policy.MaxLength+1), "alice"); !contains(got, PassphraseTooLong) {
+		t.Fatalf("want too_long, got %v", got)
+	}
+	if got := codes("alice-in-wonderland-1865", "Alice"); !contains(got, PassphraseContainsUsername) {
+		t.Fatalf("want contains_username, got %v", got)
+	}
+	if got := codes("password", "alice"); !contains(got, PassphraseTooWeak) {
+		t.Fatalf("want too_weak, got %v", got)
+	}
+	if got := codes("Tr0ub4dor&3 is famous", "alice"); !contains(got, PassphraseBreached) {
+		t.Fatalf("want breached, got %v", got)
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
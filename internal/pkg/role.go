@@ -0,0 +1,62 @@
+package pkg
+
+import (
+	"slices"
+)
+
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// permissions cover acting on resources owned by someone else, owners may
+// always act on their own resources
+const (
+	PermissionDeleteAnyImage = "images:delete:any"
+	PermissionEditAnyImage   = "images:edit:any"
+	PermissionManageUsers    = "users:manage"
+)
+
+// the central authorization policy, every role check goes through this table
+var rolePermissions = map[string][]string{
+	RoleUser:      {},
+	RoleModerator: {PermissionDeleteAnyImage},
+	RoleAdmin:     {PermissionDeleteAnyImage, PermissionEditAnyImage, PermissionManageUsers},
+}
+
+func ValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// returns the role of a user, users created before roles existed are
+// regular users
+func RoleOf(user *User) string {
+	if !ValidRole(user.Role) {
+		return RoleUser
+	}
+
+	return user.Role
+}
+
+func HasPermission(user *User, permission string) bool {
+	return slices.Contains(rolePermissions[RoleOf(user)], permission)
+}
+
+// reports whether have grants every permission role does
+func RoleCovers(have string, role string) bool {
+	for _, permission := range rolePermissions[role] {
+		if !slices.Contains(rolePermissions[have], permission) {
+			return false
+		}
+	}
+
+	return ValidRole(role)
+}
+
+// reports whether user may act on a resource owned by ownerId, either as the
+// owner or through permission
+func CanActOn(user *User, ownerId string, permission string) bool {
+	return user.UUID == ownerId || HasPermission(user, permission)
+}
@@ -0,0 +1,64 @@
+package pkg
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+)
+
+// refresh tokens outlive access tokens by a lot, every refresh rotates them
+const RefreshTokenTTL = time.Hour * 24 * 30
+
+// a session remembers this many of its latest used refresh tokens. reusing
+// one of them revokes the session, older ones are only refused like any
+// unknown token.
+const UsedRefreshHashesKept = 20
+
+// users without a passphrase confirm sensitive changes by having signed in
+// this recently
+const RecentSigninWindow = 10 * time.Minute
+
+var ErrMalformedRefreshToken = errors.New("malformed refresh token")
+
+// generates a new opaque refresh token for the given session along with the
+// hash that should be persisted. the session id is part of the token so the
+// session can be looked up without an index on the hash.
+func GenerateRefreshToken(sessionId string) (string, string, error) {
+	secret, err := RandomToken(32)
+	if err != nil {
+		return "", "", err
+	}
+
+	token := sessionId + "." + secret
+	return token, HashToken(token), nil
+}
+
+// splits a refresh token into its session id and returns it with the token hash
+func ParseRefreshToken(token string) (string, string, error) {
+	sessionId, secret, found := strings.Cut(token, ".")
+	if !found || sessionId == "" || secret == "" {
+		return "", "", ErrMalformedRefreshToken
+	}
+
+	return sessionId, HashToken(token), nil
+}
+
+// returns n random bytes encoded as url safe base64
+func RandomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// high-entropy tokens don't need a slow hash, sha256 is enough
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
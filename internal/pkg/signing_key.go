@@ -0,0 +1,268 @@
+package pkg
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	SigningAlgEdDSA = "EdDSA"
+	SigningAlgRS256 = "RS256"
+)
+
+var ErrUnknownSigningKey = errors.New("unknown signing key")
+
+// a key tokens are signed or verified with. Private is nil for keys which are
+// only kept around to verify tokens, e.g. the public key of a retired key.
+type SigningKey struct {
+	Kid     string
+	Alg     string
+	Private crypto.Signer
+	Public  crypto.PublicKey
+}
+
+// every key in the key directory is used to verify tokens and published in
+// the jwks, only the active one signs new tokens
+type KeyRing struct {
+	Active *SigningKey
+	Keys   map[string]*SigningKey
+}
+
+// a json web key as served from /.well-known/jwks.json
+type Jwk struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+// returns the key ring loaded from cfg.KeysDir (JWT_KEYS_DIR). each <kid>.pem
+// file holds a PKCS#8 Ed25519 or RSA private key, or just a public key. the
+// active key is cfg.ActiveKid (JWT_ACTIVE_KID), or else the private key whose
+// kid sorts last. an empty directory is an error, create the first key with
+// `go run ./cmd/jwtkey`. with cfg.GenerateKey (JWT_GENERATE_KEY) an Ed25519
+// key is generated instead, every replica would sign with its own key
+// otherwise.
+//
+// main loads the key ring once at startup and hands it to everything signing
+// or verifying tokens, so rotating goes:
+//  1. add a key with `go run ./cmd/jwtkey` while pinning JWT_ACTIVE_KID to the
+//     current key, restart. the new key is published but doesn't sign yet.
+//  2. once verifiers have refreshed the jwks, point JWT_ACTIVE_KID at the new
+//     key and restart.
+//  3. after AccessTokenTTL has passed, delete the old key file, or replace it
+//     with its public key if old tokens must stay verifiable, and restart.
+func LoadKeyRing(cfg JwtConfig) (*KeyRing, error) {
+	dir, activeKid := cfg.KeysDir, cfg.ActiveKid
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(paths) == 0 {
+		if !cfg.GenerateKey {
+			return nil, fmt.Errorf("no signing keys in %s, create one with `go run ./cmd/jwtkey -dir %s` or set JWT_GENERATE_KEY=true", dir, dir)
+		}
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+		path, err := GenerateSigningKey(dir, SigningAlgEdDSA)
+		if err != nil {
+			return nil, err
+		}
+		paths = []string{path}
+	}
+
+	sort.Strings(paths)
+
+	ring := &KeyRing{Keys: map[string]*SigningKey{}}
+	for _, path := range paths {
+		key, err := readSigningKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading signing key %s: %w", path, err)
+		}
+
+		ring.Keys[key.Kid] = key
+		if key.Private != nil && activeKid == "" {
+			ring.Active = key
+		}
+	}
+
+	if activeKid != "" {
+		ring.Active = ring.Keys[activeKid]
+	}
+	if ring.Active == nil || ring.Active.Private == nil {
+		return nil, errors.New("no private signing key available, check JWT_ACTIVE_KID")
+	}
+
+	return ring, nil
+}
+
+func readSigningKey(path string) (*SigningKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no pem block found")
+	}
+
+	key := &SigningKey{Kid: strings.TrimSuffix(filepath.Base(path), ".pem")}
+
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := parsed.(crypto.Signer)
+		if !ok {
+			return nil, errors.New("unsupported private key type")
+		}
+		key.Private = signer
+		key.Public = signer.Public()
+	case "PUBLIC KEY":
+		key.Public, err = x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("unsupported pem block " + block.Type)
+	}
+
+	switch key.Public.(type) {
+	case ed25519.PublicKey:
+		key.Alg = SigningAlgEdDSA
+	case *rsa.PublicKey:
+		key.Alg = SigningAlgRS256
+	default:
+		return nil, errors.New("only Ed25519 and RSA keys are supported")
+	}
+
+	return key, nil
+}
+
+// writes a new private key to dir and returns its path. the kid is derived
+// from the current time so newer keys sort last.
+func GenerateSigningKey(dir string, alg string) (string, error) {
+	var private crypto.Signer
+	var err error
+
+	switch alg {
+	case SigningAlgEdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	case SigningAlgRS256:
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	default:
+		return "", errors.New("unsupported signing algorithm " + alg)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return "", err
+	}
+
+	suffix, err := RandomToken(3)
+	if err != nil {
+		return "", err
+	}
+	kid := time.Now().UTC().Format("20060102T150405") + "-" + strings.ToLower(strings.NewReplacer("_", "", "-", "").Replace(suffix))
+	path := filepath.Join(dir, kid+".pem")
+
+	err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+func (key *SigningKey) Method() jwt.SigningMethod {
+	if key.Alg == SigningAlgRS256 {
+		return jwt.SigningMethodRS256
+	}
+
+	return jwt.SigningMethodEdDSA
+}
+
+// signs claims with the active key, the kid header tells verifiers which key
+// to use
+func (ring *KeyRing) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(ring.Active.Method(), claims)
+	token.Header["kid"] = ring.Active.Kid
+
+	return token.SignedString(ring.Active.Private)
+}
+
+// a jwt.Keyfunc which picks the verification key by the token's kid and makes
+// sure the token was signed with that key's algorithm
+func (ring *KeyRing) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	key, ok := ring.Keys[kid]
+	if !ok {
+		return nil, ErrUnknownSigningKey
+	}
+
+	if token.Method.Alg() != key.Alg {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+
+	return key.Public, nil
+}
+
+// the public keys of the ring as a json web key set
+func (ring *KeyRing) Jwks() []Jwk {
+	var keys []Jwk = []Jwk{}
+
+	kids := make([]string, 0, len(ring.Keys))
+	for kid := range ring.Keys {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+
+	for _, kid := range kids {
+		key := ring.Keys[kid]
+		jwk := Jwk{Use: "sig", Alg: key.Alg, Kid: key.Kid}
+
+		switch public := key.Public.(type) {
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		}
+
+		keys = append(keys, jwk)
+	}
+
+	return keys
+}
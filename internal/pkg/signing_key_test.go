@@ -0,0 +1,57 @@
+package pkg
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadKeyRingRequiresKeys(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "keys")
+
+	if _, err := LoadKeyRing(JwtConfig{KeysDir: dir}); err == nil {
+		t.Fatal("an empty key directory was accepted")
+	}
+
+	ring, err := LoadKeyRing(JwtConfig{KeysDir: dir, GenerateKey: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ring.Active == nil || ring.Active.Alg != SigningAlgEdDSA {
+		t.Fatalf("unexpected active key %+v", ring.Active)
+	}
+
+	// the generated key is used from then on
+	again, err := LoadKeyRing(JwtConfig{KeysDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Active.Kid != ring.Active.Kid {
+		t.Fatalf("want key %s, got %s", ring.Active.Kid, again.Active.Kid)
+	}
+}
+
+func TestLoadKeyRingPicksActiveKey(t *testing.T) {
+	dir := t.TempDir()
+
+	first, err := GenerateSigningKey(dir, SigningAlgEdDSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GenerateSigningKey(dir, SigningAlgRS256); err != nil {
+		t.Fatal(err)
+	}
+
+	// pinned to the older key while the new one is published
+	firstKid := filepath.Base(first[:len(first)-len(".pem")])
+	ring, err := LoadKeyRing(JwtConfig{KeysDir: dir, ActiveKid: firstKid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ring.Active.Kid != firstKid || len(ring.Keys) != 2 || len(ring.Jwks()) != 2 {
+		t.Fatalf("want %s active out of 2 keys, got %s out of %d", firstKid, ring.Active.Kid, len(ring.Keys))
+	}
+
+	if _, err := LoadKeyRing(JwtConfig{KeysDir: dir, ActiveKid: "missing"}); err == nil {
+		t.Fatal("an unknown active kid was accepted")
+	}
+}
@@ -0,0 +1,75 @@
+package pkg
+
+import (
+	"sync"
+	"time"
+)
+
+// how failed signin attempts are punished. the first FreeAttempts failures
+// within Window go unpunished, after that each failure doubles the wait
+// starting at BaseDelay up to MaxDelay. from LockoutAfter failures on the key
+// is locked for LockoutDuration.
+type ThrottlePolicy struct {
+	FreeAttempts    int64
+	BaseDelay       time.Duration
+	MaxDelay        time.Duration
+	LockoutAfter    int64
+	LockoutDuration time.Duration
+	Window          time.Duration
+}
+
+var UsernameThrottle = ThrottlePolicy{
+	FreeAttempts:    3,
+	BaseDelay:       time.Second,
+	MaxDelay:        time.Minute * 5,
+	LockoutAfter:    10,
+	LockoutDuration: time.Minute * 15,
+	Window:          time.Hour,
+}
+
+// many users can share an ip, so it gets more slack
+var IpThrottle = ThrottlePolicy{
+	FreeAttempts:    20,
+	BaseDelay:       time.Second,
+	MaxDelay:        time.Minute * 5,
+	LockoutAfter:    100,
+	LockoutDuration: time.Hour,
+	Window:          time.Hour,
+}
+
+// returns until when further attempts are refused after failures failed
+// attempts, the last one at lastFailure
+func (policy ThrottlePolicy) BlockedUntil(failures int64, lastFailure time.Time) time.Time {
+	if failures >= policy.LockoutAfter {
+		return lastFailure.Add(policy.LockoutDuration)
+	}
+	if failures <= policy.FreeAttempts {
+		return time.Time{}
+	}
+
+	delay := policy.BaseDelay
+	for i := policy.FreeAttempts + 1; i < failures && delay < policy.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > policy.MaxDelay {
+		delay = policy.MaxDelay
+	}
+
+	return lastFailure.Add(delay)
+}
+
+var (
+	dummyHash     string
+	dummyHashOnce sync.Once
+)
+
+// spends as much time as checking a real passphrase, so unknown usernames
+// can't be told apart from wrong passphrases by timing
+func DummyCheckPassword(params Argon2Params, password string) {
+	dummyHashOnce.Do(func() {
+		secret, _ := RandomToken(32)
+		dummyHash, _ = HashPassword(params, secret)
+	})
+
+	CheckHashPassword(password, dummyHash)
+}
@@ -0,0 +1,110 @@
+package pkg
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"image/png"
+	"strings"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+const (
+	totpIssuer        = "CloudBuddy"
+	totpPeriod        = 30
+	recoveryCodeCount = 10
+)
+
+type TotpKey struct {
+	Secret string
+	Url    string
+	// png of the otpauth url, encoded as a data uri
+	QrCode string
+}
+
+// generates a new totp secret for the given account
+func GenerateTotpKey(accountName string) (TotpKey, error) {
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      totpIssuer,
+		AccountName: accountName,
+	})
+	if err != nil {
+		return TotpKey{}, err
+	}
+
+	img, err := key.Image(256, 256)
+	if err != nil {
+		return TotpKey{}, err
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return TotpKey{}, err
+	}
+
+	return TotpKey{
+		Secret: key.Secret(),
+		Url:    key.URL(),
+		QrCode: "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()),
+	}, nil
+}
+
+// checks code against secret, allowing one period of clock skew either way,
+// and returns the time step it belongs to. steps up to lastStep were used
+// already and are refused, so a code can't be replayed while it's valid.
+func ValidateTotpCode(code string, secret string, lastStep int64) (int64, bool) {
+	code = strings.TrimSpace(code)
+	current := time.Now().Unix() / totpPeriod
+
+	for step := current - 1; step <= current+1; step++ {
+		if step <= lastStep {
+			continue
+		}
+
+		expected, err := totp.GenerateCodeCustom(secret, time.Unix(step*totpPeriod, 0), totp.ValidateOpts{
+			Period:    totpPeriod,
+			Digits:    otp.DigitsSix,
+			Algorithm: otp.AlgorithmSHA1,
+		})
+		if err != nil {
+			return 0, false
+		}
+
+		if subtle.ConstantTimeCompare([]byte(code), []byte(expected)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+// generates one-time recovery codes and the hashes that should be persisted
+func GenerateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+
+		code := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b))
+		code = code[:8] + "-" + code[8:]
+		codes = append(codes, code)
+		hashes = append(hashes, HashRecoveryCode(code))
+	}
+
+	return codes, hashes, nil
+}
+
+// recovery codes are compared case-insensitively and without the dash
+func HashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	return HashToken(code)
+}
@@ -5,17 +5,155 @@ import "time"
 type Image struct {
 	UUID      string    `clover:"_id" json:"uuid"`
 	Title     string    `clover:"title" json:"title"`
-	Url       string    `clover:"url" json:"image_url"`
+	Url       string    `clover:"url,omitempty" json:"image_url"`
+	Key       string    `clover:"key" json:"-"`
+	Backend   string    `clover:"backend" json:"-"`
 	Likes     int64     `clover:"likes" json:"likes"`
 	UserId    string    `clover:"user_id" json:"user_id"`
 	CreatedAt time.Time `clover:"created_at" json:"created_at"`
 }
 
 type User struct {
+	UUID              string    `clover:"_id" json:"uuid"`
+	Username          string    `clover:"username" json:"username"`
+	UsernameKey       string    `clover:"username_key" json:"-"`
+	Fullname          string    `clover:"fullname" json:"fullname"`
+	Email             string    `clover:"email" json:"email"`
+	EmailVerified     bool      `clover:"email_verified" json:"email_verified"`
+	Role              string    `clover:"role" json:"role"`
+	Passphrase        string    `clover:"passphrase" json:"-"`
+	TokenVersion      int64     `clover:"token_version" json:"-"`
+	TotpEnabled       bool      `clover:"totp_enabled" json:"totp_enabled"`
+	TotpSecret        string    `clover:"totp_secret" json:"-"`
+	TotpPendingSecret string    `clover:"totp_pending_secret" json:"-"`
+	TotpLastStep      int64     `clover:"totp_last_step" json:"-"`
+	RecoveryCodes     []string  `clover:"recovery_codes" json:"-"`
+	Images            []string  `clover:"images" json:"images"`
+	CreatedAt         time.Time `clover:"created_at" json:"created_at"`
+}
+
+type Export struct {
+	UUID        string    `clover:"_id" json:"uuid"`
+	UserId      string    `clover:"user_id" json:"user_id"`
+	Status      string    `clover:"status" json:"status"`
+	Key         string    `clover:"key" json:"-"`
+	CreatedAt   time.Time `clover:"created_at" json:"created_at"`
+	CompletedAt time.Time `clover:"completed_at" json:"completed_at"`
+	ExpiresAt   time.Time `clover:"expires_at" json:"expires_at"`
+}
+
+const (
+	ExportStatusPending = "pending"
+	ExportStatusReady   = "ready"
+	ExportStatusFailed  = "failed"
+	ExportStatusExpired = "expired"
+)
+
+// a session is one signin, the refresh tokens rotated within it form a family
+// and reusing any of the old ones revokes the whole session
+type Session struct {
 	UUID       string    `clover:"_id" json:"uuid"`
-	Username   string    `clover:"username" json:"username"`
-	Fullname   string    `clover:"fullname" json:"fullname"`
-	Passphrase string    `clover:"passphrase" json:"-"`
-	Images     []string  `clover:"images" json:"images"`
+	UserId     string    `clover:"user_id" json:"user_id"`
+	TokenHash  string    `clover:"token_hash" json:"-"`
+	UsedHashes []string  `clover:"used_hashes" json:"-"`
+	Revoked    bool      `clover:"revoked" json:"-"`
+	UserAgent  string    `clover:"user_agent" json:"user_agent"`
+	IP         string    `clover:"ip" json:"ip"`
+	ExpiresAt  time.Time `clover:"expires_at" json:"expires_at"`
+	LastUsedAt time.Time `clover:"last_used_at" json:"last_used_at"`
 	CreatedAt  time.Time `clover:"created_at" json:"created_at"`
 }
+
+// a webauthn credential (passkey) registered by a user. the library's
+// credential record is kept json encoded in Credential.
+type Credential struct {
+	UUID         string    `clover:"_id" json:"uuid"`
+	UserId       string    `clover:"user_id" json:"user_id"`
+	CredentialId string    `clover:"credential_id" json:"credential_id"`
+	Name         string    `clover:"name" json:"name"`
+	Credential   string    `clover:"credential" json:"-"`
+	LastUsedAt   time.Time `clover:"last_used_at" json:"last_used_at"`
+	CreatedAt    time.Time `clover:"created_at" json:"created_at"`
+}
+
+// links a user to an account at an external identity provider
+type Identity struct {
+	UUID      string    `clover:"_id" json:"uuid"`
+	UserId    string    `clover:"user_id" json:"user_id"`
+	Provider  string    `clover:"provider" json:"provider"`
+	Subject   string    `clover:"subject" json:"subject"`
+	Email     string    `clover:"email" json:"email"`
+	CreatedAt time.Time `clover:"created_at" json:"created_at"`
+}
+
+// a single-use passphrase reset token, only its hash is stored
+type PassphraseReset struct {
+	UUID      string    `clover:"_id" json:"uuid"`
+	UserId    string    `clover:"user_id" json:"user_id"`
+	TokenHash string    `clover:"token_hash" json:"-"`
+	Used      bool      `clover:"used" json:"used"`
+	ExpiresAt time.Time `clover:"expires_at" json:"expires_at"`
+	CreatedAt time.Time `clover:"created_at" json:"created_at"`
+}
+
+// a token mailed to confirm an email address, only its hash is stored
+type EmailVerification struct {
+	UUID      string    `clover:"_id" json:"uuid"`
+	UserId    string    `clover:"user_id" json:"user_id"`
+	Email     string    `clover:"email" json:"email"`
+	TokenHash string    `clover:"token_hash" json:"-"`
+	Used      bool      `clover:"used" json:"used"`
+	ExpiresAt time.Time `clover:"expires_at" json:"expires_at"`
+	CreatedAt time.Time `clover:"created_at" json:"created_at"`
+}
+
+// a personal api key for scripts, only the hash of the key is stored
+type ApiKey struct {
+	UUID       string    `clover:"_id" json:"uuid"`
+	UserId     string    `clover:"user_id" json:"user_id"`
+	Name       string    `clover:"name" json:"name"`
+	Prefix     string    `clover:"prefix" json:"prefix"`
+	KeyHash    string    `clover:"key_hash" json:"-"`
+	Scopes     []string  `clover:"scopes" json:"scopes"`
+	LastUsedAt time.Time `clover:"last_used_at" json:"last_used_at"`
+	CreatedAt  time.Time `clover:"created_at" json:"created_at"`
+}
+
+// an access token revoked before it expired, e.g. on signout. the entry is
+// only needed until the token expires.
+type RevokedToken struct {
+	Jti       string    `clover:"jti" json:"jti"`
+	UserId    string    `clover:"user_id" json:"user_id"`
+	ExpiresAt time.Time `clover:"expires_at" json:"expires_at"`
+	CreatedAt time.Time `clover:"created_at" json:"created_at"`
+}
+
+// failed signins counted under a throttle key, a username or a client ip
+type SigninAttempt struct {
+	Key           string    `clover:"key" json:"key"`
+	Failures      int64     `clover:"failures" json:"failures"`
+	LastFailureAt time.Time `clover:"last_failure_at" json:"last_failure_at"`
+}
+
+// the state of a webauthn ceremony between its begin and finish requests.
+// the library's session data is kept json encoded in Session.
+type WebAuthnChallenge struct {
+	UUID      string    `clover:"_id" json:"uuid"`
+	Kind      string    `clover:"kind" json:"kind"`
+	Session   string    `clover:"session" json:"-"`
+	ExpiresAt time.Time `clover:"expires_at" json:"expires_at"`
+	CreatedAt time.Time `clover:"created_at" json:"created_at"`
+}
+
+// a login at an identity provider in progress. UserId is set when the
+// identity is linked to a signed in user instead.
+type OidcState struct {
+	UUID      string    `clover:"_id" json:"uuid"`
+	Provider  string    `clover:"provider" json:"provider"`
+	State     string    `clover:"state" json:"-"`
+	Nonce     string    `clover:"nonce" json:"-"`
+	Verifier  string    `clover:"verifier" json:"-"`
+	UserId    string    `clover:"user_id" json:"user_id"`
+	ExpiresAt time.Time `clover:"expires_at" json:"expires_at"`
+	CreatedAt time.Time `clover:"created_at" json:"created_at"`
+}
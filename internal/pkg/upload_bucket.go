@@ -6,72 +6,213 @@ import (
 	"fmt"
 	"io"
 	"mime/multipart"
-	"os"
+	"net/url"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/joho/godotenv"
 )
 
-// prefix is basically an optional string which gets prepended to name of the file
-func UploadToBucket(file *multipart.FileHeader, prefix string) error {
-	err := godotenv.Load()
+// newBucketClient builds an s3 client for the configured bucket
+func newBucketClient(cfg BucketConfig) (*s3.S3, error) {
+	sess, err := session.NewSession(&aws.Config{
+		Region:           aws.String(cfg.Region),
+		Endpoint:         aws.String(cfg.Endpoint),
+		S3ForcePathStyle: aws.Bool(cfg.PathStyle),
+		Credentials:      credentials.NewStaticCredentials(cfg.AccessKey, cfg.SecretKey, ""),
+	})
 	if err != nil {
-		return errors.New(fmt.Sprintf("Error loading environment variables: %s", err.Error()))
+		return nil, errors.New(fmt.Sprintf("Error creating session: %s", err.Error()))
 	}
 
-	accessKey := os.Getenv("BUCKET_ACCESS_KEY")
-	secretKey := os.Getenv("BUCKET_SECRET_KEY")
-	bucketName := os.Getenv("BUCKET_NAME")
-	endpoint := os.Getenv("BUCKET_ENDPOINT")
-
-	if accessKey == "" || secretKey == "" || bucketName == "" {
-		return errors.New(fmt.Sprintf("Environment variables are not loaded correctly"))
-	}
+	return s3.New(sess), nil
+}
 
-	sess, err := session.NewSession(&aws.Config{
-		Region:      aws.String("us-west-2"),
-		Endpoint:    aws.String(endpoint),
-		Credentials: credentials.NewStaticCredentials(accessKey, secretKey, ""),
-	})
+// prefix is basically an optional string which gets prepended to name of the file.
+// returns the key the file was stored under.
+func UploadToBucket(cfg BucketConfig, file *multipart.FileHeader, prefix string) (string, error) {
+	client, err := newBucketClient(cfg)
 	if err != nil {
-		return errors.New(fmt.Sprintf("Error creating session: %s", err.Error()))
+		return "", err
 	}
 
-	client := s3.New(sess)
-
 	f, err := file.Open()
-	defer f.Close()
 	if err != nil {
-		return errors.New(fmt.Sprintf("Error opening file: %s", err.Error()))
+		return "", errors.New(fmt.Sprintf("Error opening file: %s", err.Error()))
 	}
+	defer f.Close()
 
 	// Read the contents of the file into a buffer
 	var buf bytes.Buffer
 	if _, err := io.Copy(&buf, f); err != nil {
-		return errors.New(fmt.Sprintf("Error reading file: %s", err.Error()))
+		return "", errors.New(fmt.Sprintf("Error reading file: %s", err.Error()))
 	}
 
-	destinationKey := strings.Join([]string{
-		"cloudbuddy/",
-		prefix,
-		"-",
-		file.Filename,
-	}, "")
+	destinationKey := cfg.ObjectKey(prefix + "-" + file.Filename)
 
 	// This uploads the contents of the buffer to S3
 	_, err = client.PutObject(&s3.PutObjectInput{
-		Bucket: aws.String(bucketName),
-		Key:    aws.String(destinationKey),
-		Body:   bytes.NewReader(buf.Bytes()),
+		Bucket:      aws.String(cfg.Name),
+		Key:         aws.String(destinationKey),
+		Body:        bytes.NewReader(buf.Bytes()),
+		ContentType: aws.String(file.Header.Get("Content-Type")),
 	})
 
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Error uploading file: %s", err.Error()))
+	}
+
+	return destinationKey, nil
+}
+
+// uploads raw bytes to the bucket under the given key
+func UploadBytesToBucket(cfg BucketConfig, key string, body []byte, contentType string) error {
+	client, err := newBucketClient(cfg)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(cfg.Name),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String(contentType),
+	})
 	if err != nil {
 		return errors.New(fmt.Sprintf("Error uploading file: %s", err.Error()))
 	}
 
 	return nil
 }
+
+// removes the object stored under key, removing a missing object is fine
+func DeleteFromBucket(cfg BucketConfig, key string) error {
+	client, err := newBucketClient(cfg)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(cfg.Name),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error deleting file: %s", err.Error()))
+	}
+
+	return nil
+}
+
+// reads the whole object stored under key
+func DownloadFromBucket(cfg BucketConfig, key string) ([]byte, error) {
+	client, err := newBucketClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(cfg.Name),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error downloading file: %s", err.Error()))
+	}
+	defer out.Body.Close()
+
+	body, err := io.ReadAll(out.Body)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error reading file: %s", err.Error()))
+	}
+
+	return body, nil
+}
+
+// returns a pre-signed GET url for key which stops working after expiry
+func PresignBucketObject(cfg BucketConfig, key string, expiry time.Duration) (string, error) {
+	client, err := newBucketClient(cfg)
+	if err != nil {
+		return "", err
+	}
+
+	req, _ := client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(cfg.Name),
+		Key:    aws.String(key),
+	})
+
+	url, err := req.Presign(expiry)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Error presigning url: %s", err.Error()))
+	}
+
+	return url, nil
+}
+
+// the key an object called name is stored under, every key we write starts
+// with KeyPrefix
+func (cfg BucketConfig) ObjectKey(name string) string {
+	return cfg.KeyPrefix + name
+}
+
+// the bucket export archives go to. they must never be publicly readable, so
+// unless ExportsName names a separate bucket they only share the image bucket
+// when that one is private and served through signed urls.
+func (cfg BucketConfig) Exports() BucketConfig {
+	if cfg.ExportsName != "" {
+		cfg.Name = cfg.ExportsName
+	}
+
+	return cfg
+}
+
+// exports are off when there is no private bucket to keep them in
+func (cfg BucketConfig) ExportsEnabled() bool {
+	return cfg.ExportsName != "" || cfg.SignedUrls
+}
+
+// the url clients fetch the object stored under key from. it is computed
+// whenever an object is served, so moving the bucket or putting a cdn in
+// front only takes a config change.
+func (cfg BucketConfig) ObjectUrl(key string) string {
+	escaped := escapeKey(key)
+
+	if cfg.PublicBaseUrl != "" {
+		return strings.TrimSuffix(cfg.PublicBaseUrl, "/") + "/" + escaped
+	}
+
+	endpoint := strings.TrimSuffix(cfg.Endpoint, "/")
+	if cfg.PathStyle {
+		return endpoint + "/" + cfg.Name + "/" + escaped
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return endpoint + "/" + cfg.Name + "/" + escaped
+	}
+	u.Host = cfg.Name + "." + u.Host
+
+	return u.String() + "/" + escaped
+}
+
+// escapes every segment of key for use in a url path
+func escapeKey(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+
+	return strings.Join(segments, "/")
+}
+
+// derives the object key from an image url stored by PostImage before images
+// kept their key (<bucket endpoint>/<bucket name>/cloudbuddy/<key>)
+func ObjectKeyFromUrl(url string) string {
+	idx := strings.Index(url, "/cloudbuddy/")
+	if idx == -1 {
+		return ""
+	}
+
+	return url[idx+1:]
+}
@@ -0,0 +1,37 @@
+package pkg
+
+import (
+	"fmt"
+	"time"
+)
+
+// the backend images are stored in. it is kept with every image next to
+// the key so the url can be resolved however the backend is set up.
+const StorageBackendS3 = "s3"
+
+// produces the urls clients fetch stored objects from
+type UrlResolver interface {
+	Resolve(backend string, key string) (string, error)
+}
+
+type bucketUrlResolver struct {
+	cfg BucketConfig
+}
+
+// resolves objects in the bucket to public or cdn urls, see ObjectUrl, or to
+// pre-signed urls if SignedUrls is set
+func NewUrlResolver(cfg BucketConfig) UrlResolver {
+	return &bucketUrlResolver{cfg: cfg}
+}
+
+func (r *bucketUrlResolver) Resolve(backend string, key string) (string, error) {
+	if backend != StorageBackendS3 {
+		return "", fmt.Errorf("unknown storage backend %q", backend)
+	}
+
+	if r.cfg.SignedUrls {
+		return PresignBucketObject(r.cfg, key, time.Duration(r.cfg.SignedUrlTtl)*time.Second)
+	}
+
+	return r.cfg.ObjectUrl(key), nil
+}
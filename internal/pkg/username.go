@@ -0,0 +1,95 @@
+package pkg
+
+import (
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	uuid "github.com/satori/go.uuid"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	UsernameMinLength = 3
+	UsernameMaxLength = 30
+)
+
+// reasons a username is rejected
+const (
+	UsernameTooShort     = "too_short"
+	UsernameTooLong      = "too_long"
+	UsernameInvalidChars = "invalid_characters"
+	UsernameReserved     = "reserved"
+	UsernameTaken        = "taken"
+)
+
+type UsernameError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (err *UsernameError) Error() string {
+	return err.Message
+}
+
+var usernamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]*$`)
+
+// names that would be confused with the service, its staff or its routes
+var reservedUsernames = []string{
+	"admin", "administrator", "root", "system", "sysadmin", "superuser",
+	"moderator", "mod", "staff", "support", "help", "security", "abuse",
+	"postmaster", "webmaster", "hostmaster", "noreply", "no-reply",
+	"cloudbuddy", "official", "team",
+	"me", "you", "user", "users", "api", "auth", "signin", "signup", "signout",
+	"login", "logout", "register", "account", "settings", "images", "image",
+	"www", "mail", "null", "undefined", "anonymous", "everyone",
+}
+
+// returns the username to display, NFKC normalized so look-alike compatibility
+// characters collapse, and the case-folded key usernames are compared by.
+// the error is a *UsernameError when the username breaks a rule.
+func NormalizeUsername(username string) (string, string, error) {
+	display := norm.NFKC.String(strings.TrimSpace(username))
+	key := UsernameKey(display)
+
+	if len(key) < UsernameMinLength {
+		return "", "", &UsernameError{
+			Code:    UsernameTooShort,
+			Message: "username must be at least " + strconv.Itoa(UsernameMinLength) + " characters long",
+		}
+	}
+	if len(key) > UsernameMaxLength {
+		return "", "", &UsernameError{
+			Code:    UsernameTooLong,
+			Message: "username must be at most " + strconv.Itoa(UsernameMaxLength) + " characters long",
+		}
+	}
+	if !usernamePattern.MatchString(key) {
+		return "", "", &UsernameError{
+			Code:    UsernameInvalidChars,
+			Message: "username may only contain letters a-z, digits, '.', '_' and '-' and must start with a letter or digit",
+		}
+	}
+	if slices.Contains(reservedUsernames, key) {
+		return "", "", &UsernameError{
+			Code:    UsernameReserved,
+			Message: "username is reserved",
+		}
+	}
+
+	return display, key, nil
+}
+
+// the key to look a username up by, without enforcing the rules. used for
+// signin, where rejecting old usernames would lock their owners out.
+func UsernameKey(username string) string {
+	return norm.NFKC.String(cases.Fold().String(norm.NFKC.String(strings.TrimSpace(username))))
+}
+
+// the _id of the claim on a username key. clover only takes uuids as ids, so
+// it's a name based uuid of the key.
+func UsernameClaimId(key string) string {
+	return uuid.NewV5(uuid.NamespaceURL, "cloudbuddy:username:"+key).String()
+}
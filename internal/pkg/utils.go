@@ -1,6 +1,10 @@
 package pkg
 
-import "fmt"
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+)
 
 func ConvertInterfaceSliceToXSlice[T comparable](slice []interface{}) ([]T, bool) {
 	var assertedSlice []T = []T{}
@@ -25,3 +29,16 @@ func RemoveByValue[T comparable](slice []T, value T) []T {
 
 	return slice
 }
+
+// lowercases and validates an email address, ok is false for anything that
+// isn't a bare address
+func NormalizeEmail(email string) (string, bool) {
+	email = strings.ToLower(strings.TrimSpace(email))
+
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return "", false
+	}
+
+	return email, true
+}
@@ -0,0 +1,50 @@
+package pkg
+
+import (
+	"errors"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// adapts a user document and its stored credentials to webauthn.User
+type WebAuthnUser struct {
+	Id          string
+	Name        string
+	DisplayName string
+	Credentials []webauthn.Credential
+}
+
+func (u *WebAuthnUser) WebAuthnID() []byte {
+	return []byte(u.Id)
+}
+
+func (u *WebAuthnUser) WebAuthnName() string {
+	return u.Name
+}
+
+func (u *WebAuthnUser) WebAuthnDisplayName() string {
+	if u.DisplayName == "" {
+		return u.Name
+	}
+
+	return u.DisplayName
+}
+
+func (u *WebAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	return u.Credentials
+}
+
+var ErrWebAuthnDisabled = errors.New("passkeys are not configured")
+
+// builds the relying party, ErrWebAuthnDisabled means passkeys are off
+func NewWebAuthn(cfg WebAuthnConfig) (*webauthn.WebAuthn, error) {
+	if cfg.RpId == "" || len(cfg.RpOrigins) == 0 {
+		return nil, ErrWebAuthnDisabled
+	}
+
+	return webauthn.New(&webauthn.Config{
+		RPID:          cfg.RpId,
+		RPDisplayName: cfg.RpDisplayName,
+		RPOrigins:     cfg.RpOrigins,
+	})
+}